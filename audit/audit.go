@@ -0,0 +1,198 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Actions recorded in the log
+const (
+	ActionCreateDatabase = "create_database"
+	ActionDropTable      = "drop_table"
+	ActionAlterTable     = "alter_table"
+	ActionInsertRow      = "insert_row"
+	ActionUpdateRow      = "update_row"
+	ActionDeleteRow      = "delete_row"
+	ActionImport         = "import"
+	ActionSQL            = "sql"
+)
+
+// Actions lists the actions in the order they are offered as filters
+var Actions = []string{
+	ActionCreateDatabase,
+	ActionDropTable,
+	ActionAlterTable,
+	ActionInsertRow,
+	ActionUpdateRow,
+	ActionDeleteRow,
+	ActionImport,
+	ActionSQL,
+}
+
+// Entry is one statement executed for a user
+type Entry struct {
+	Time     time.Time     `json:"time"`
+	ServerID string        `json:"server_id"`
+	Database string        `json:"database,omitempty"`
+	User     string        `json:"user"`
+	ClientIP string        `json:"client_ip"`
+	Action   string        `json:"action"`
+	SQL      string        `json:"sql"`
+	Args     []interface{} `json:"args,omitempty"`
+	// Source is the uploaded file of an import
+	Source string `json:"source,omitempty"`
+	// RowsAffected is -1 when unknown
+	RowsAffected int64  `json:"rows_affected"`
+	Error        string `json:"error,omitempty"`
+}
+
+// Filter selects entries. Empty fields match everything.
+type Filter struct {
+	ServerID string
+	User     string
+	Action   string
+	// Search is matched against the SQL text, case-insensitively
+	Search string
+	From   time.Time
+	To     time.Time
+}
+
+// Match reports whether an entry passes the filter
+func (f Filter) Match(e *Entry) bool {
+	switch {
+	case f.ServerID != "" && e.ServerID != f.ServerID:
+		return false
+	case f.User != "" && e.User != f.User:
+		return false
+	case f.Action != "" && e.Action != f.Action:
+		return false
+	case !f.From.IsZero() && e.Time.Before(f.From):
+		return false
+	case !f.To.IsZero() && !e.Time.Before(f.To):
+		return false
+	case f.Search != "" && !strings.Contains(strings.ToLower(e.SQL), strings.ToLower(f.Search)):
+		return false
+	}
+	return true
+}
+
+var (
+	mu       sync.Mutex
+	filename string
+	file     *os.File
+)
+
+// Open opens the log for appending, creating it readable by the owner only.
+// Entries are never rewritten.
+func Open(name string) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if file != nil {
+		file.Close()
+	}
+	filename = name
+	file = f
+	return nil
+}
+
+// Record appends an entry. A failed write is logged rather than returned, as
+// the statement has already run.
+func Record(e Entry) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("audit: %v", err)
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if file == nil {
+		log.Printf("audit: log is not open, dropped %s on %s", e.Action, e.ServerID)
+		return
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		log.Printf("audit: %v", err)
+	}
+}
+
+// Entries returns the newest entries matching the filter, newest first, and
+// whether older matching entries were left out
+func Entries(f Filter, limit int) ([]Entry, bool, error) {
+	var entries []Entry
+	more := false
+	err := scan(f, func(e *Entry, _ []byte) error {
+		entries = append(entries, *e)
+		if len(entries) > limit {
+			entries = entries[1:]
+			more = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries, more, nil
+}
+
+// WriteEntries copies the matching entries to w as JSON lines, oldest first
+func WriteEntries(w io.Writer, f Filter) error {
+	return scan(f, func(_ *Entry, line []byte) error {
+		if _, err := w.Write(line); err != nil {
+			return err
+		}
+		_, err := w.Write([]byte{'\n'})
+		return err
+	})
+}
+
+// scan calls fn for every matching entry of the log, oldest first. Lines that
+// cannot be parsed, such as one cut short by a crash, are skipped.
+func scan(f Filter, fn func(e *Entry, line []byte) error) error {
+	mu.Lock()
+	name := filename
+	mu.Unlock()
+
+	in, err := os.Open(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer in.Close()
+
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue
+		}
+		if !f.Match(&e) {
+			continue
+		}
+		if err := fn(&e, scanner.Bytes()); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
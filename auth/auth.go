@@ -0,0 +1,201 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"godbadmin/config"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// SessionCookie is the name of the cookie holding the session token
+const SessionCookie = "godbadmin_session"
+
+// SessionTimeout is how long a session stays valid without requests
+const SessionTimeout = 12 * time.Hour
+
+type session struct {
+	username string
+	expires  time.Time
+}
+
+var (
+	sessionsMu sync.Mutex
+	sessions   = make(map[string]*session)
+
+	setupMu    sync.Mutex
+	setupToken string
+)
+
+// publicPaths are reachable without logging in
+var publicPaths = map[string]bool{
+	"/login":            true,
+	"/setup":            true,
+	"/api/set-language": true,
+}
+
+// Middleware requires a logged-in user on every route except the login and
+// setup pages. Until the first account exists every page leads to the setup
+// page. Pages redirect to the login page; API and form posts get 401.
+func Middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			path := c.Request().URL.Path
+			if publicPaths[path] {
+				return next(c)
+			}
+
+			if config.GetUsers().Count() == 0 {
+				return c.Redirect(http.StatusSeeOther, "/setup")
+			}
+
+			if user, ok := sessionUser(c); ok {
+				c.Set("user", user)
+				return next(c)
+			}
+
+			if c.Request().Method != http.MethodGet || strings.HasPrefix(path, "/api/") {
+				return c.JSON(http.StatusUnauthorized, map[string]interface{}{
+					"success": false,
+					"error":   "Authentication required",
+				})
+			}
+			return c.Redirect(http.StatusSeeOther, "/login?next="+url.QueryEscape(c.Request().URL.RequestURI()))
+		}
+	}
+}
+
+// CurrentUser returns the logged-in user of a request, or nil on public pages
+func CurrentUser(c echo.Context) *config.User {
+	user, _ := c.Get("user").(*config.User)
+	return user
+}
+
+// sessionUser looks up the session of the request and extends it
+func sessionUser(c echo.Context) (*config.User, bool) {
+	cookie, err := c.Cookie(SessionCookie)
+	if err != nil {
+		return nil, false
+	}
+
+	sessionsMu.Lock()
+	s, found := sessions[cookie.Value]
+	if found && time.Now().After(s.expires) {
+		delete(sessions, cookie.Value)
+		found = false
+	}
+	if found {
+		s.expires = time.Now().Add(SessionTimeout)
+	}
+	sessionsMu.Unlock()
+
+	if !found {
+		return nil, false
+	}
+
+	// The account may have been deleted since the login
+	return config.GetUsers().GetUser(s.username)
+}
+
+// Login starts a session for the user and sets its cookie
+func Login(c echo.Context, username string) error {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	token := hex.EncodeToString(b)
+
+	sessionsMu.Lock()
+	// Drop expired sessions while here
+	now := time.Now()
+	for t, s := range sessions {
+		if now.After(s.expires) {
+			delete(sessions, t)
+		}
+	}
+	sessions[token] = &session{username: username, expires: now.Add(SessionTimeout)}
+	sessionsMu.Unlock()
+
+	c.SetCookie(&http.Cookie{
+		Name:     SessionCookie,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   c.IsTLS(),
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// Logout ends the session of the request and clears its cookie
+func Logout(c echo.Context) {
+	if cookie, err := c.Cookie(SessionCookie); err == nil {
+		sessionsMu.Lock()
+		delete(sessions, cookie.Value)
+		sessionsMu.Unlock()
+	}
+
+	c.SetCookie(&http.Cookie{
+		Name:     SessionCookie,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   c.IsTLS(),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// EndSessions logs a user out everywhere, after a password change or when the
+// account is deleted. The session of keep, if any, stays.
+func EndSessions(username string, keep echo.Context) {
+	keepToken := ""
+	if keep != nil {
+		if cookie, err := keep.Cookie(SessionCookie); err == nil {
+			keepToken = cookie.Value
+		}
+	}
+
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	for token, s := range sessions {
+		if s.username == username && token != keepToken {
+			delete(sessions, token)
+		}
+	}
+}
+
+// NewSetupToken creates the one-time token that the setup page asks for
+// before the first administrator is created. Only whoever can read the
+// startup log knows it.
+func NewSetupToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	setupMu.Lock()
+	defer setupMu.Unlock()
+	setupToken = hex.EncodeToString(b)
+	return setupToken, nil
+}
+
+// CheckSetupToken reports whether token is the current setup token
+func CheckSetupToken(token string) bool {
+	setupMu.Lock()
+	defer setupMu.Unlock()
+	return setupToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(setupToken)) == 1
+}
+
+// ClearSetupToken invalidates the setup token once the first account exists
+func ClearSetupToken() {
+	setupMu.Lock()
+	defer setupMu.Unlock()
+	setupToken = ""
+}
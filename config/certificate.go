@@ -0,0 +1,99 @@
+package config
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// selfSignedValidity is how long a generated certificate is valid. An
+// expired one is replaced at the next start.
+const selfSignedValidity = 2 * 365 * 24 * time.Hour
+
+// EnsureSelfSignedCert keeps a self-signed certificate for hosts in certFile
+// and keyFile, generating it when the files do not exist yet or the
+// certificate expired. It returns the SHA-256 fingerprint of the certificate,
+// to compare with the one a browser shows.
+func EnsureSelfSignedCert(certFile, keyFile string, hosts []string) (fingerprint string, generated bool, err error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	switch {
+	case err == nil && time.Now().Before(cert.Leaf.NotAfter):
+		return certFingerprint(cert.Leaf.Raw), false, nil
+	case err != nil && !os.IsNotExist(err):
+		return "", false, fmt.Errorf("TLS certificate: %w", err)
+	}
+
+	der, err := generateSelfSignedCert(certFile, keyFile, hosts)
+	if err != nil {
+		return "", false, fmt.Errorf("generating a TLS certificate: %w", err)
+	}
+	return certFingerprint(der), true, nil
+}
+
+func generateSelfSignedCert(certFile, keyFile string, hosts []string) ([]byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"godbadmin"}, CommonName: hosts[0]},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// The key first, so a certificate is never left without its key
+	if err := writeFileAtomic(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return nil, err
+	}
+	return der, nil
+}
+
+// certFingerprint formats the SHA-256 of a certificate as browsers show it
+func certFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
@@ -1,26 +1,213 @@
 package config
 
 import (
+	"crypto/sha256"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
 	"os"
+	"reflect"
+	"strconv"
 	"sync"
+	"time"
 )
 
+// Connection pool defaults for servers that leave the limits unset
+const (
+	DefaultMaxOpenConns = 10
+	DefaultMaxIdleConns = 2
+	DefaultIdleTimeout  = 300 // seconds
+)
+
+// DefaultSSHPort is used for SSH tunnels that leave the port unset
+const DefaultSSHPort = 22
+
+// TLS modes of a server connection, from the weakest to the strictest
+const (
+	TLSDisabled = "disabled"
+	// TLSPreferred encrypts when the server supports it, without verifying it
+	TLSPreferred = "preferred"
+	// TLSRequired encrypts without verifying the server certificate
+	TLSRequired = "required"
+	// TLSVerifyCA checks the certificate was signed by the CA
+	TLSVerifyCA = "verify-ca"
+	// TLSVerifyIdentity also checks the certificate is for the host
+	TLSVerifyIdentity = "verify-identity"
+)
+
+// TLSModes lists the TLS modes in the order the server form shows them
+var TLSModes = []string{TLSDisabled, TLSPreferred, TLSRequired, TLSVerifyCA, TLSVerifyIdentity}
+
 type ServerConfig struct {
-	ID       string `json:"id"`
-	Name     string `json:"name"`
-	DBType   string `json:"db_type"`
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	DBType string `json:"db_type"`
+	// Host is the database file path for SQLite
 	Host     string `json:"host"`
 	Port     int    `json:"port"`
 	User     string `json:"user"`
 	Password string `json:"password"`
 	Database string `json:"database"`
+
+	// Connection options. Zero values use the driver defaults.
+	//
+	// Socket is a Unix socket path used instead of Host for MySQL, or the
+	// socket directory for PostgreSQL.
+	Socket string `json:"socket,omitempty"`
+	// Timeouts are in seconds. Read and write timeouts are MySQL only.
+	ConnectTimeout int `json:"connect_timeout,omitempty"`
+	ReadTimeout    int `json:"read_timeout,omitempty"`
+	WriteTimeout   int `json:"write_timeout,omitempty"`
+	// Charset and Collation of the connection are MySQL only
+	Charset   string `json:"charset,omitempty"`
+	Collation string `json:"collation,omitempty"`
+	// TimeZone is an IANA name such as Asia/Tokyo: MySQL's loc for parsed
+	// times, PostgreSQL's session TimeZone
+	TimeZone string `json:"time_zone,omitempty"`
+	// Params are extra DSN parameters, added after the options above
+	Params map[string]string `json:"params,omitempty"`
+
+	// Connection pool limits. Zero uses the defaults.
+	MaxOpenConns int `json:"max_open_conns,omitempty"`
+	MaxIdleConns int `json:"max_idle_conns,omitempty"`
+	// IdleTimeout is in seconds
+	IdleTimeout int `json:"idle_timeout,omitempty"`
+
+	// Optional SSH tunnel through a jump host, for servers that only accept
+	// connections from inside their network. SSHHost empty means none.
+	SSHHost string `json:"ssh_host,omitempty"`
+	// SSHPort zero uses DefaultSSHPort
+	SSHPort          int    `json:"ssh_port,omitempty"`
+	SSHUser          string `json:"ssh_user,omitempty"`
+	SSHPassword      string `json:"ssh_password,omitempty"`
+	SSHKeyFile       string `json:"ssh_key_file,omitempty"`
+	SSHKeyPassphrase string `json:"ssh_key_passphrase,omitempty"`
+	// SSHKnownHosts is the known_hosts file checked for the jump host's key,
+	// ~/.ssh/known_hosts when empty
+	SSHKnownHosts       string `json:"ssh_known_hosts,omitempty"`
+	SSHSkipHostKeyCheck bool   `json:"ssh_skip_host_key_check,omitempty"`
+
+	// TLSMode is one of TLSModes. Empty means TLSDisabled.
+	TLSMode string `json:"tls_mode,omitempty"`
+	// PEM files of the CA certificate and the client certificate and key.
+	// Without a CA the system roots are used.
+	TLSCACert     string `json:"tls_ca_cert,omitempty"`
+	TLSClientCert string `json:"tls_client_cert,omitempty"`
+	TLSClientKey  string `json:"tls_client_key,omitempty"`
+}
+
+// Address returns the host and port, or the file path for SQLite.
+func (s ServerConfig) Address() string {
+	if s.DBType == "sqlite" {
+		return s.Host
+	}
+	if s.Socket != "" {
+		return s.Socket
+	}
+	return fmt.Sprintf("%s:%d", s.Host, s.Port)
+}
+
+// PoolLimits returns the connection pool limits with the defaults applied.
+func (s ServerConfig) PoolLimits() (maxOpen, maxIdle int, idleTimeout time.Duration) {
+	maxOpen, maxIdle, idle := s.MaxOpenConns, s.MaxIdleConns, s.IdleTimeout
+	if maxOpen <= 0 {
+		maxOpen = DefaultMaxOpenConns
+	}
+	if maxIdle <= 0 {
+		maxIdle = DefaultMaxIdleConns
+	}
+	if maxIdle > maxOpen {
+		maxIdle = maxOpen
+	}
+	if idle <= 0 {
+		idle = DefaultIdleTimeout
+	}
+	return maxOpen, maxIdle, time.Duration(idle) * time.Second
+}
+
+// UsesSSH reports whether the server is reached through an SSH tunnel.
+func (s ServerConfig) UsesSSH() bool {
+	return s.SSHHost != "" && s.DBType != "sqlite"
 }
 
+// SSHAddress returns the host and port of the SSH jump host.
+func (s ServerConfig) SSHAddress() string {
+	port := s.SSHPort
+	if port <= 0 {
+		port = DefaultSSHPort
+	}
+	return net.JoinHostPort(s.SSHHost, strconv.Itoa(port))
+}
+
+// TLS returns the TLS mode of the connection.
+func (s ServerConfig) TLS() string {
+	if s.TLSMode == "" || s.DBType == "sqlite" {
+		return TLSDisabled
+	}
+	return s.TLSMode
+}
+
+// Secrets returns the passwords and passphrases of the server, for redacting
+// them from messages.
+func (s ServerConfig) Secrets() []string {
+	var values []string
+	for _, secret := range s.secrets() {
+		values = append(values, *secret)
+	}
+	return values
+}
+
+// secrets returns the fields stored encrypted in the settings file.
+func (s *ServerConfig) secrets() []*string {
+	return []*string{&s.Password, &s.SSHPassword, &s.SSHKeyPassphrase}
+}
+
+// SettingsVersion is the format of settings.json written by this version.
+// Older files are brought up to date by settingsMigrations when loaded.
+const SettingsVersion = 1
+
+// settingsMigrations[n] converts settings of version n to version n+1. Add
+// one whenever the meaning of a field changes, rather than guessing from the
+// content of old files.
+var settingsMigrations = []func(*Settings) error{
+	// Version 0 is every file written before the version field, which has
+	// the format of version 1
+	func(*Settings) error { return nil },
+}
+
+// SettingsBackups is how many previous versions of settings.json are kept,
+// from settings.json.1 (the most recent) to settings.json.5
+const SettingsBackups = 5
+
+// SettingsWatchInterval is how often Watch looks for changes to settings.json
+const SettingsWatchInterval = 2 * time.Second
+
+// ErrSettingsChanged is returned by Save when another program changed
+// settings.json since it was read. The settings are reloaded from the file
+// instead, and the change has to be made again.
+var ErrSettingsChanged = errors.New("settings.json was changed by another program")
+
 type Settings struct {
-	Servers       []ServerConfig `json:"servers"`
-	EncryptionKey string         `json:"encryption_key,omitempty"`
-	mu            sync.RWMutex
+	// Version is the format of the file, see SettingsVersion
+	Version int            `json:"version"`
+	Servers []ServerConfig `json:"servers"`
+	// EncryptionKey is the key of settings without a master password
+	EncryptionKey string `json:"encryption_key,omitempty"`
+	// KDF derives the key from the master password, checked by decrypting
+	// KeyCheck
+	KDF      *KDFParams `json:"kdf,omitempty"`
+	KeyCheck string     `json:"key_check,omitempty"`
+
+	// key is the key derived from the master password
+	key []byte
+	// sum is the checksum of the file as last read or written, telling
+	// changes by other programs from ours
+	sum [sha256.Size]byte
+	// changed is called with the servers changed by a reload
+	changed func(serverIDs []string)
+	mu      sync.RWMutex
 }
 
 var (
@@ -37,66 +224,393 @@ func GetSettings() *Settings {
 	return settings
 }
 
-func (s *Settings) Load(filename string) error {
+// Load reads the settings and decrypts the server secrets. masterPassword
+// unlocks settings protected by one, and protects new settings from the
+// start. A missing file starts empty settings, unless backups show it was
+// lost. Files of an older version are migrated and saved again.
+func (s *Settings) Load(filename, masterPassword string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	data, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		if hasBackup(filename, SettingsBackups) {
+			return fmt.Errorf("%s is missing but its backups exist; restore %s or remove the backups", filename, backupName(filename, 1))
+		}
+		return s.unlock(masterPassword)
+	}
 	if err != nil {
-		if os.IsNotExist(err) {
-			return nil
+		return err
+	}
+
+	// Files written by older versions may be readable by anyone
+	if info, err := os.Stat(filename); err == nil && info.Mode().Perm()&0077 != 0 {
+		if err := os.Chmod(filename, 0600); err != nil {
+			return err
 		}
+	}
+
+	loaded, err := decodeSettings(data)
+	if err != nil {
+		return err
+	}
+	migrated := loaded.Version < SettingsVersion
+	if err := loaded.migrate(); err != nil {
 		return err
 	}
 
-	if err := json.Unmarshal(data, s); err != nil {
+	s.assign(loaded)
+	s.sum = sha256.Sum256(data)
+	if err := s.unlock(masterPassword); err != nil {
+		return err
+	}
+	if err := s.decryptSecrets(); err != nil {
 		return err
 	}
 
-	// Decrypt passwords
+	// The backup keeps the file as it was before the migration
+	if migrated {
+		return s.save(filename)
+	}
+	return nil
+}
+
+// decodeSettings parses settings.json without decrypting it.
+func decodeSettings(data []byte) (*Settings, error) {
+	loaded := &Settings{Servers: []ServerConfig{}}
+	if err := json.Unmarshal(data, loaded); err != nil {
+		return nil, err
+	}
+	if loaded.Version > SettingsVersion {
+		return nil, fmt.Errorf("settings version %d was written by a newer godbadmin, which supports up to version %d", loaded.Version, SettingsVersion)
+	}
+	return loaded, nil
+}
+
+// migrate brings the settings up to SettingsVersion.
+func (s *Settings) migrate() error {
+	for ; s.Version < SettingsVersion; s.Version++ {
+		if err := settingsMigrations[s.Version](s); err != nil {
+			return fmt.Errorf("migrating settings from version %d: %w", s.Version, err)
+		}
+	}
+	return nil
+}
+
+// assign replaces the settings with loaded ones.
+func (s *Settings) assign(loaded *Settings) {
+	s.Version = loaded.Version
+	s.Servers = loaded.Servers
+	s.EncryptionKey = loaded.EncryptionKey
+	s.KDF = loaded.KDF
+	s.KeyCheck = loaded.KeyCheck
+	s.key = loaded.key
+}
+
+// decryptSecrets decrypts the server secrets. A secret that cannot be
+// decrypted is an error rather than being taken for a plaintext password.
+func (s *Settings) decryptSecrets() error {
+	var key []byte
 	for i := range s.Servers {
-		if s.Servers[i].Password != "" {
-			decrypted, err := Decrypt(s.Servers[i].Password)
+		for _, secret := range s.Servers[i].secrets() {
+			if *secret == "" {
+				continue
+			}
+			if key == nil {
+				var err error
+				if key, err = s.encryptionKey(); err != nil {
+					return err
+				}
+			}
+			decrypted, err := decrypt(key, *secret)
+			if err != nil {
+				return fmt.Errorf("server %q: a password cannot be decrypted with the current key: %w", s.Servers[i].Name, err)
+			}
+			*secret = decrypted
+		}
+	}
+	return nil
+}
+
+// Reload reads the settings again when another program changed the file,
+// keeping the key in use. A missing file is left for the next Save to write
+// again.
+func (s *Settings) Reload(filename string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if sha256.Sum256(data) == s.sum {
+		return false, nil
+	}
+	return true, s.reload(data)
+}
+
+func (s *Settings) reload(data []byte) error {
+	loaded, err := decodeSettings(data)
+	if err != nil {
+		return err
+	}
+	if err := loaded.migrate(); err != nil {
+		return err
+	}
+
+	// The master password is not kept, so only a file encrypted with the
+	// key in use can be reloaded
+	if loaded.KDF != nil {
+		if s.KDF == nil || *loaded.KDF != *s.KDF || loaded.KeyCheck != s.KeyCheck {
+			return errors.New("the master password was changed; restart godbadmin to use the new one")
+		}
+		loaded.key = s.key
+	}
+	if err := loaded.decryptSecrets(); err != nil {
+		return err
+	}
+
+	changed := changedServers(s.Servers, loaded.Servers)
+	s.assign(loaded)
+	s.sum = sha256.Sum256(data)
+	if s.changed != nil && len(changed) > 0 {
+		s.changed(changed)
+	}
+	return nil
+}
+
+// changedServers returns the IDs of the servers added, edited or removed
+// between two versions of the settings.
+func changedServers(before, after []ServerConfig) []string {
+	previous := make(map[string]ServerConfig, len(before))
+	for _, server := range before {
+		previous[server.ID] = server
+	}
+
+	var ids []string
+	for _, server := range after {
+		if old, ok := previous[server.ID]; !ok || !reflect.DeepEqual(old, server) {
+			ids = append(ids, server.ID)
+		}
+		delete(previous, server.ID)
+	}
+	for id := range previous {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// Watch reloads the settings whenever another program changes the file, and
+// calls changed with the IDs of the servers that were added, edited or
+// removed, so their connections can be dropped.
+func (s *Settings) Watch(filename string, interval time.Duration, changed func(serverIDs []string)) {
+	s.mu.Lock()
+	s.changed = changed
+	s.mu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		// A file that cannot be reloaded is reported once, not on every tick
+		var lastErr string
+		for range ticker.C {
+			reloaded, err := s.Reload(filename)
 			if err != nil {
-				// If decryption fails, assume it's plain text (for backward compatibility)
-				// and encrypt it on next save
+				if err.Error() != lastErr {
+					log.Printf("config: %s was changed but cannot be reloaded: %v", filename, err)
+				}
+				lastErr = err.Error()
 				continue
 			}
-			s.Servers[i].Password = decrypted
+			lastErr = ""
+			if reloaded {
+				log.Printf("config: reloaded %s after it was changed", filename)
+			}
 		}
+	}()
+}
+
+// unlock derives the key from the master password when the settings use one.
+func (s *Settings) unlock(masterPassword string) error {
+	switch {
+	case s.KDF != nil:
+		if masterPassword == "" {
+			return ErrMasterPasswordRequired
+		}
+		key, err := s.KDF.deriveKey(masterPassword)
+		if err != nil {
+			return err
+		}
+		if check, err := decrypt(key, s.KeyCheck); err != nil || check != keyCheckValue {
+			return ErrWrongMasterPassword
+		}
+		s.key = key
+	case masterPassword != "" && s.EncryptionKey == "" && len(s.Servers) == 0:
+		return s.setMasterPassword(masterPassword)
+	}
+	return nil
+}
+
+// setMasterPassword derives a new key from the master password, with a new
+// salt, in place of the current key.
+func (s *Settings) setMasterPassword(masterPassword string) error {
+	kdf, err := newKDFParams()
+	if err != nil {
+		return err
+	}
+	key, err := kdf.deriveKey(masterPassword)
+	if err != nil {
+		return err
+	}
+	check, err := encrypt(key, keyCheckValue)
+	if err != nil {
+		return err
 	}
 
+	s.KDF, s.KeyCheck, s.key = kdf, check, key
+	s.EncryptionKey = ""
 	return nil
 }
 
+// UsesMasterPassword reports whether the key is derived from a master
+// password rather than stored in settings.json.
+func (s *Settings) UsesMasterPassword() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.KDF != nil
+}
+
+// RotateKey derives a new key from the master password and saves the
+// settings with every secret encrypted again. Settings keeping their key in
+// the file switch to the master password. Backups encrypted with the
+// previous key are removed.
+func (s *Settings) RotateKey(filename, masterPassword string) error {
+	if masterPassword == "" {
+		return errors.New("the new master password is empty")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.setMasterPassword(masterPassword); err != nil {
+		return err
+	}
+	return s.save(filename)
+}
+
 func (s *Settings) Save(filename string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	return s.save(filename)
+}
+
+// save writes the settings through a temporary file, readable by the owner
+// only, and keeps the previous file as the most recent backup. It refuses to
+// overwrite changes made by another program since the file was read.
+func (s *Settings) save(filename string) error {
+	current, err := os.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	exists := err == nil
+	if exists && sha256.Sum256(current) != s.sum {
+		if err := s.reload(current); err != nil {
+			return fmt.Errorf("%w, and cannot be reloaded: %v", ErrSettingsChanged, err)
+		}
+		return ErrSettingsChanged
+	}
+
 	// Create a copy with encrypted passwords
 	encrypted := Settings{
+		Version:       SettingsVersion,
 		Servers:       make([]ServerConfig, len(s.Servers)),
 		EncryptionKey: s.EncryptionKey, // Preserve encryption key
+		KDF:           s.KDF,
+		KeyCheck:      s.KeyCheck,
 	}
 	copy(encrypted.Servers, s.Servers)
 
 	// Encrypt passwords
+	var key []byte
 	for i := range encrypted.Servers {
-		if encrypted.Servers[i].Password != "" {
-			encryptedPwd, err := Encrypt(encrypted.Servers[i].Password)
+		for _, secret := range encrypted.Servers[i].secrets() {
+			if *secret == "" {
+				continue
+			}
+			if key == nil {
+				if key, err = s.encryptionKey(); err != nil {
+					return err
+				}
+			}
+			encryptedPwd, err := encrypt(key, *secret)
 			if err != nil {
 				return err
 			}
-			encrypted.Servers[i].Password = encryptedPwd
+			*secret = encryptedPwd
 		}
 	}
 
-	data, err := json.MarshalIndent(encrypted, "", "  ")
+	// A key generated for the first password is stored with the settings
+	encrypted.EncryptionKey = s.EncryptionKey
+
+	data, err := json.MarshalIndent(&encrypted, "", "  ")
 	if err != nil {
 		return err
 	}
 
-	return os.WriteFile(filename, data, 0644)
+	if exists {
+		if err := s.backup(filename, current); err != nil {
+			return fmt.Errorf("backup of %s: %w", filename, err)
+		}
+	}
+	if err := writeFileAtomic(filename, data, 0600); err != nil {
+		return err
+	}
+	s.sum = sha256.Sum256(data)
+	return nil
+}
+
+// backup keeps current as the most recent backup of filename. Under a master
+// password only files encrypted with its key are kept: a backup holding
+// encryption_key, or written before RotateKey, would still reveal the secrets
+// with the key the master password replaced.
+func (s *Settings) backup(filename string, current []byte) error {
+	if s.KDF == nil {
+		return writeBackup(filename, current, SettingsBackups, 0600)
+	}
+
+	for n := 1; n <= SettingsBackups; n++ {
+		data, err := os.ReadFile(backupName(filename, n))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !s.encryptedWithKey(data) {
+			if err := os.Remove(backupName(filename, n)); err != nil {
+				return err
+			}
+		}
+	}
+	if !s.encryptedWithKey(current) {
+		return nil
+	}
+	return writeBackup(filename, current, SettingsBackups, 0600)
+}
+
+// encryptedWithKey reports whether a settings file is encrypted with the key
+// derived from the current master password.
+func (s *Settings) encryptedWithKey(data []byte) bool {
+	var file Settings
+	if err := json.Unmarshal(data, &file); err != nil {
+		return false
+	}
+	return file.EncryptionKey == "" && file.KDF != nil && *file.KDF == *s.KDF && file.KeyCheck == s.KeyCheck
 }
 
 func (s *Settings) AddServer(server ServerConfig) {
@@ -0,0 +1,241 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeSettings saves servers to a new settings file with a key kept in the
+// file, as settings without a master password are.
+func writeSettings(t *testing.T, servers ...ServerConfig) string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "settings.json")
+	s := &Settings{Servers: servers}
+	if err := s.Save(filename); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	return filename
+}
+
+func readVersion(t *testing.T, filename string) int {
+	t.Helper()
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var file struct {
+		Version int `json:"version"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		t.Fatal(err)
+	}
+	return file.Version
+}
+
+func TestLoadMigratesSettings(t *testing.T) {
+	tests := []struct {
+		name       string
+		content    string
+		wantErr    bool
+		wantBackup bool
+	}{
+		{
+			name:       "version 0",
+			content:    `{"servers": [{"id": "s1", "name": "local", "db_type": "sqlite", "host": "/tmp/app.db"}]}`,
+			wantBackup: true,
+		},
+		{
+			name:    "current version",
+			content: `{"version": 1, "servers": [{"id": "s1", "name": "local", "db_type": "sqlite", "host": "/tmp/app.db"}]}`,
+		},
+		{
+			name:    "newer version",
+			content: `{"version": 99, "servers": []}`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid JSON",
+			content: `{"servers": [`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "settings.json")
+			if err := os.WriteFile(filename, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			s := &Settings{}
+			err := s.Load(filename, "")
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("Load() succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Load() error = %v", err)
+			}
+
+			if s.Version != SettingsVersion || readVersion(t, filename) != SettingsVersion {
+				t.Errorf("version %d, file version %d, want %d", s.Version, readVersion(t, filename), SettingsVersion)
+			}
+			if len(s.Servers) != 1 || s.Servers[0].ID != "s1" {
+				t.Errorf("servers = %+v, want s1", s.Servers)
+			}
+			info, err := os.Stat(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if perm := info.Mode().Perm(); perm != 0600 {
+				t.Errorf("file mode %o, want 600", perm)
+			}
+
+			backup, err := os.ReadFile(backupName(filename, 1))
+			if tt.wantBackup {
+				if err != nil || string(backup) != tt.content {
+					t.Errorf("backup = %q (%v), want the file before the migration", backup, err)
+				}
+			} else if err == nil {
+				t.Error("a backup was written without a migration")
+			}
+		})
+	}
+}
+
+func TestLoadMissingFileWithBackups(t *testing.T) {
+	filename := writeSettings(t)
+	if err := (&Settings{}).Load(filename, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filename, backupName(filename, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := (&Settings{}).Load(filename, ""); err == nil {
+		t.Error("Load() started empty settings although backups exist")
+	}
+}
+
+func TestRotateKey(t *testing.T) {
+	server := ServerConfig{ID: "s1", Name: "db", DBType: "mysql", Host: "localhost", Port: 3306, User: "app", Password: "db-password", SSHPassword: "ssh-password"}
+	filename := writeSettings(t, server)
+
+	s := &Settings{}
+	if err := s.Load(filename, ""); err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if err := s.RotateKey(filename, ""); err == nil {
+		t.Error("RotateKey() accepted an empty master password")
+	}
+	if err := s.RotateKey(filename, "first master"); err != nil {
+		t.Fatalf("RotateKey() error = %v", err)
+	}
+	if err := s.RotateKey(filename, "second master"); err != nil {
+		t.Fatalf("RotateKey() error = %v", err)
+	}
+
+	tests := []struct {
+		name           string
+		masterPassword string
+		wantErr        error
+	}{
+		{"new password", "second master", nil},
+		{"previous password", "first master", ErrWrongMasterPassword},
+		{"no password", "", ErrMasterPasswordRequired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loaded := &Settings{}
+			err := loaded.Load(filename, tt.masterPassword)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Load() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if !loaded.UsesMasterPassword() || loaded.EncryptionKey != "" {
+				t.Error("the key is still stored in the file")
+			}
+			got, _ := loaded.GetServer("s1")
+			if got == nil || got.Password != server.Password || got.SSHPassword != server.SSHPassword {
+				t.Errorf("server = %+v, want the secrets of %+v", got, server)
+			}
+		})
+	}
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var file Settings
+	if err := json.Unmarshal(data, &file); err != nil {
+		t.Fatal(err)
+	}
+	if file.Servers[0].Password == server.Password || file.EncryptionKey != "" {
+		t.Error("settings.json holds a plaintext password or the key")
+	}
+}
+
+func TestRotateKeyRemovesBackups(t *testing.T) {
+	filename := writeSettings(t, ServerConfig{ID: "s1", Name: "db", DBType: "mysql", Host: "localhost", User: "app", Password: "db-password"})
+	s := &Settings{}
+	if err := s.Load(filename, ""); err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	type backupFile struct {
+		EncryptionKey string     `json:"encryption_key"`
+		KDF           *KDFParams `json:"kdf"`
+	}
+	backups := func() []backupFile {
+		var files []backupFile
+		for n := 1; n <= SettingsBackups; n++ {
+			data, err := os.ReadFile(backupName(filename, n))
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var file backupFile
+			if err := json.Unmarshal(data, &file); err != nil {
+				t.Fatalf("backup %d: %v", n, err)
+			}
+			files = append(files, file)
+		}
+		return files
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := s.Save(filename); err != nil {
+			t.Fatalf("Save() error = %v", err)
+		}
+	}
+	if got := backups(); len(got) != 2 || got[0].EncryptionKey == "" {
+		t.Fatalf("backups before the master password = %+v, want 2 with the key", got)
+	}
+
+	for _, masterPassword := range []string{"first master", "second master"} {
+		if err := s.RotateKey(filename, masterPassword); err != nil {
+			t.Fatalf("RotateKey() error = %v", err)
+		}
+		if got := backups(); len(got) != 0 {
+			t.Errorf("backups after RotateKey(%q) = %+v, want none", masterPassword, got)
+		}
+
+		// Later saves keep backups under the new key again
+		if err := s.Save(filename); err != nil {
+			t.Fatalf("Save() error = %v", err)
+		}
+		got := backups()
+		if len(got) != 1 || got[0].EncryptionKey != "" || got[0].KDF == nil || *got[0].KDF != *s.KDF {
+			t.Errorf("backups after saving = %+v, want 1 under the key of %q", got, masterPassword)
+		}
+	}
+}
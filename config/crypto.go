@@ -7,40 +7,155 @@ import (
 	"encoding/base64"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/term"
+)
+
+// Environment variables holding the master password of settings.json, and
+// the new one for rotate-key
+const (
+	MasterPasswordEnv    = "GODBADMIN_MASTER_PASSWORD"
+	NewMasterPasswordEnv = "GODBADMIN_NEW_MASTER_PASSWORD"
 )
 
-// GetEncryptionKey returns the encryption key from Settings or generates a new one
+var (
+	// ErrMasterPasswordRequired is returned by Load when the settings are
+	// protected by a master password and none was given.
+	ErrMasterPasswordRequired = errors.New("settings are encrypted with a master password, but none was given")
+	// ErrWrongMasterPassword is returned by Load when the master password
+	// does not derive the key of the settings.
+	ErrWrongMasterPassword = errors.New("wrong master password")
+)
+
+// keyCheckValue is encrypted into KeyCheck to recognize a wrong master
+// password before decrypting anything else.
+const keyCheckValue = "godbadmin-key-check"
+
+// KDFParams are the Argon2id parameters deriving the encryption key from the
+// master password. The salt is random for each key.
+type KDFParams struct {
+	Algorithm string `json:"algorithm"`
+	Salt      string `json:"salt"`
+	Time      uint32 `json:"time"`
+	// Memory is in KiB
+	Memory  uint32 `json:"memory"`
+	Threads uint8  `json:"threads"`
+}
+
+func newKDFParams() (*KDFParams, error) {
+	salt := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	return &KDFParams{
+		Algorithm: "argon2id",
+		Salt:      base64.StdEncoding.EncodeToString(salt),
+		Time:      3,
+		Memory:    64 * 1024,
+		Threads:   4,
+	}, nil
+}
+
+func (p *KDFParams) deriveKey(masterPassword string) ([]byte, error) {
+	if p.Algorithm != "argon2id" {
+		return nil, fmt.Errorf("unknown key derivation %q", p.Algorithm)
+	}
+	salt, err := base64.StdEncoding.DecodeString(p.Salt)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key derivation salt: %w", err)
+	}
+	return argon2.IDKey([]byte(masterPassword), salt, p.Time, p.Memory, p.Threads, 32), nil
+}
+
+// MasterPassword returns the master password from the environment or, when
+// keyFile is set, from the first line of that file. It is empty when neither
+// holds one.
+func MasterPassword(env, keyFile string) (string, error) {
+	if keyFile != "" {
+		data, err := os.ReadFile(keyFile)
+		if err != nil {
+			return "", fmt.Errorf("master key file: %w", err)
+		}
+		line, _, _ := strings.Cut(string(data), "\n")
+		return strings.TrimRight(line, "\r"), nil
+	}
+	return os.Getenv(env), nil
+}
+
+// CanPrompt reports whether a password can be asked on the terminal.
+func CanPrompt() bool {
+	return term.IsTerminal(int(os.Stdin.Fd()))
+}
+
+// PromptPassword asks for a password on the terminal without echoing it.
+func PromptPassword(prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	password, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	return string(password), err
+}
+
+// GetEncryptionKey returns the key encrypting the server secrets: the one
+// derived from the master password when the settings use one, otherwise the
+// key stored in settings.json, generated on first use.
 // Note: This function assumes the caller already holds the mutex lock if needed
-func GetEncryptionKey() []byte {
-	settings := GetSettings()
+func GetEncryptionKey() ([]byte, error) {
+	return GetSettings().encryptionKey()
+}
+
+func (s *Settings) encryptionKey() ([]byte, error) {
+	if s.key != nil {
+		return s.key, nil
+	}
+	if s.KDF != nil {
+		return nil, ErrMasterPasswordRequired
+	}
 
 	// If key exists in settings, decode and return it
-	if settings.EncryptionKey != "" {
-		if key, err := hex.DecodeString(settings.EncryptionKey); err == nil && len(key) == 32 {
-			return key
+	if s.EncryptionKey != "" {
+		key, err := hex.DecodeString(s.EncryptionKey)
+		if err != nil || len(key) != 32 {
+			return nil, errors.New("invalid encryption_key in settings")
 		}
+		return key, nil
 	}
 
 	// Generate new key
 	key := make([]byte, 32)
 	if _, err := io.ReadFull(rand.Reader, key); err != nil {
-		// Fallback to a deterministic key if random generation fails
-		fallback := "godbadmin-fallback-key-32bytes!"
-		copy(key, []byte(fallback))
-		return key[:32]
+		return nil, err
 	}
 
 	// Store key in settings
-	settings.EncryptionKey = hex.EncodeToString(key)
+	s.EncryptionKey = hex.EncodeToString(key)
 
-	return key
+	return key, nil
 }
 
 // Encrypt encrypts plain text using AES-256-GCM
 func Encrypt(plaintext string) (string, error) {
-	key := GetEncryptionKey()
+	key, err := GetEncryptionKey()
+	if err != nil {
+		return "", err
+	}
+	return encrypt(key, plaintext)
+}
 
+// Decrypt decrypts cipher text using AES-256-GCM
+func Decrypt(ciphertext string) (string, error) {
+	key, err := GetEncryptionKey()
+	if err != nil {
+		return "", err
+	}
+	return decrypt(key, ciphertext)
+}
+
+func encrypt(key []byte, plaintext string) (string, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return "", err
@@ -60,10 +175,7 @@ func Encrypt(plaintext string) (string, error) {
 	return base64.StdEncoding.EncodeToString(ciphertext), nil
 }
 
-// Decrypt decrypts cipher text using AES-256-GCM
-func Decrypt(ciphertext string) (string, error) {
-	key := GetEncryptionKey()
-
+func decrypt(key []byte, ciphertext string) (string, error) {
 	data, err := base64.StdEncoding.DecodeString(ciphertext)
 	if err != nil {
 		return "", err
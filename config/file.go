@@ -0,0 +1,77 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// writeFileAtomic replaces filename with data through a temporary file in
+// the same directory, so a crash leaves either the old or the new content.
+func writeFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		return err
+	}
+
+	// Persist the rename itself; not every platform can sync a directory
+	if dir, err := os.Open(filepath.Dir(filename)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
+
+// backupName returns the name of the nth backup of filename, 1 being the
+// most recent.
+func backupName(filename string, n int) string {
+	return fmt.Sprintf("%s.%d", filename, n)
+}
+
+// writeBackup keeps data as the most recent of count backups of filename,
+// shifting the older ones and dropping the oldest.
+func writeBackup(filename string, data []byte, count int, perm os.FileMode) error {
+	if count <= 0 {
+		return nil
+	}
+	if err := os.Remove(backupName(filename, count)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for n := count - 1; n >= 1; n-- {
+		if err := os.Rename(backupName(filename, n), backupName(filename, n+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return writeFileAtomic(backupName(filename, 1), data, perm)
+}
+
+// hasBackup reports whether a backup of filename exists.
+func hasBackup(filename string, count int) bool {
+	for n := 1; n <= count; n++ {
+		if _, err := os.Stat(backupName(filename, n)); err == nil {
+			return true
+		}
+	}
+	return false
+}
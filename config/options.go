@@ -0,0 +1,241 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Environment variables setting the options, overridden by the command line
+const (
+	OptionsFileEnv   = "GODBADMIN_CONFIG"
+	DataDirEnv       = "GODBADMIN_DATA_DIR"
+	SettingsFileEnv  = "GODBADMIN_SETTINGS"
+	BindEnv          = "GODBADMIN_BIND"
+	PortEnv          = "GODBADMIN_PORT"
+	PortProbeEnv     = "GODBADMIN_PORT_PROBE"
+	MasterKeyFileEnv = "GODBADMIN_MASTER_KEY_FILE"
+	TLSCertEnv       = "GODBADMIN_TLS_CERT"
+	TLSKeyEnv        = "GODBADMIN_TLS_KEY"
+	TLSSelfSignedEnv = "GODBADMIN_TLS_SELF_SIGNED"
+	HTTPRedirectEnv  = "GODBADMIN_HTTP_REDIRECT_PORT"
+	HSTSMaxAgeEnv    = "GODBADMIN_HSTS_MAX_AGE"
+	TrustedProxyEnv  = "GODBADMIN_TRUSTED_PROXIES"
+)
+
+// DefaultHSTSMaxAge tells browsers to use HTTPS only for a year
+const DefaultHSTSMaxAge = 365 * 24 * 60 * 60
+
+// Options are how godbadmin runs. They come from an options file, then the
+// environment, then the command line, each overriding the previous.
+type Options struct {
+	// DataDir holds settings.json, users.json and audit.jsonl
+	DataDir string `json:"data_dir"`
+	// SettingsFile is settings.json in DataDir unless set
+	SettingsFile string `json:"settings_file"`
+	// Bind is the address to listen on; empty listens on every interface
+	Bind string `json:"bind"`
+	Port int    `json:"port"`
+	// PortProbe tries the next ports when Port is in use
+	PortProbe     bool   `json:"port_probe"`
+	MasterKeyFile string `json:"master_key_file"`
+
+	// TLSCert and TLSKey serve HTTPS with a certificate of their own
+	TLSCert string `json:"tls_cert"`
+	TLSKey  string `json:"tls_key"`
+	// TLSSelfSigned serves HTTPS with a certificate generated on first run
+	// and kept in DataDir, unless TLSCert and TLSKey name its files
+	TLSSelfSigned bool `json:"tls_self_signed"`
+	// HTTPRedirectPort, when set, redirects plain HTTP on that port to HTTPS
+	HTTPRedirectPort int `json:"http_redirect_port"`
+	// HSTSMaxAge is the max-age in seconds of the Strict-Transport-Security
+	// header sent over HTTPS; 0 sends none
+	HSTSMaxAge int `json:"hsts_max_age"`
+
+	// TrustedProxies are the addresses or CIDR ranges of reverse proxies
+	// whose X-Forwarded-For header gives the client address. Without any,
+	// the client address is the one connecting.
+	TrustedProxies []string `json:"trusted_proxies"`
+}
+
+// DefaultOptions returns the options of a plain start from a working copy:
+// files in the current directory, reachable from this machine only.
+func DefaultOptions() Options {
+	return Options{
+		DataDir:    ".",
+		Bind:       "127.0.0.1",
+		Port:       8000,
+		PortProbe:  true,
+		HSTSMaxAge: DefaultHSTSMaxAge,
+	}
+}
+
+// LoadFile reads the options set in a JSON file. Relative paths in it are
+// relative to the file, so it does not depend on the working directory.
+func (o *Options) LoadFile(filename string) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	// Fields missing from the file keep their current values
+	loaded := *o
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&loaded); err != nil {
+		return fmt.Errorf("%s: %w", filename, err)
+	}
+
+	var set Options
+	json.Unmarshal(data, &set)
+	dir := filepath.Dir(filename)
+	for _, path := range []struct{ set, loaded *string }{
+		{&set.DataDir, &loaded.DataDir},
+		{&set.SettingsFile, &loaded.SettingsFile},
+		{&set.MasterKeyFile, &loaded.MasterKeyFile},
+		{&set.TLSCert, &loaded.TLSCert},
+		{&set.TLSKey, &loaded.TLSKey},
+	} {
+		if *path.set != "" && !filepath.IsAbs(*path.set) {
+			*path.loaded = filepath.Join(dir, *path.set)
+		}
+	}
+
+	*o = loaded
+	return nil
+}
+
+// LoadEnv reads the options set in the environment.
+func (o *Options) LoadEnv() error {
+	for env, value := range map[string]*string{
+		DataDirEnv:       &o.DataDir,
+		SettingsFileEnv:  &o.SettingsFile,
+		BindEnv:          &o.Bind,
+		MasterKeyFileEnv: &o.MasterKeyFile,
+		TLSCertEnv:       &o.TLSCert,
+		TLSKeyEnv:        &o.TLSKey,
+	} {
+		if v, ok := os.LookupEnv(env); ok {
+			*value = v
+		}
+	}
+
+	if v, ok := os.LookupEnv(TrustedProxyEnv); ok {
+		o.TrustedProxies = SplitList(v)
+	}
+
+	for env, value := range map[string]*int{
+		PortEnv:         &o.Port,
+		HTTPRedirectEnv: &o.HTTPRedirectPort,
+		HSTSMaxAgeEnv:   &o.HSTSMaxAge,
+	} {
+		if v := os.Getenv(env); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("%s: %w", env, err)
+			}
+			*value = n
+		}
+	}
+
+	for env, value := range map[string]*bool{
+		PortProbeEnv:     &o.PortProbe,
+		TLSSelfSignedEnv: &o.TLSSelfSigned,
+	} {
+		if v := os.Getenv(env); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return fmt.Errorf("%s: %w", env, err)
+			}
+			*value = b
+		}
+	}
+	return nil
+}
+
+// Validate reports options that cannot be used together.
+func (o Options) Validate() error {
+	switch {
+	case (o.TLSCert == "") != (o.TLSKey == ""):
+		return errors.New("the TLS certificate and key must be set together")
+	case o.HTTPRedirectPort != 0 && !o.TLS():
+		return errors.New("redirecting HTTP to HTTPS needs a TLS certificate or tls_self_signed")
+	case o.HTTPRedirectPort != 0 && o.HTTPRedirectPort == o.Port:
+		return errors.New("the HTTP redirect port must differ from the port")
+	case o.HSTSMaxAge < 0:
+		return errors.New("hsts_max_age cannot be negative")
+	}
+	_, err := o.TrustedProxyRanges()
+	return err
+}
+
+// TrustedProxyRanges parses TrustedProxies; a single address is a range of
+// one.
+func (o Options) TrustedProxyRanges() ([]*net.IPNet, error) {
+	var ranges []*net.IPNet
+	for _, proxy := range o.TrustedProxies {
+		if ip := net.ParseIP(proxy); ip != nil {
+			bits := 8 * len(ip)
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			ranges = append(ranges, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy %q is neither an address nor a CIDR range", proxy)
+		}
+		ranges = append(ranges, ipNet)
+	}
+	return ranges, nil
+}
+
+// SplitList splits a comma-separated list, dropping blank entries.
+func SplitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// TLS reports whether the UI is served over HTTPS.
+func (o Options) TLS() bool {
+	return o.TLSCert != "" || o.TLSSelfSigned
+}
+
+// TLSFiles returns the certificate and key served over HTTPS. The
+// self-signed certificate is kept in DataDir unless its files are named.
+func (o Options) TLSFiles() (certFile, keyFile string) {
+	if o.TLSCert != "" {
+		return o.TLSCert, o.TLSKey
+	}
+	return filepath.Join(o.DataDir, "tls-cert.pem"), filepath.Join(o.DataDir, "tls-key.pem")
+}
+
+// SettingsPath returns the server settings file.
+func (o Options) SettingsPath() string {
+	if o.SettingsFile != "" {
+		return o.SettingsFile
+	}
+	return filepath.Join(o.DataDir, "settings.json")
+}
+
+// UsersPath returns the user accounts file.
+func (o Options) UsersPath() string {
+	return filepath.Join(o.DataDir, "users.json")
+}
+
+// AuditPath returns the audit log.
+func (o Options) AuditPath() string {
+	return filepath.Join(o.DataDir, "audit.jsonl")
+}
@@ -0,0 +1,342 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// MinPasswordLength is the shortest password accepted for an account
+const MinPasswordLength = 8
+
+var (
+	ErrInvalidUsername  = errors.New("invalid username")
+	ErrPasswordTooShort = errors.New("password is too short")
+	ErrUserExists       = errors.New("user already exists")
+	ErrUserNotFound     = errors.New("user not found")
+	ErrLastAdmin        = errors.New("the last administrator cannot be removed")
+)
+
+// Role is what a user may do on one saved server
+type Role string
+
+const (
+	// RoleNone hides the server from the user
+	RoleNone Role = ""
+	// RoleViewer browses and exports data
+	RoleViewer Role = "viewer"
+	// RoleEditor also inserts, updates and deletes rows
+	RoleEditor Role = "editor"
+	// RoleAdmin also changes table structure, drops tables, creates
+	// databases, runs arbitrary SQL and edits the server settings
+	RoleAdmin Role = "admin"
+)
+
+// Roles lists the roles from the least to the most privileged
+var Roles = []Role{RoleViewer, RoleEditor, RoleAdmin}
+
+func (r Role) rank() int {
+	for i, role := range Roles {
+		if role == r {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// Includes reports whether r grants everything required grants
+func (r Role) Includes(required Role) bool {
+	return required.rank() > 0 && r.rank() >= required.rank()
+}
+
+// ParseRole accepts the name of a role or an empty string for RoleNone
+func ParseRole(name string) (Role, bool) {
+	role := Role(name)
+	return role, role == RoleNone || role.rank() > 0
+}
+
+// User is a local account of the web UI
+type User struct {
+	Username     string `json:"username"`
+	PasswordHash string `json:"password_hash"`
+	// Admin accounts manage the other accounts and the list of servers, and
+	// have RoleAdmin on every server
+	Admin bool `json:"admin"`
+	// Roles maps server IDs to the role on that server
+	Roles     map[string]Role `json:"roles,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// RoleFor returns the role of the user on a server
+func (user *User) RoleFor(serverID string) Role {
+	if user.Admin {
+		return RoleAdmin
+	}
+	return user.Roles[serverID]
+}
+
+// Can reports whether the user has at least the given role on a server
+func (user *User) Can(serverID string, required Role) bool {
+	return user != nil && user.RoleFor(serverID).Includes(required)
+}
+
+// ManagesAnyServer reports whether the user may edit the settings of at
+// least one server, and so test connections from the server form
+func (user *User) ManagesAnyServer() bool {
+	if user == nil {
+		return false
+	}
+	if user.Admin {
+		return true
+	}
+	for _, role := range user.Roles {
+		if role.Includes(RoleAdmin) {
+			return true
+		}
+	}
+	return false
+}
+
+type Users struct {
+	Users []User `json:"users"`
+	mu    sync.RWMutex
+}
+
+var (
+	users     *Users
+	usersOnce sync.Once
+)
+
+// dummyHash is compared against when a username does not exist, so that a
+// login takes as long for unknown users as for a wrong password
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("godbadmin-dummy-password"), bcrypt.DefaultCost)
+
+func GetUsers() *Users {
+	usersOnce.Do(func() {
+		users = &Users{
+			Users: []User{},
+		}
+	})
+	return users
+}
+
+func (u *Users) Load(filename string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	return json.Unmarshal(data, u)
+}
+
+// Save writes the accounts readable by the owner only, as they hold password
+// hashes, through a temporary file so a crash cannot truncate them
+func (u *Users) Save(filename string) error {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+
+	data, err := json.MarshalIndent(u, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(filename, data, 0600)
+}
+
+// Count returns the number of accounts
+func (u *Users) Count() int {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return len(u.Users)
+}
+
+func (u *Users) GetUser(username string) (*User, bool) {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+
+	for _, user := range u.Users {
+		if user.Username == username {
+			return &user, true
+		}
+	}
+	return nil, false
+}
+
+func (u *Users) GetUsers() []User {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+
+	list := make([]User, len(u.Users))
+	copy(list, u.Users)
+	return list
+}
+
+// AddUser creates an account with a bcrypt hash of the password
+func (u *Users) AddUser(username, password string, admin bool) error {
+	username = strings.TrimSpace(username)
+	if !validUsername(username) {
+		return ErrInvalidUsername
+	}
+
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	for _, user := range u.Users {
+		if strings.EqualFold(user.Username, username) {
+			return ErrUserExists
+		}
+	}
+
+	u.Users = append(u.Users, User{
+		Username:     username,
+		PasswordHash: hash,
+		Admin:        admin,
+		CreatedAt:    time.Now(),
+	})
+	return nil
+}
+
+func (u *Users) SetPassword(username, password string) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	for i := range u.Users {
+		if u.Users[i].Username == username {
+			u.Users[i].PasswordHash = hash
+			return nil
+		}
+	}
+	return ErrUserNotFound
+}
+
+// SetRoles replaces the server roles of an account. Servers with RoleNone
+// are left out.
+func (u *Users) SetRoles(username string, roles map[string]Role) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	for i := range u.Users {
+		if u.Users[i].Username == username {
+			kept := make(map[string]Role)
+			for serverID, role := range roles {
+				if role != RoleNone {
+					kept[serverID] = role
+				}
+			}
+			u.Users[i].Roles = kept
+			return nil
+		}
+	}
+	return ErrUserNotFound
+}
+
+// RemoveServer drops the roles on a deleted server
+func (u *Users) RemoveServer(serverID string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	// The maps are replaced rather than changed, as GetUser hands out copies
+	// of the accounts that share them
+	for i, user := range u.Users {
+		if _, found := user.Roles[serverID]; !found {
+			continue
+		}
+		kept := make(map[string]Role)
+		for id, role := range user.Roles {
+			if id != serverID {
+				kept[id] = role
+			}
+		}
+		u.Users[i].Roles = kept
+	}
+}
+
+// DeleteUser removes an account. The last administrator is kept so that
+// accounts can still be managed.
+func (u *Users) DeleteUser(username string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	admins := 0
+	index := -1
+	for i, user := range u.Users {
+		if user.Admin {
+			admins++
+		}
+		if user.Username == username {
+			index = i
+		}
+	}
+	if index == -1 {
+		return ErrUserNotFound
+	}
+	if u.Users[index].Admin && admins == 1 {
+		return ErrLastAdmin
+	}
+
+	u.Users = append(u.Users[:index], u.Users[index+1:]...)
+	return nil
+}
+
+// Authenticate returns the account when the password matches
+func (u *Users) Authenticate(username, password string) (*User, bool) {
+	user, found := u.GetUser(username)
+	if !found {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return nil, false
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) != nil {
+		return nil, false
+	}
+	return user, true
+}
+
+func hashPassword(password string) (string, error) {
+	if len(password) < MinPasswordLength {
+		return "", ErrPasswordTooShort
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// validUsername allows letters, digits and ._@- so names are safe in URLs and logs
+func validUsername(username string) bool {
+	if username == "" || len(username) > 64 {
+		return false
+	}
+	for _, r := range username {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '.' || r == '_' || r == '@' || r == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
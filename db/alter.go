@@ -0,0 +1,142 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ColumnEdit is one column row submitted from the table structure editor.
+type ColumnEdit struct {
+	// Original is the current name of the column, empty for a new column
+	Original string
+	Name     string
+	Type     string
+	Nullable bool
+	// Default is written the way GetTableColumns reports it; empty means no default
+	Default string
+	Drop    bool
+}
+
+// ColumnEditsFromColumns returns editor rows for the current columns of a table.
+func ColumnEditsFromColumns(columns []ColumnInfo) []ColumnEdit {
+	edits := make([]ColumnEdit, len(columns))
+	for i, col := range columns {
+		edits[i] = ColumnEdit{
+			Original: col.Field,
+			Name:     col.Field,
+			Type:     col.Type,
+			Nullable: col.Null == "YES",
+		}
+		if col.Default != nil {
+			edits[i].Default = *col.Default
+		}
+	}
+	return edits
+}
+
+// columnDiff records which attributes of an existing column were edited.
+type columnDiff struct {
+	Rename  bool
+	Type    bool
+	Null    bool
+	Default bool
+}
+
+func diffColumn(current ColumnInfo, edit ColumnEdit) columnDiff {
+	currentDefault := ""
+	if current.Default != nil {
+		currentDefault = *current.Default
+	}
+
+	return columnDiff{
+		Rename:  edit.Name != current.Field,
+		Type:    !strings.EqualFold(edit.Type, current.Type),
+		Null:    edit.Nullable != (current.Null == "YES"),
+		Default: edit.Default != currentDefault,
+	}
+}
+
+// modified reports whether the column definition, not just its name, changed.
+func (d columnDiff) modified() bool {
+	return d.Type || d.Null || d.Default
+}
+
+// BuildAlterTable compares the edited columns with the current columns of a
+// table and returns the ALTER TABLE statements that apply the edits. Drops
+// come first so a dropped name can be reused, then renames and modifications
+// in column order, then new columns. Current columns missing from edits are
+// left untouched.
+func BuildAlterTable(conn *Conn, tableName string, current []ColumnInfo, edits []ColumnEdit) ([]string, error) {
+	currentByName := make(map[string]*ColumnInfo, len(current))
+	for i := range current {
+		currentByName[current[i].Field] = &current[i]
+	}
+
+	// Validate before generating anything so a bad row produces no statements
+	seenOriginal := make(map[string]bool)
+	seenName := make(map[string]bool)
+	kept := len(current)
+	for i, edit := range edits {
+		if edit.Original != "" {
+			if currentByName[edit.Original] == nil {
+				return nil, fmt.Errorf("column %s does not exist", edit.Original)
+			}
+			if seenOriginal[edit.Original] {
+				return nil, fmt.Errorf("column %s is listed twice", edit.Original)
+			}
+			seenOriginal[edit.Original] = true
+		}
+
+		if edit.Drop {
+			if edit.Original != "" {
+				kept--
+			}
+			continue
+		}
+		if edit.Original == "" {
+			kept++
+		}
+
+		if edit.Name == "" {
+			return nil, fmt.Errorf("column %d has no name", i+1)
+		}
+		if edit.Type == "" {
+			return nil, fmt.Errorf("column %s has no type", edit.Name)
+		}
+		if seenName[strings.ToLower(edit.Name)] {
+			return nil, fmt.Errorf("column name %s is used twice", edit.Name)
+		}
+		seenName[strings.ToLower(edit.Name)] = true
+	}
+	if kept == 0 {
+		return nil, errors.New("a table must keep at least one column")
+	}
+
+	var drops, changes, adds []string
+	for _, edit := range edits {
+		var col *ColumnInfo
+		if edit.Original != "" {
+			col = currentByName[edit.Original]
+		} else if edit.Drop {
+			// A new row that was removed again
+			continue
+		}
+
+		statements, err := conn.driver.AlterColumn(tableName, col, edit)
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case edit.Drop:
+			drops = append(drops, statements...)
+		case col == nil:
+			adds = append(adds, statements...)
+		default:
+			changes = append(changes, statements...)
+		}
+	}
+
+	return append(append(drops, changes...), adds...), nil
+}
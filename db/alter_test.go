@@ -0,0 +1,170 @@
+package db
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBuildAlterTable(t *testing.T) {
+	defaultZero := "0"
+	current := []ColumnInfo{
+		{Field: "id", Type: "int", Null: "NO", Key: "PRI", Extra: "auto_increment"},
+		{Field: "name", Type: "varchar(50)", Null: "YES"},
+		{Field: "score", Type: "int", Null: "NO", Default: &defaultZero},
+	}
+
+	tests := []struct {
+		name    string
+		driver  Driver
+		edits   []ColumnEdit
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:   "unchanged",
+			driver: mysqlDriver{},
+			edits:  ColumnEditsFromColumns(current),
+			want:   nil,
+		},
+		{
+			name:   "mysql modify keeps auto_increment",
+			driver: mysqlDriver{},
+			edits: []ColumnEdit{
+				{Original: "id", Name: "id", Type: "bigint"},
+			},
+			want: []string{"ALTER TABLE `t` MODIFY COLUMN `id` bigint NOT NULL AUTO_INCREMENT"},
+		},
+		{
+			name:   "mysql drops, then changes, then adds",
+			driver: mysqlDriver{},
+			edits: []ColumnEdit{
+				{Name: "email", Type: "varchar(100)", Nullable: true, Default: "none"},
+				{Original: "name", Name: "title", Type: "varchar(50)", Nullable: true},
+				{Original: "score", Drop: true},
+			},
+			want: []string{
+				"ALTER TABLE `t` DROP COLUMN `score`",
+				"ALTER TABLE `t` RENAME COLUMN `name` TO `title`",
+				"ALTER TABLE `t` ADD COLUMN `email` varchar(100) NULL DEFAULT 'none'",
+			},
+		},
+		{
+			name:   "mysql numeric default",
+			driver: mysqlDriver{},
+			edits: []ColumnEdit{
+				{Original: "score", Name: "score", Type: "int", Default: "10"},
+			},
+			want: []string{"ALTER TABLE `t` MODIFY COLUMN `score` int NOT NULL DEFAULT 10"},
+		},
+		{
+			name:   "postgres changes each attribute",
+			driver: postgresDriver{},
+			edits: []ColumnEdit{
+				{Original: "name", Name: "title", Type: "text"},
+				{Original: "score", Name: "score", Type: "int", Nullable: true},
+			},
+			want: []string{
+				`ALTER TABLE "t" RENAME COLUMN "name" TO "title"`,
+				`ALTER TABLE "t" ALTER COLUMN "title" TYPE text`,
+				`ALTER TABLE "t" ALTER COLUMN "title" SET NOT NULL`,
+				`ALTER TABLE "t" ALTER COLUMN "score" DROP NOT NULL`,
+				`ALTER TABLE "t" ALTER COLUMN "score" DROP DEFAULT`,
+			},
+		},
+		{
+			name:   "postgres add with default",
+			driver: postgresDriver{},
+			edits: []ColumnEdit{
+				{Name: "created", Type: "timestamp", Default: "now()"},
+			},
+			want: []string{`ALTER TABLE "t" ADD COLUMN "created" timestamp NOT NULL DEFAULT now()`},
+		},
+		{
+			name:   "new row removed again",
+			driver: postgresDriver{},
+			edits: []ColumnEdit{
+				{Name: "gone", Type: "int", Drop: true},
+			},
+			want: nil,
+		},
+		{
+			name:   "sqlite rename",
+			driver: sqliteDriver{},
+			edits: []ColumnEdit{
+				{Original: "name", Name: "title", Type: "varchar(50)", Nullable: true},
+			},
+			want: []string{`ALTER TABLE "t" RENAME COLUMN "name" TO "title"`},
+		},
+		{
+			name:   "sqlite cannot modify",
+			driver: sqliteDriver{},
+			edits: []ColumnEdit{
+				{Original: "name", Name: "name", Type: "text", Nullable: true},
+			},
+			wantErr: true,
+		},
+		{
+			name:   "unknown column",
+			driver: mysqlDriver{},
+			edits: []ColumnEdit{
+				{Original: "missing", Name: "missing", Type: "int"},
+			},
+			wantErr: true,
+		},
+		{
+			name:   "column listed twice",
+			driver: mysqlDriver{},
+			edits: []ColumnEdit{
+				{Original: "name", Name: "a", Type: "int"},
+				{Original: "name", Name: "b", Type: "int"},
+			},
+			wantErr: true,
+		},
+		{
+			name:   "duplicate name",
+			driver: mysqlDriver{},
+			edits: []ColumnEdit{
+				{Original: "name", Name: "Score", Type: "int"},
+				{Original: "score", Name: "score", Type: "int"},
+			},
+			wantErr: true,
+		},
+		{
+			name:   "missing type",
+			driver: mysqlDriver{},
+			edits: []ColumnEdit{
+				{Name: "extra"},
+			},
+			wantErr: true,
+		},
+		{
+			name:   "dropping every column",
+			driver: mysqlDriver{},
+			edits: []ColumnEdit{
+				{Original: "id", Drop: true},
+				{Original: "name", Drop: true},
+				{Original: "score", Drop: true},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &Conn{driver: tt.driver}
+			got, err := BuildAlterTable(conn, "t", current, tt.edits)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("BuildAlterTable() = %q, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("BuildAlterTable() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("BuildAlterTable() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
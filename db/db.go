@@ -1,10 +1,13 @@
 package db
 
 import (
+	"context"
+	"database/sql"
 	"fmt"
 	"godbadmin/config"
+	"strings"
+	"sync"
 
-	_ "github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
 )
 
@@ -16,63 +19,141 @@ type DatabaseInfo struct {
 	DatabaseName string `db:"SCHEMA_NAME"`
 }
 
-func Connect(server config.ServerConfig) (*sqlx.DB, error) {
-	dsn := fmt.Sprintf("%s:%s@tcp(%s:%d)/%s",
-		server.User,
-		server.Password,
-		server.Host,
-		server.Port,
-		server.Database,
-	)
+// Conn is a connection to a server together with the driver that speaks its
+// dialect. It is cheap: connections to saved servers come from a pool shared
+// across requests (see Open), and each request gets its own Conn.
+type Conn struct {
+	*sqlx.DB
+	Server config.ServerConfig
+	driver Driver
+
+	// OnExec, when set, is told about every statement that changes data or
+	// schema, and every statement run by ExecuteStatements
+	OnExec ExecHook
+
+	pool *pool
+	// owned is set when the pool was opened for this connection alone
+	owned bool
+
+	mu sync.Mutex
+	// releases give back the connections to other databases taken from the
+	// pool, when the connection is closed
+	releases []func()
+	closed   bool
+}
 
-	db, err := sqlx.Connect("mysql", dsn)
+// Connect opens a connection of its own, for servers that are not saved yet
+// such as the connection test. Close closes it.
+func Connect(server config.ServerConfig) (*Conn, error) {
+	p, err := newPool(server)
 	if err != nil {
 		return nil, err
 	}
 
-	return db, nil
+	return &Conn{DB: p.db, Server: server, driver: p.driver, pool: p, owned: true}, nil
 }
 
-func ConnectWithoutDB(host string, port int, user, password string) (*sqlx.DB, error) {
-	dsn := fmt.Sprintf("%s:%s@tcp(%s:%d)/",
-		user,
-		password,
-		host,
-		port,
-	)
+func ConnectWithoutDB(server config.ServerConfig) (*Conn, error) {
+	server.Database = ""
+	return Connect(server)
+}
 
-	db, err := sqlx.Connect("mysql", dsn)
-	if err != nil {
-		return nil, err
+// ExecHook is called after a statement that changes data or schema ran.
+// rowsAffected is -1 when the server does not report it.
+type ExecHook func(query string, args []interface{}, rowsAffected int64, err error)
+
+// exec runs a statement that changes data or schema and reports it to
+// OnExec. Schema changes drop the cached metadata of the server.
+func (c *Conn) exec(ctx context.Context, e sqlx.ExecerContext, query string, args ...interface{}) (sql.Result, error) {
+	result, err := e.ExecContext(ctx, query, args...)
+	if changesSchema(query) && c.Server.ID != "" {
+		InvalidateMetadata(c.Server.ID)
 	}
+	affected := int64(-1)
+	if err == nil {
+		if n, rowsErr := result.RowsAffected(); rowsErr == nil {
+			affected = n
+		}
+	}
+	c.report(query, args, affected, err)
+	return result, err
+}
 
-	return db, nil
+// report tells OnExec about a statement that ran.
+func (c *Conn) report(query string, args []interface{}, rowsAffected int64, err error) {
+	if c.OnExec != nil {
+		c.OnExec(query, args, rowsAffected, err)
+	}
 }
 
-func GetDatabases(db *sqlx.DB) ([]DatabaseInfo, error) {
-	var databases []DatabaseInfo
-	query := `SELECT SCHEMA_NAME FROM information_schema.SCHEMATA
-	          WHERE SCHEMA_NAME NOT IN ('information_schema', 'mysql', 'performance_schema', 'sys')
-	          ORDER BY SCHEMA_NAME`
+// Driver returns the driver for the connected server.
+func (c *Conn) Driver() Driver {
+	return c.driver
+}
 
-	err := db.Select(&databases, query)
+// Use returns the handle on which queries about the given database run.
+// Queries name tables with Table.
+func (c *Conn) Use(database string) (*sqlx.DB, error) {
+	if database == "" {
+		return c.DB, nil
+	}
+	return c.driver.UseDatabase(c, database)
+}
+
+// openDatabase returns the pooled connections to another database on the
+// same server, kept until the connection is closed.
+func (c *Conn) openDatabase(database string) (*sqlx.DB, error) {
+	db, release, err := c.pool.database(database)
 	if err != nil {
 		return nil, err
 	}
 
-	return databases, nil
+	c.mu.Lock()
+	c.releases = append(c.releases, release)
+	c.mu.Unlock()
+	return db, nil
 }
 
-func GetAllDatabases(db *sqlx.DB) ([]DatabaseInfo, error) {
-	var databases []DatabaseInfo
-	query := `SELECT SCHEMA_NAME FROM information_schema.SCHEMATA ORDER BY SCHEMA_NAME`
+// Close releases the connection. Pooled connections stay open for the next
+// request; those opened by Connect are closed.
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	releases := c.releases
+	c.releases = nil
+	c.mu.Unlock()
 
-	err := db.Select(&databases, query)
-	if err != nil {
-		return nil, err
+	for _, release := range releases {
+		release()
+	}
+	if c.owned {
+		return c.pool.close()
 	}
+	c.pool.release()
+	return nil
+}
 
-	return databases, nil
+// QuoteIdentifier quotes a name using the server's dialect.
+func (c *Conn) QuoteIdentifier(name string) string {
+	return c.driver.QuoteIdentifier(name)
+}
+
+// Table quotes a table name, qualified with its database where the server
+// reaches several databases over one connection.
+func (c *Conn) Table(database, tableName string) string {
+	return c.driver.QualifyTable(database, tableName)
+}
+
+func GetDatabases(conn *Conn) ([]DatabaseInfo, error) {
+	return conn.driver.GetDatabases(conn.DB, false)
+}
+
+func GetAllDatabases(conn *Conn) ([]DatabaseInfo, error) {
+	return conn.driver.GetDatabases(conn.DB, true)
 }
 
 type DatabaseWithTables struct {
@@ -80,33 +161,117 @@ type DatabaseWithTables struct {
 	Tables       []TableInfo
 }
 
-func GetTables(db *sqlx.DB, database string) ([]TableInfo, error) {
-	var tables []TableInfo
-	query := `SELECT TABLE_NAME FROM information_schema.TABLES WHERE TABLE_SCHEMA = ? ORDER BY TABLE_NAME`
-
-	err := db.Select(&tables, query, database)
+func GetTables(conn *Conn, database string) ([]TableInfo, error) {
+	db, err := conn.Use(database)
 	if err != nil {
 		return nil, err
 	}
 
-	return tables, nil
+	return conn.driver.GetTables(db, database)
 }
 
-func GetTableData(db *sqlx.DB, database, tableName string, limit int) ([]map[string]interface{}, []string, error) {
-	if limit <= 0 {
-		limit = 100
-	}
+// Filter operators accepted by TableQuery.
+const (
+	FilterEquals    = "eq"
+	FilterNotEquals = "ne"
+	FilterLike      = "like"
+	FilterNotLike   = "notlike"
+	FilterNull      = "null"
+	FilterNotNull   = "notnull"
+	FilterRange     = "range"
+)
 
-	// Select database first
-	if database != "" {
-		_, err := db.Exec(fmt.Sprintf("USE `%s`", database))
-		if err != nil {
-			return nil, nil, err
+// Filter restricts the rows of a table by one column. Range uses Value as the
+// lower and Value2 as the upper bound; either may be empty.
+type Filter struct {
+	Column   string
+	Operator string
+	Value    string
+	Value2   string
+}
+
+// TableQuery selects one page of table data.
+type TableQuery struct {
+	Limit   int
+	Offset  int
+	OrderBy string
+	Desc    bool
+	Filters []Filter
+}
+
+// filterWhere builds a WHERE clause with ? placeholders for the filters.
+func filterWhere(conn *Conn, filters []Filter) (string, []interface{}, error) {
+	var clauses []string
+	var args []interface{}
+	for _, f := range filters {
+		col := conn.QuoteIdentifier(f.Column)
+		switch f.Operator {
+		case FilterEquals:
+			clauses = append(clauses, col+" = ?")
+			args = append(args, f.Value)
+		case FilterNotEquals:
+			clauses = append(clauses, col+" <> ?")
+			args = append(args, f.Value)
+		case FilterLike, FilterNotLike:
+			// PostgreSQL has no LIKE for numbers and dates
+			if _, ok := conn.driver.(postgresDriver); ok {
+				col = "CAST(" + col + " AS TEXT)"
+			}
+			if f.Operator == FilterLike {
+				clauses = append(clauses, col+" LIKE ?")
+			} else {
+				clauses = append(clauses, col+" NOT LIKE ?")
+			}
+			args = append(args, f.Value)
+		case FilterNull:
+			clauses = append(clauses, col+" IS NULL")
+		case FilterNotNull:
+			clauses = append(clauses, col+" IS NOT NULL")
+		case FilterRange:
+			if f.Value != "" {
+				clauses = append(clauses, col+" >= ?")
+				args = append(args, f.Value)
+			}
+			if f.Value2 != "" {
+				clauses = append(clauses, col+" <= ?")
+				args = append(args, f.Value2)
+			}
+		default:
+			return "", nil, fmt.Errorf("unknown filter operator: %s", f.Operator)
 		}
 	}
 
-	query := fmt.Sprintf("SELECT * FROM `%s` LIMIT %d", tableName, limit)
-	rows, err := db.Queryx(query)
+	if len(clauses) == 0 {
+		return "", nil, nil
+	}
+	return " WHERE " + strings.Join(clauses, " AND "), args, nil
+}
+
+func GetTableData(conn *Conn, database, tableName string, q TableQuery) ([]map[string]interface{}, []string, error) {
+	if q.Limit <= 0 {
+		q.Limit = 100
+	}
+	if q.Offset < 0 {
+		q.Offset = 0
+	}
+
+	db, err := conn.Use(database)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	whereClause, args, err := filterWhere(conn, q.Filters)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	orderClause, err := tableOrder(conn, db, database, tableName, q)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	query := db.Rebind(fmt.Sprintf("SELECT * FROM %s%s%s LIMIT %d OFFSET %d", conn.Table(database, tableName), whereClause, orderClause, q.Limit, q.Offset))
+	rows, err := db.Queryx(query, args...)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -138,146 +303,120 @@ func GetTableData(db *sqlx.DB, database, tableName string, limit int) ([]map[str
 	return results, columns, nil
 }
 
-func GetTableDataAll(db *sqlx.DB, database, tableName string) ([]map[string]interface{}, error) {
-	// Select database first
-	if database != "" {
-		_, err := db.Exec(fmt.Sprintf("USE `%s`", database))
-		if err != nil {
-			return nil, err
+// tableOrder returns the ORDER BY clause of a page. Without a total order,
+// LIMIT and OFFSET may repeat or skip rows between pages, so the primary key
+// orders unsorted pages and breaks the ties of the chosen sort. Tables
+// without one are ordered by their row ID.
+func tableOrder(conn *Conn, db *sqlx.DB, database, tableName string, q TableQuery) (string, error) {
+	var order []string
+	if q.OrderBy != "" {
+		column := conn.QuoteIdentifier(q.OrderBy)
+		if q.Desc {
+			column += " DESC"
 		}
+		order = append(order, column)
 	}
 
-	query := fmt.Sprintf("SELECT * FROM `%s`", tableName)
-	rows, err := db.Queryx(query)
+	pkColumns, err := conn.driver.GetPrimaryKeyColumns(db, database, tableName)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
-	defer rows.Close()
-
-	var results []map[string]interface{}
-	for rows.Next() {
-		row := make(map[string]interface{})
-		err := rows.MapScan(row)
+	for _, col := range pkColumns {
+		if col != q.OrderBy {
+			order = append(order, conn.QuoteIdentifier(col))
+		}
+	}
+	if len(pkColumns) == 0 {
+		rowID, err := conn.driver.RowIDColumn(db, database, tableName)
 		if err != nil {
-			return nil, err
+			return "", err
 		}
-
-		// Convert []byte to string for display
-		for key, val := range row {
-			if b, ok := val.([]byte); ok {
-				row[key] = string(b)
-			}
+		if rowID != "" {
+			order = append(order, rowID)
 		}
-
-		results = append(results, row)
 	}
 
-	return results, nil
+	if len(order) == 0 {
+		return "", nil
+	}
+	return " ORDER BY " + strings.Join(order, ", "), nil
 }
 
-type ColumnInfo struct {
-	Field   string `db:"Field"`
-	Type    string `db:"Type"`
-	Null    string `db:"Null"`
-	Key     string `db:"Key"`
-	Default *string `db:"Default"`
-	Extra   string `db:"Extra"`
-}
+// EstimatedCountThreshold is the row count from the server statistics above
+// which CountTableRows reports the estimate instead of counting.
+const EstimatedCountThreshold = 100000
 
-func GetTableColumns(db *sqlx.DB, database, tableName string) ([]ColumnInfo, error) {
-	// Select database first
-	if database != "" {
-		_, err := db.Exec(fmt.Sprintf("USE `%s`", database))
-		if err != nil {
-			return nil, err
+// CountTableRows counts the rows matching the filters. Without filters and
+// unless exact is set, large tables report the server's estimate instead.
+func CountTableRows(conn *Conn, database, tableName string, filters []Filter, exact bool) (count int64, estimated bool, err error) {
+	db, err := conn.Use(database)
+	if err != nil {
+		return 0, false, err
+	}
+
+	if len(filters) == 0 && !exact {
+		estimate, err := conn.driver.EstimateRowCount(db, database, tableName)
+		if err == nil && estimate >= EstimatedCountThreshold {
+			return estimate, true, nil
 		}
 	}
 
-	var columns []ColumnInfo
-	query := fmt.Sprintf("SHOW COLUMNS FROM `%s`", tableName)
-	err := db.Select(&columns, query)
+	whereClause, args, err := filterWhere(conn, filters)
 	if err != nil {
-		return nil, err
+		return 0, false, err
 	}
 
-	return columns, nil
+	query := db.Rebind(fmt.Sprintf("SELECT COUNT(*) FROM %s%s", conn.Table(database, tableName), whereClause))
+	err = db.Get(&count, query, args...)
+	return count, false, err
 }
 
-func GetTableCreateStatement(db *sqlx.DB, database, tableName string) (string, error) {
-	// Select database first
-	if database != "" {
-		_, err := db.Exec(fmt.Sprintf("USE `%s`", database))
-		if err != nil {
-			return "", err
-		}
-	}
-
-	// Use QueryRow and scan into map to handle any number of columns
-	query := fmt.Sprintf("SHOW CREATE TABLE `%s`", tableName)
-
-	var tblName string
-	var createStmt string
+type ColumnInfo struct {
+	Field   string  `db:"Field"`
+	Type    string  `db:"Type"`
+	Null    string  `db:"Null"`
+	Key     string  `db:"Key"`
+	Default *string `db:"Default"`
+	Extra   string  `db:"Extra"`
+}
 
-	err := db.QueryRow(query).Scan(&tblName, &createStmt)
+func GetTableColumns(conn *Conn, database, tableName string) ([]ColumnInfo, error) {
+	db, err := conn.Use(database)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	return createStmt, nil
+	return conn.driver.GetTableColumns(db, database, tableName)
 }
 
-func GetPrimaryKeyColumns(db *sqlx.DB, database, tableName string) ([]string, error) {
-	// Select database first
-	if database != "" {
-		_, err := db.Exec(fmt.Sprintf("USE `%s`", database))
-		if err != nil {
-			return nil, err
-		}
+func GetTableCreateStatement(conn *Conn, database, tableName string) (string, error) {
+	db, err := conn.Use(database)
+	if err != nil {
+		return "", err
 	}
 
-	var pkColumns []string
-	query := `SELECT COLUMN_NAME
-	          FROM information_schema.KEY_COLUMN_USAGE
-	          WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ? AND CONSTRAINT_NAME = 'PRIMARY'
-	          ORDER BY ORDINAL_POSITION`
+	return conn.driver.GetTableCreateStatement(db, database, tableName)
+}
 
-	err := db.Select(&pkColumns, query, database, tableName)
+func GetPrimaryKeyColumns(conn *Conn, database, tableName string) ([]string, error) {
+	db, err := conn.Use(database)
 	if err != nil {
 		return nil, err
 	}
 
-	return pkColumns, nil
+	return conn.driver.GetPrimaryKeyColumns(db, database, tableName)
 }
 
-func GetRowData(db *sqlx.DB, database, tableName string, pkColumns []string, pkValues []string) (map[string]interface{}, error) {
-	// Select database first
-	if database != "" {
-		_, err := db.Exec(fmt.Sprintf("USE `%s`", database))
-		if err != nil {
-			return nil, err
-		}
+func GetRowData(conn *Conn, database, tableName string, pkColumns []string, pkValues []string) (map[string]interface{}, error) {
+	db, err := conn.Use(database)
+	if err != nil {
+		return nil, err
 	}
 
 	// Build WHERE clause
-	var whereClauses []string
-	for _, col := range pkColumns {
-		whereClauses = append(whereClauses, fmt.Sprintf("`%s` = ?", col))
-	}
-	whereClause := ""
-	if len(whereClauses) > 0 {
-		whereClause = " WHERE " + fmt.Sprintf("%s", whereClauses[0])
-		for i := 1; i < len(whereClauses); i++ {
-			whereClause += " AND " + whereClauses[i]
-		}
-	}
-
-	query := fmt.Sprintf("SELECT * FROM `%s`%s LIMIT 1", tableName, whereClause)
+	whereClause, args := primaryKeyWhere(conn, pkColumns, pkValues)
 
-	// Convert pkValues to interface{} slice
-	args := make([]interface{}, len(pkValues))
-	for i, v := range pkValues {
-		args[i] = v
-	}
+	query := db.Rebind(fmt.Sprintf("SELECT * FROM %s%s LIMIT 1", conn.Table(database, tableName), whereClause))
 
 	rows, err := db.Queryx(query, args...)
 	if err != nil {
@@ -305,158 +444,178 @@ func GetRowData(db *sqlx.DB, database, tableName string, pkColumns []string, pkV
 	return nil, fmt.Errorf("row not found")
 }
 
-type ServerInfo struct {
-	Version               string
-	VersionComment        string
-	ProtocolVersion       string
-	ConnectionID          string
-	CurrentUser           string
-	CharacterSetServer    string
-	CollationServer       string
-	CharacterSetConnection string
-	CollationConnection   string
-	SSLCipher             string
-}
-
-func GetServerInfo(db *sqlx.DB) (*ServerInfo, error) {
-	info := &ServerInfo{}
-
-	// Get version
-	var version string
-	err := db.Get(&version, "SELECT VERSION()")
-	if err == nil {
-		info.Version = version
+// primaryKeyWhere builds a WHERE clause with ? placeholders matching the primary key values.
+func primaryKeyWhere(conn *Conn, pkColumns []string, pkValues []string) (string, []interface{}) {
+	var whereClauses []string
+	for _, col := range pkColumns {
+		whereClauses = append(whereClauses, fmt.Sprintf("%s = ?", conn.QuoteIdentifier(col)))
 	}
 
-	// Get version comment
-	var versionComment string
-	err = db.Get(&versionComment, "SELECT @@version_comment")
-	if err == nil {
-		info.VersionComment = versionComment
+	// Convert pkValues to interface{} slice
+	args := make([]interface{}, len(pkValues))
+	for i, v := range pkValues {
+		args[i] = v
 	}
 
-	// Get protocol version
-	var protocolVersion string
-	err = db.Get(&protocolVersion, "SELECT @@protocol_version")
-	if err == nil {
-		info.ProtocolVersion = protocolVersion
+	if len(whereClauses) == 0 {
+		return "", args
 	}
+	return " WHERE " + strings.Join(whereClauses, " AND "), args
+}
 
-	// Get connection ID
-	var connectionID int
-	err = db.Get(&connectionID, "SELECT CONNECTION_ID()")
-	if err == nil {
-		info.ConnectionID = fmt.Sprintf("%d", connectionID)
+// ColumnValue is a value written to a column. A nil Value writes NULL.
+// Binary values are sent as bytes rather than text.
+type ColumnValue struct {
+	Column string
+	Value  *string
+	Binary bool
+}
+
+func (v ColumnValue) arg() interface{} {
+	if v.Binary && v.Value != nil {
+		return []byte(*v.Value)
 	}
+	return v.Value
+}
 
-	// Get current user
-	var currentUser string
-	err = db.Get(&currentUser, "SELECT CURRENT_USER()")
-	if err == nil {
-		info.CurrentUser = currentUser
+// IsBinaryColumn reports whether a column type, as in ColumnInfo, holds
+// bytes rather than text.
+func IsBinaryColumn(columnType string) bool {
+	return isBinaryType(strings.ToUpper(columnType))
+}
+
+// InsertRow inserts a row. Columns missing from values get their default.
+func InsertRow(conn *Conn, database, tableName string, values []ColumnValue) error {
+	db, err := conn.Use(database)
+	if err != nil {
+		return err
 	}
 
-	// Get character set
-	var charsetServer string
-	err = db.Get(&charsetServer, "SELECT @@character_set_server")
-	if err == nil {
-		info.CharacterSetServer = charsetServer
+	var columns, placeholders []string
+	var args []interface{}
+	for _, v := range values {
+		columns = append(columns, conn.QuoteIdentifier(v.Column))
+		placeholders = append(placeholders, "?")
+		args = append(args, v.arg())
 	}
 
-	// Get collation
-	var collationServer string
-	err = db.Get(&collationServer, "SELECT @@collation_server")
-	if err == nil {
-		info.CollationServer = collationServer
+	var query string
+	if len(columns) > 0 {
+		query = fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", conn.Table(database, tableName), strings.Join(columns, ", "), strings.Join(placeholders, ", "))
+	} else if _, ok := conn.driver.(mysqlDriver); ok {
+		query = fmt.Sprintf("INSERT INTO %s () VALUES ()", conn.Table(database, tableName))
+	} else {
+		query = fmt.Sprintf("INSERT INTO %s DEFAULT VALUES", conn.Table(database, tableName))
 	}
 
-	// Get connection character set
-	var charsetConnection string
-	err = db.Get(&charsetConnection, "SELECT @@character_set_connection")
-	if err == nil {
-		info.CharacterSetConnection = charsetConnection
+	_, err = conn.exec(context.Background(), db, db.Rebind(query), args...)
+	return err
+}
+
+// UpdateRow updates the row with the given primary key values.
+func UpdateRow(conn *Conn, database, tableName string, pkColumns []string, pkValues []string, values []ColumnValue) error {
+	if len(pkColumns) == 0 {
+		return fmt.Errorf("table %s has no primary key", tableName)
+	}
+	if len(values) == 0 {
+		return nil
 	}
 
-	// Get connection collation
-	var collationConnection string
-	err = db.Get(&collationConnection, "SELECT @@collation_connection")
-	if err == nil {
-		info.CollationConnection = collationConnection
+	db, err := conn.Use(database)
+	if err != nil {
+		return err
 	}
 
-	// Get SSL cipher (empty if not using SSL)
-	var sslCipher string
-	err = db.Get(&sslCipher, "SHOW STATUS LIKE 'Ssl_cipher'")
-	if err == nil {
-		info.SSLCipher = sslCipher
+	var setClauses []string
+	var args []interface{}
+	for _, v := range values {
+		setClauses = append(setClauses, fmt.Sprintf("%s = ?", conn.QuoteIdentifier(v.Column)))
+		args = append(args, v.arg())
 	}
+	whereClause, whereArgs := primaryKeyWhere(conn, pkColumns, pkValues)
 
-	return info, nil
+	// MySQL reports 0 affected rows when nothing changed, so a missing row is not detected here
+	query := db.Rebind(fmt.Sprintf("UPDATE %s SET %s%s", conn.Table(database, tableName), strings.Join(setClauses, ", "), whereClause))
+	_, err = conn.exec(context.Background(), db, query, append(args, whereArgs...)...)
+	return err
 }
 
-type UserPrivilege struct {
-	User       string
-	Host       string
-	Privileges string
-}
+// DeleteRow deletes the row with the given primary key values.
+func DeleteRow(conn *Conn, database, tableName string, pkColumns []string, pkValues []string) error {
+	if len(pkColumns) == 0 {
+		return fmt.Errorf("table %s has no primary key", tableName)
+	}
 
-func GetUserPrivileges(db *sqlx.DB) ([]UserPrivilege, error) {
-	// Get all users
-	type MySQLUser struct {
-		User string `db:"User"`
-		Host string `db:"Host"`
+	db, err := conn.Use(database)
+	if err != nil {
+		return err
 	}
 
-	var users []MySQLUser
-	err := db.Select(&users, "SELECT User, Host FROM mysql.user ORDER BY User, Host")
+	whereClause, args := primaryKeyWhere(conn, pkColumns, pkValues)
+	query := db.Rebind(fmt.Sprintf("DELETE FROM %s%s", conn.Table(database, tableName), whereClause))
+	result, err := conn.exec(context.Background(), db, query, args...)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	var userPrivileges []UserPrivilege
-	for _, user := range users {
-		// Get grants for each user
-		query := fmt.Sprintf("SHOW GRANTS FOR '%s'@'%s'", user.User, user.Host)
-		rows, err := db.Query(query)
-		if err != nil {
-			// Skip users we can't query
-			continue
-		}
+	affected, err := result.RowsAffected()
+	if err == nil && affected == 0 {
+		return fmt.Errorf("row not found")
+	}
 
-		var grants []string
-		for rows.Next() {
-			var grant string
-			if err := rows.Scan(&grant); err == nil {
-				grants = append(grants, grant)
-			}
-		}
-		rows.Close()
+	return nil
+}
 
-		userPrivileges = append(userPrivileges, UserPrivilege{
-			User:       user.User,
-			Host:       user.Host,
-			Privileges: fmt.Sprintf("%d grants", len(grants)),
-		})
+// CreateDatabase creates a database on the server.
+func CreateDatabase(conn *Conn, name, charset, collation string) error {
+	query, err := conn.driver.CreateDatabase(name, charset, collation)
+	if err != nil {
+		return err
 	}
 
-	return userPrivileges, nil
+	_, err = conn.exec(context.Background(), conn.DB, query)
+	return err
 }
 
-func GetUserGrants(db *sqlx.DB, user, host string) ([]string, error) {
-	query := fmt.Sprintf("SHOW GRANTS FOR '%s'@'%s'", user, host)
-	rows, err := db.Query(query)
+// DropTable drops a table from the given database.
+func DropTable(conn *Conn, database, tableName string) error {
+	db, err := conn.Use(database)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	defer rows.Close()
 
-	var grants []string
-	for rows.Next() {
-		var grant string
-		if err := rows.Scan(&grant); err == nil {
-			grants = append(grants, grant)
-		}
-	}
+	_, err = conn.exec(context.Background(), db, fmt.Sprintf("DROP TABLE %s", conn.Table(database, tableName)))
+	return err
+}
+
+type ServerInfo struct {
+	Version                string
+	VersionComment         string
+	ProtocolVersion        string
+	ConnectionID           string
+	CurrentUser            string
+	CharacterSetServer     string
+	CollationServer        string
+	CharacterSetConnection string
+	CollationConnection    string
+	SSLCipher              string
+	SSLVersion             string
+}
+
+func GetServerInfo(conn *Conn) (*ServerInfo, error) {
+	return conn.driver.GetServerInfo(conn.DB)
+}
+
+type UserPrivilege struct {
+	User       string
+	Host       string
+	Privileges string
+}
+
+func GetUserPrivileges(conn *Conn) ([]UserPrivilege, error) {
+	return conn.driver.GetUserPrivileges(conn.DB)
+}
 
-	return grants, nil
+func GetUserGrants(conn *Conn, user, host string) ([]string, error) {
+	return conn.driver.GetUserGrants(conn.DB, user, host)
 }
@@ -0,0 +1,96 @@
+package db
+
+import (
+	"fmt"
+	"godbadmin/config"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Driver hides the differences between database servers. Each implementation
+// knows how to build a DSN, quote identifiers and read the server metadata
+// shown by the handlers.
+type Driver interface {
+	// DriverName returns the database/sql driver name used by sqlx.
+	DriverName() string
+
+	// DSN builds the data source name for the server and database.
+	DSN(server config.ServerConfig) string
+
+	// DefaultPort returns the port the server listens on unless configured
+	// otherwise, or 0 when it is not reached over the network.
+	DefaultPort() int
+
+	// QuoteIdentifier quotes a table, column or database name.
+	QuoteIdentifier(name string) string
+
+	// QuoteLiteral quotes a string literal.
+	QuoteLiteral(value string) string
+
+	// QualifyTable quotes a table name, prefixed with its database when one
+	// connection reaches several databases.
+	QualifyTable(database, tableName string) string
+
+	// UseDatabase returns the handle on which queries about the given
+	// database run. It never changes the default database of a pooled
+	// connection, so queries name tables with QualifyTable.
+	UseDatabase(conn *Conn, database string) (*sqlx.DB, error)
+
+	GetDatabases(db *sqlx.DB, includeSystem bool) ([]DatabaseInfo, error)
+	GetTables(db *sqlx.DB, database string) ([]TableInfo, error)
+	GetTableColumns(db *sqlx.DB, database, tableName string) ([]ColumnInfo, error)
+	GetPrimaryKeyColumns(db *sqlx.DB, database, tableName string) ([]string, error)
+
+	// RowIDColumn returns the system column ordering the rows of a table
+	// without a primary key, such as rowid or ctid, or "" when there is none.
+	RowIDColumn(db *sqlx.DB, database, tableName string) (string, error)
+	GetTableCreateStatement(db *sqlx.DB, database, tableName string) (string, error)
+
+	// EstimateRowCount returns the row count kept in the server statistics,
+	// or an error when there is none.
+	EstimateRowCount(db *sqlx.DB, database, tableName string) (int64, error)
+
+	GetServerInfo(db *sqlx.DB) (*ServerInfo, error)
+	GetUserPrivileges(db *sqlx.DB) ([]UserPrivilege, error)
+	GetUserGrants(db *sqlx.DB, user, host string) ([]string, error)
+
+	// CreateDatabase returns the statement creating a database. Charset and
+	// collation are optional.
+	CreateDatabase(name, charset, collation string) (string, error)
+
+	// AlterColumn returns the ALTER TABLE statements that add a column (current
+	// is nil), drop it (edit.Drop) or rename and modify it.
+	AlterColumn(tableName string, current *ColumnInfo, edit ColumnEdit) ([]string, error)
+}
+
+var drivers = map[string]Driver{
+	"mysql":      mysqlDriver{},
+	"mariadb":    mysqlDriver{},
+	"postgresql": postgresDriver{},
+	"sqlite":     sqliteDriver{},
+}
+
+// DefaultPort returns the default port of a ServerConfig.DBType, or 0 for
+// unknown types.
+func DefaultPort(dbType string) int {
+	driver, err := GetDriver(dbType)
+	if err != nil {
+		return 0
+	}
+	return driver.DefaultPort()
+}
+
+// GetDriver returns the driver for a ServerConfig.DBType.
+// Servers saved before the type was selectable have no DBType and use MySQL.
+func GetDriver(dbType string) (Driver, error) {
+	if dbType == "" {
+		dbType = "mysql"
+	}
+
+	driver, ok := drivers[dbType]
+	if !ok {
+		return nil, fmt.Errorf("unsupported database type: %s", dbType)
+	}
+
+	return driver, nil
+}
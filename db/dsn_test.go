@@ -0,0 +1,121 @@
+package db
+
+import (
+	"godbadmin/config"
+	"net/url"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// dsnSecrets are passwords and names using the characters DSNs split on
+var dsnSecrets = []struct {
+	name     string
+	user     string
+	password string
+	database string
+}{
+	{"plain", "app", "secret", "shop"},
+	{"separators", "app", "p@ss/w:rd?x=1&y#z", "shop"},
+	{"percent and spaces", "app user", "100% sure ", "my db"},
+	{"parenthesis", "app", "a)b(c", "shop"},
+	{"unicode", "利用者", "パスワード", "データ"},
+}
+
+func TestMySQLDSN(t *testing.T) {
+	for _, tt := range dsnSecrets {
+		t.Run(tt.name, func(t *testing.T) {
+			server := config.ServerConfig{
+				DBType:   "mysql",
+				Host:     "db.example.com",
+				Port:     3307,
+				User:     tt.user,
+				Password: tt.password,
+				Database: tt.database,
+				TimeZone: "Asia/Tokyo",
+				Params:   map[string]string{"sql_mode": "'ANSI,TRADITIONAL'"},
+			}
+			cfg, err := mysql.ParseDSN(mysqlDriver{}.DSN(server))
+			if err != nil {
+				t.Fatalf("ParseDSN() error = %v", err)
+			}
+			if cfg.User != tt.user || cfg.Passwd != tt.password || cfg.DBName != tt.database {
+				t.Errorf("parsed user %q password %q database %q, want %q %q %q", cfg.User, cfg.Passwd, cfg.DBName, tt.user, tt.password, tt.database)
+			}
+			if cfg.Net != "tcp" || cfg.Addr != "db.example.com:3307" {
+				t.Errorf("parsed address %s(%s), want tcp(db.example.com:3307)", cfg.Net, cfg.Addr)
+			}
+			if cfg.Loc.String() != "Asia/Tokyo" {
+				t.Errorf("parsed loc %s, want Asia/Tokyo", cfg.Loc)
+			}
+			if cfg.Params["sql_mode"] != "'ANSI,TRADITIONAL'" {
+				t.Errorf("parsed sql_mode %q", cfg.Params["sql_mode"])
+			}
+		})
+	}
+}
+
+func TestPostgresDSN(t *testing.T) {
+	for _, tt := range dsnSecrets {
+		t.Run(tt.name, func(t *testing.T) {
+			server := config.ServerConfig{
+				DBType:   "postgresql",
+				Host:     "db.example.com",
+				Port:     5433,
+				User:     tt.user,
+				Password: tt.password,
+				Database: tt.database,
+				Params:   map[string]string{"application_name": "godbadmin & co"},
+			}
+			dsn, err := url.Parse(postgresDriver{}.DSN(server))
+			if err != nil {
+				t.Fatalf("url.Parse() error = %v", err)
+			}
+			password, _ := dsn.User.Password()
+			if dsn.User.Username() != tt.user || password != tt.password || dsn.Path != "/"+tt.database {
+				t.Errorf("parsed user %q password %q path %q, want %q %q /%s", dsn.User.Username(), password, dsn.Path, tt.user, tt.password, tt.database)
+			}
+			if dsn.Host != "db.example.com:5433" {
+				t.Errorf("parsed host %s, want db.example.com:5433", dsn.Host)
+			}
+			if got := dsn.Query().Get("application_name"); got != "godbadmin & co" {
+				t.Errorf("parsed application_name %q", got)
+			}
+		})
+	}
+}
+
+func TestPostgresDSNSocket(t *testing.T) {
+	server := config.ServerConfig{DBType: "postgresql", Socket: "/var/run/postgresql", Port: 5432, User: "app"}
+	dsn, err := url.Parse(postgresDriver{}.DSN(server))
+	if err != nil {
+		t.Fatalf("url.Parse() error = %v", err)
+	}
+	if dsn.Host != "" || dsn.Query().Get("host") != "/var/run/postgresql" || dsn.Query().Get("port") != "5432" {
+		t.Errorf("DSN %s does not connect to the socket directory", dsn)
+	}
+	if dsn.Path != "/"+defaultPostgresDatabase {
+		t.Errorf("DSN path %s, want /%s", dsn.Path, defaultPostgresDatabase)
+	}
+}
+
+func TestSQLiteDSN(t *testing.T) {
+	tests := []struct {
+		path string
+	}{
+		{"/data/app.db"},
+		{"/data/my app?.db"},
+		{"/data/a#b%c.db"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			dsn, err := url.Parse(sqliteDriver{}.DSN(config.ServerConfig{DBType: "sqlite", Host: tt.path}))
+			if err != nil {
+				t.Fatalf("url.Parse() error = %v", err)
+			}
+			if dsn.Path != tt.path || dsn.Query().Get("mode") != "rw" {
+				t.Errorf("parsed path %q mode %q, want %q rw", dsn.Path, dsn.Query().Get("mode"), tt.path)
+			}
+		})
+	}
+}
@@ -0,0 +1,270 @@
+package db
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxInsertBytes limits the size of one extended INSERT statement, like
+// mysqldump's net_buffer_length.
+const maxInsertBytes = 1 << 20
+
+// DumpOptions selects what WriteSQLDump writes.
+type DumpOptions struct {
+	Structure bool
+	Data      bool
+	// DropTable adds DROP TABLE IF EXISTS before each CREATE TABLE
+	DropTable bool
+	// ExtendedInserts writes many rows per INSERT statement
+	ExtendedInserts bool
+	// DisableForeignKeys turns foreign key checks off while the dump is loaded
+	DisableForeignKeys bool
+	// Progress, when set, is called with zero rows as each table starts and
+	// with the number of rows written so far after each row
+	Progress func(tableName string, rows int64)
+}
+
+// WriteSQLDump writes the structure and/or data of the given tables as SQL
+// statements that recreate them. Rows are streamed, so large tables are not
+// held in memory.
+func WriteSQLDump(ctx context.Context, w io.Writer, conn *Conn, database string, tables []string, opts DumpOptions) error {
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+
+	fmt.Fprintf(bw, "-- GoDB Admin SQL dump\n")
+	fmt.Fprintf(bw, "-- Server: %s\n", conn.Server.Address())
+	fmt.Fprintf(bw, "-- Database: %s\n", database)
+	fmt.Fprintf(bw, "-- Generated: %s\n\n", time.Now().Format("2006-01-02 15:04:05"))
+
+	if opts.DisableForeignKeys {
+		if stmt := foreignKeyChecks(conn, false); stmt != "" {
+			fmt.Fprintf(bw, "%s\n\n", stmt)
+		}
+	}
+
+	for _, tableName := range tables {
+		if opts.Progress != nil {
+			opts.Progress(tableName, 0)
+		}
+		if opts.Structure {
+			if err := dumpStructure(bw, conn, database, tableName, opts); err != nil {
+				return fmt.Errorf("%s: %w", tableName, err)
+			}
+		}
+		if opts.Data {
+			if err := dumpData(ctx, bw, conn, database, tableName, opts); err != nil {
+				return fmt.Errorf("%s: %w", tableName, err)
+			}
+		}
+	}
+
+	if opts.DisableForeignKeys {
+		if stmt := foreignKeyChecks(conn, true); stmt != "" {
+			fmt.Fprintf(bw, "%s\n", stmt)
+		}
+	}
+
+	return bw.Flush()
+}
+
+// foreignKeyChecks returns the statement that turns foreign key checks on or
+// off for the session loading the dump. PostgreSQL can only defer them with
+// superuser rights, so nothing is written for it.
+func foreignKeyChecks(conn *Conn, enabled bool) string {
+	switch conn.driver.(type) {
+	case mysqlDriver:
+		if enabled {
+			return "SET FOREIGN_KEY_CHECKS=1;"
+		}
+		return "SET FOREIGN_KEY_CHECKS=0;"
+	case sqliteDriver:
+		if enabled {
+			return "PRAGMA foreign_keys = ON;"
+		}
+		return "PRAGMA foreign_keys = OFF;"
+	}
+	return ""
+}
+
+func dumpStructure(w *bufio.Writer, conn *Conn, database, tableName string, opts DumpOptions) error {
+	createStmt, err := GetTableCreateStatement(conn, database, tableName)
+	if err != nil {
+		return err
+	}
+
+	sequences, err := ownedSequences(conn, database, tableName)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "--\n-- Table structure for %s\n--\n\n", tableName)
+	if opts.DropTable {
+		fmt.Fprintf(w, "DROP TABLE IF EXISTS %s;\n", conn.QuoteIdentifier(tableName))
+	}
+
+	// The sequences of serial columns are used by the column defaults, so
+	// they come first; those of identity columns are created by the table.
+	for _, seq := range sequences {
+		if seq.Identity != "" {
+			continue
+		}
+		cycle := "NO CYCLE"
+		if seq.Cycle {
+			cycle = "CYCLE"
+		}
+		fmt.Fprintf(w, "CREATE SEQUENCE IF NOT EXISTS %s AS %s INCREMENT BY %d MINVALUE %d MAXVALUE %d START WITH %d CACHE %d %s;\n",
+			seq.Name, seq.Type, seq.Increment, seq.Min, seq.Max, seq.Start, seq.Cache, cycle)
+		if seq.LastValue.Valid {
+			fmt.Fprintf(w, "SELECT setval(%s, %d, true);\n", conn.driver.QuoteLiteral(seq.Name), seq.LastValue.Int64)
+		}
+	}
+
+	createStmt = strings.TrimSpace(createStmt)
+	if !strings.HasSuffix(createStmt, ";") {
+		createStmt += ";"
+	}
+	fmt.Fprintf(w, "%s\n", createStmt)
+
+	for _, seq := range sequences {
+		column := conn.QuoteIdentifier(tableName) + "." + conn.QuoteIdentifier(seq.Column)
+		switch {
+		case seq.Identity == "":
+			fmt.Fprintf(w, "ALTER SEQUENCE %s OWNED BY %s;\n", seq.Name, column)
+		case seq.LastValue.Valid:
+			fmt.Fprintf(w, "SELECT setval(pg_get_serial_sequence(%s, %s), %d, true);\n",
+				conn.driver.QuoteLiteral(conn.QuoteIdentifier(tableName)), conn.driver.QuoteLiteral(seq.Column), seq.LastValue.Int64)
+		}
+	}
+	fmt.Fprintf(w, "\n")
+
+	return nil
+}
+
+// ownedSequences returns the sequences owned by the columns of a PostgreSQL
+// table, which a dump has to recreate along with it. Other servers have none.
+func ownedSequences(conn *Conn, database, tableName string) ([]pgSequence, error) {
+	d, ok := conn.driver.(postgresDriver)
+	if !ok {
+		return nil, nil
+	}
+	db, err := conn.Use(database)
+	if err != nil {
+		return nil, err
+	}
+	return d.ownedSequences(db, tableName)
+}
+
+func dumpData(ctx context.Context, w *bufio.Writer, conn *Conn, database, tableName string, opts DumpOptions) error {
+	rows, err := OpenTableRows(ctx, conn, database, tableName)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	quotedColumns := make([]string, len(rows.Columns))
+	for i, col := range rows.Columns {
+		quotedColumns[i] = conn.QuoteIdentifier(col)
+	}
+	insertPrefix := fmt.Sprintf("INSERT INTO %s (%s)", conn.QuoteIdentifier(tableName), strings.Join(quotedColumns, ", "))
+
+	// GENERATED ALWAYS identity columns only take the dumped values when told to
+	sequences, err := ownedSequences(conn, database, tableName)
+	if err != nil {
+		return err
+	}
+	for _, seq := range sequences {
+		if seq.Identity == "a" {
+			insertPrefix += " OVERRIDING SYSTEM VALUE"
+			break
+		}
+	}
+	insertPrefix += " VALUES"
+
+	fmt.Fprintf(w, "--\n-- Data for %s\n--\n\n", tableName)
+
+	var statement strings.Builder
+	flush := func() {
+		if statement.Len() > 0 {
+			w.WriteString(statement.String())
+			w.WriteString(";\n")
+			statement.Reset()
+		}
+	}
+
+	var count int64
+	for rows.Next() {
+		row, err := rows.Scan()
+		if err != nil {
+			return err
+		}
+		count++
+		if opts.Progress != nil {
+			opts.Progress(tableName, count)
+		}
+
+		values := make([]string, len(row))
+		for i, val := range row {
+			values[i] = sqlLiteral(conn, val)
+		}
+		tuple := "(" + strings.Join(values, ", ") + ")"
+
+		if !opts.ExtendedInserts {
+			fmt.Fprintf(w, "%s %s;\n", insertPrefix, tuple)
+			continue
+		}
+
+		if statement.Len() > 0 && statement.Len()+len(tuple) > maxInsertBytes {
+			flush()
+		}
+		if statement.Len() == 0 {
+			statement.WriteString(insertPrefix)
+			statement.WriteString("\n")
+		} else {
+			statement.WriteString(",\n")
+		}
+		statement.WriteString(tuple)
+	}
+	flush()
+	w.WriteString("\n")
+
+	return rows.Err()
+}
+
+// sqlLiteral formats a value from TableRows as a SQL literal for the server's dialect.
+func sqlLiteral(conn *Conn, value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "NULL"
+	case json.Number:
+		return string(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case bool:
+		if v {
+			return "TRUE"
+		}
+		return "FALSE"
+	case time.Time:
+		if v.Location() == time.UTC {
+			return conn.driver.QuoteLiteral(v.Format("2006-01-02 15:04:05.999999"))
+		}
+		return conn.driver.QuoteLiteral(v.Format("2006-01-02 15:04:05.999999-07:00"))
+	case []byte:
+		if _, ok := conn.driver.(postgresDriver); ok {
+			return `'\x` + hex.EncodeToString(v) + "'"
+		}
+		return "X'" + hex.EncodeToString(v) + "'"
+	case string:
+		return conn.driver.QuoteLiteral(v)
+	}
+	return conn.driver.QuoteLiteral(fmt.Sprintf("%v", value))
+}
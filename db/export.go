@@ -0,0 +1,143 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// TableRows streams the rows of a table for export. Values are converted by
+// column type so that formats with types can keep them: numbers become
+// int64, float64 or json.Number (exact decimals), binary columns []byte,
+// text string, and NULL nil. bool and time.Time pass through.
+type TableRows struct {
+	Columns []string
+
+	rows      *sqlx.Rows
+	typeNames []string
+}
+
+// OpenTableRows starts reading every row of a table. Cancelling ctx stops
+// the query on the server.
+func OpenTableRows(ctx context.Context, conn *Conn, database, tableName string) (*TableRows, error) {
+	db, err := conn.Use(database)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryxContext(ctx, fmt.Sprintf("SELECT * FROM %s", conn.Table(database, tableName)))
+	if err != nil {
+		return nil, err
+	}
+
+	columnTypes, err := rows.ColumnTypes()
+	if err != nil {
+		rows.Close()
+		return nil, err
+	}
+
+	t := &TableRows{
+		Columns:   make([]string, len(columnTypes)),
+		rows:      rows,
+		typeNames: make([]string, len(columnTypes)),
+	}
+	for i, col := range columnTypes {
+		t.Columns[i] = col.Name()
+		t.typeNames[i] = strings.ToUpper(col.DatabaseTypeName())
+	}
+
+	return t, nil
+}
+
+// Next prepares the next row for Scan.
+func (t *TableRows) Next() bool {
+	return t.rows.Next()
+}
+
+// Scan returns the converted values of the current row.
+func (t *TableRows) Scan() ([]interface{}, error) {
+	row, err := t.rows.SliceScan()
+	if err != nil {
+		return nil, err
+	}
+
+	for i, val := range row {
+		row[i] = exportValue(val, t.typeNames[i])
+	}
+	return row, nil
+}
+
+// Err returns the error, if any, that ended the iteration.
+func (t *TableRows) Err() error {
+	return t.rows.Err()
+}
+
+func (t *TableRows) Close() error {
+	return t.rows.Close()
+}
+
+// isBinaryType reports whether a column type holds bytes rather than text.
+func isBinaryType(typeName string) bool {
+	return strings.Contains(typeName, "BLOB") || strings.Contains(typeName, "BINARY") || typeName == "BYTEA"
+}
+
+// isNumericType reports whether a column type holds numbers, which drivers
+// such as MySQL's still return as bytes.
+func isNumericType(typeName string) bool {
+	switch strings.TrimPrefix(typeName, "UNSIGNED ") {
+	case "TINYINT", "SMALLINT", "MEDIUMINT", "INT", "INTEGER", "BIGINT", "INT2", "INT4", "INT8",
+		"DECIMAL", "NUMERIC", "FLOAT", "DOUBLE", "REAL", "FLOAT4", "FLOAT8":
+		return true
+	}
+	return false
+}
+
+// exportValue converts a scanned value according to the upper-case database
+// type name of its column.
+func exportValue(value interface{}, typeName string) interface{} {
+	switch v := value.(type) {
+	case nil, int64, bool, time.Time:
+		return v
+	case float64:
+		// NaN and Infinity have no number literal in SQL or JSON
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return strconv.FormatFloat(v, 'g', -1, 64)
+		}
+		return v
+	case []byte:
+		if isNumericType(typeName) {
+			if n, ok := exactNumber(string(v)); ok {
+				return n
+			}
+		}
+		if isBinaryType(typeName) || !utf8.Valid(v) {
+			return v
+		}
+		return string(v)
+	case string:
+		if isNumericType(typeName) {
+			if n, ok := exactNumber(v); ok {
+				return n
+			}
+		}
+		return v
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+// exactNumber keeps the text of a finite number so that decimals are not
+// rounded through float64.
+func exactNumber(s string) (json.Number, bool) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return "", false
+	}
+	return json.Number(s), true
+}
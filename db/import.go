@@ -0,0 +1,245 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MaxImportErrors is the number of failed rows kept in an ImportResult.
+const MaxImportErrors = 100
+
+// ImportRowError is a source row that could not be imported. Line is the
+// line or record number in the source file.
+type ImportRowError struct {
+	Line    int
+	Message string
+}
+
+func (e *ImportRowError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Message)
+}
+
+// ImportResult reports the outcome of ImportRows.
+type ImportResult struct {
+	// Statement is the INSERT statement run for each row
+	Statement string
+	Inserted  int64
+	Failed    int64
+	// Errors holds the first MaxImportErrors failed rows
+	Errors []ImportRowError
+}
+
+func (r *ImportResult) fail(rowErr ImportRowError) {
+	r.Failed++
+	if len(r.Errors) < MaxImportErrors {
+		r.Errors = append(r.Errors, rowErr)
+	}
+}
+
+// importRow is a row waiting in the current batch
+type importRow struct {
+	line   int
+	values []interface{}
+}
+
+// ImportRows inserts the rows returned by next into the given columns of a
+// table, committing a transaction every batchSize rows. When a batch fails it
+// is rolled back and its rows are inserted one by one, so each bad row is
+// reported and the others are kept. next returns io.EOF after the last row
+// and an *ImportRowError for a row it cannot read; any other error stops the
+// import. A nil value inserts NULL.
+//
+// The connection must be opened to the target database with OpenDatabase, as
+// table names are not qualified.
+func ImportRows(ctx context.Context, conn *Conn, tableName string, columns []string, next func() (int, []*string, error), batchSize int) (*ImportResult, error) {
+	if len(columns) == 0 {
+		return nil, errors.New("no columns to import")
+	}
+	if batchSize < 1 {
+		batchSize = 1
+	}
+
+	quoted := make([]string, len(columns))
+	placeholders := make([]string, len(columns))
+	for i, col := range columns {
+		quoted[i] = conn.QuoteIdentifier(col)
+		placeholders[i] = "?"
+	}
+	query := conn.DB.Rebind(fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)",
+		conn.QuoteIdentifier(tableName), strings.Join(quoted, ", "), strings.Join(placeholders, ", ")))
+
+	result := &ImportResult{Statement: query}
+	batch := make([]importRow, 0, batchSize)
+	for {
+		line, values, err := next()
+		if err == io.EOF {
+			break
+		}
+		var rowErr *ImportRowError
+		if errors.As(err, &rowErr) {
+			result.fail(*rowErr)
+			continue
+		}
+		if err != nil {
+			return result, err
+		}
+
+		row := importRow{line: line, values: make([]interface{}, len(values))}
+		for i, v := range values {
+			if v != nil {
+				row.values[i] = *v
+			}
+		}
+		batch = append(batch, row)
+
+		if len(batch) == batchSize {
+			if err := importBatch(ctx, conn, query, batch, result); err != nil {
+				return result, err
+			}
+			batch = batch[:0]
+		}
+	}
+
+	if len(batch) > 0 {
+		if err := importBatch(ctx, conn, query, batch, result); err != nil {
+			return result, err
+		}
+	}
+
+	// Rows that could not be read are reported before the failed inserts of their batch
+	sort.Slice(result.Errors, func(i, j int) bool {
+		return result.Errors[i].Line < result.Errors[j].Line
+	})
+	return result, nil
+}
+
+// importBatch inserts a batch in one transaction, falling back to inserting
+// the rows separately when any of them fails. The returned error is for
+// failures of the connection itself, not of rows.
+func importBatch(ctx context.Context, conn *Conn, query string, batch []importRow, result *ImportResult) error {
+	tx, err := conn.DB.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	// The statements of the transaction are reported once it commits; rolled
+	// back ones are run and reported again one by one below
+	hook := conn.OnExec
+	type execReport struct {
+		args         []interface{}
+		rowsAffected int64
+		err          error
+	}
+	var reports []execReport
+	conn.OnExec = func(query string, args []interface{}, rowsAffected int64, err error) {
+		reports = append(reports, execReport{args, rowsAffected, err})
+	}
+
+	failed := false
+	for _, row := range batch {
+		if _, err := conn.exec(ctx, tx, query, row.values...); err != nil {
+			failed = true
+			break
+		}
+	}
+	conn.OnExec = hook
+
+	if !failed {
+		if err := tx.Commit(); err == nil {
+			if hook != nil {
+				for _, r := range reports {
+					hook(query, r.args, r.rowsAffected, r.err)
+				}
+			}
+			result.Inserted += int64(len(batch))
+			return nil
+		}
+	} else {
+		tx.Rollback()
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	for _, row := range batch {
+		if _, err := conn.exec(ctx, conn.DB, query, row.values...); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			result.fail(ImportRowError{Line: row.line, Message: err.Error()})
+			continue
+		}
+		result.Inserted++
+	}
+	return nil
+}
+
+// CreateTableStatement returns a CREATE TABLE statement for new columns. Only
+// Name, Type and Nullable of each column are used.
+func CreateTableStatement(conn *Conn, tableName string, columns []ColumnEdit) (string, error) {
+	if tableName == "" {
+		return "", errors.New("table name is empty")
+	}
+	if len(columns) == 0 {
+		return "", errors.New("a table needs at least one column")
+	}
+
+	seen := make(map[string]bool)
+	defs := make([]string, len(columns))
+	for i, col := range columns {
+		if col.Name == "" {
+			return "", fmt.Errorf("column %d has no name", i+1)
+		}
+		if col.Type == "" {
+			return "", fmt.Errorf("column %s has no type", col.Name)
+		}
+		if seen[strings.ToLower(col.Name)] {
+			return "", fmt.Errorf("column name %s is used twice", col.Name)
+		}
+		seen[strings.ToLower(col.Name)] = true
+
+		null := "NULL"
+		if !col.Nullable {
+			null = "NOT NULL"
+		}
+		defs[i] = fmt.Sprintf("    %s %s %s", conn.QuoteIdentifier(col.Name), col.Type, null)
+	}
+
+	return fmt.Sprintf("CREATE TABLE %s (\n%s\n)", conn.QuoteIdentifier(tableName), strings.Join(defs, ",\n")), nil
+}
+
+// InferColumnType suggests a column type for text values: BIGINT when every
+// non-empty value is an integer, DOUBLE PRECISION when every one is a
+// number, and TEXT otherwise. The names are understood by all supported
+// servers.
+func InferColumnType(values []string) string {
+	integer, number, hasValue := true, true, false
+	for _, v := range values {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		hasValue = true
+		if _, err := strconv.ParseInt(v, 10, 64); err != nil {
+			integer = false
+		}
+		if _, err := strconv.ParseFloat(v, 64); err != nil {
+			number = false
+		}
+	}
+
+	switch {
+	case !hasValue:
+		return "TEXT"
+	case integer:
+		return "BIGINT"
+	case number:
+		return "DOUBLE PRECISION"
+	}
+	return "TEXT"
+}
@@ -0,0 +1,162 @@
+package db
+
+import (
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// MetadataTTL is how long the lists of databases and tables of a server are
+// cached. Statements changing the schema through godbadmin drop the cache at
+// once; changes made elsewhere show up after this or a manual refresh.
+const MetadataTTL = 30 * time.Second
+
+type cachedDatabases struct {
+	databases []DatabaseInfo
+	loaded    time.Time
+}
+
+type cachedTables struct {
+	tables []TableInfo
+	loaded time.Time
+}
+
+// serverMetadata is the cached metadata of one server
+type serverMetadata struct {
+	databases *cachedDatabases
+	tables    map[string]cachedTables
+}
+
+var (
+	metadataMu sync.Mutex
+	metadata   = make(map[string]*serverMetadata)
+)
+
+func metadataFor(serverID string) *serverMetadata {
+	m, ok := metadata[serverID]
+	if !ok {
+		m = &serverMetadata{tables: make(map[string]cachedTables)}
+		metadata[serverID] = m
+	}
+	return m
+}
+
+// CachedDatabases returns the databases of the server like GetAllDatabases,
+// from the cache when it is fresh.
+func CachedDatabases(conn *Conn) ([]DatabaseInfo, error) {
+	serverID := conn.Server.ID
+	if serverID == "" {
+		return GetAllDatabases(conn)
+	}
+
+	metadataMu.Lock()
+	if m, ok := metadata[serverID]; ok && m.databases != nil && time.Since(m.databases.loaded) < MetadataTTL {
+		databases := m.databases.databases
+		metadataMu.Unlock()
+		return databases, nil
+	}
+	metadataMu.Unlock()
+
+	databases, err := GetAllDatabases(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	metadataMu.Lock()
+	metadataFor(serverID).databases = &cachedDatabases{databases: databases, loaded: time.Now()}
+	metadataMu.Unlock()
+	return databases, nil
+}
+
+// CachedTables returns the tables of a database like GetTables, from the
+// cache when it is fresh.
+func CachedTables(conn *Conn, database string) ([]TableInfo, error) {
+	serverID := conn.Server.ID
+	if serverID == "" {
+		return GetTables(conn, database)
+	}
+
+	metadataMu.Lock()
+	if m, ok := metadata[serverID]; ok {
+		if cached, ok := m.tables[database]; ok && time.Since(cached.loaded) < MetadataTTL {
+			metadataMu.Unlock()
+			return cached.tables, nil
+		}
+	}
+	metadataMu.Unlock()
+
+	tables, err := GetTables(conn, database)
+	if err != nil {
+		return nil, err
+	}
+
+	metadataMu.Lock()
+	metadataFor(serverID).tables[database] = cachedTables{tables: tables, loaded: time.Now()}
+	metadataMu.Unlock()
+	return tables, nil
+}
+
+// CachedTree returns every database with its tables. Drivers that can list
+// the tables of all databases at once do so in one query. The others would
+// need a connection to each database, so only the tables in the cache are
+// returned and Tables is nil for the databases to load with CachedTables.
+func CachedTree(conn *Conn) ([]DatabaseWithTables, error) {
+	databases, err := CachedDatabases(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	lister, ok := conn.driver.(allTablesLister)
+	if !ok {
+		tree := make([]DatabaseWithTables, len(databases))
+		metadataMu.Lock()
+		m := metadata[conn.Server.ID]
+		for i, database := range databases {
+			tree[i].DatabaseName = database.DatabaseName
+			if m == nil {
+				continue
+			}
+			if cached, ok := m.tables[database.DatabaseName]; ok && time.Since(cached.loaded) < MetadataTTL {
+				tree[i].Tables = cached.tables
+			}
+		}
+		metadataMu.Unlock()
+		return tree, nil
+	}
+
+	all, err := lister.GetAllTables(conn.DB)
+	if err != nil {
+		return nil, err
+	}
+
+	tree := make([]DatabaseWithTables, len(databases))
+	for i, database := range databases {
+		tree[i] = DatabaseWithTables{DatabaseName: database.DatabaseName, Tables: all[database.DatabaseName]}
+	}
+
+	if conn.Server.ID != "" {
+		now := time.Now()
+		metadataMu.Lock()
+		m := metadataFor(conn.Server.ID)
+		for _, database := range tree {
+			m.tables[database.DatabaseName] = cachedTables{tables: database.Tables, loaded: now}
+		}
+		metadataMu.Unlock()
+	}
+	return tree, nil
+}
+
+// InvalidateMetadata drops the cached metadata of a server.
+func InvalidateMetadata(serverID string) {
+	metadataMu.Lock()
+	delete(metadata, serverID)
+	metadataMu.Unlock()
+}
+
+// allTablesLister is implemented by drivers that list the tables of every
+// database in one query.
+type allTablesLister interface {
+	// GetAllTables returns the tables by database name.
+	GetAllTables(db *sqlx.DB) (map[string][]TableInfo, error)
+}
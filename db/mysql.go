@@ -0,0 +1,456 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"godbadmin/config"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+)
+
+// mysqlDriver implements Driver for MySQL and MariaDB.
+type mysqlDriver struct{}
+
+func (mysqlDriver) DriverName() string {
+	return "mysql"
+}
+
+func (d mysqlDriver) DSN(server config.ServerConfig) string {
+	return d.dsn(server, nil)
+}
+
+// dsn renders the settings of the server with mysql.Config, which escapes the
+// database name and parameter values. Passwords may contain '@' and '/' as
+// the driver splits the DSN at the last of each.
+func (mysqlDriver) dsn(server config.ServerConfig, tunnel *sshTunnel) string {
+	cfg := mysql.NewConfig()
+	cfg.User = server.User
+	cfg.Passwd = server.Password
+	cfg.DBName = server.Database
+
+	switch {
+	case tunnel != nil:
+		cfg.Net, cfg.Addr = sshNetwork, tunnel.id
+	case server.Socket != "":
+		cfg.Net, cfg.Addr = "unix", server.Socket
+	default:
+		cfg.Net, cfg.Addr = "tcp", net.JoinHostPort(server.Host, strconv.Itoa(server.Port))
+	}
+
+	cfg.Timeout = time.Duration(server.ConnectTimeout) * time.Second
+	cfg.ReadTimeout = time.Duration(server.ReadTimeout) * time.Second
+	cfg.WriteTimeout = time.Duration(server.WriteTimeout) * time.Second
+	if server.Charset != "" {
+		cfg.Apply(mysql.Charset(server.Charset, server.Collation))
+	} else {
+		cfg.Collation = server.Collation
+	}
+
+	switch server.TLS() {
+	case config.TLSDisabled:
+	case config.TLSPreferred:
+		cfg.TLSConfig = tlsConfigName(server)
+		cfg.AllowFallbackToPlaintext = true
+	default:
+		cfg.TLSConfig = tlsConfigName(server)
+	}
+
+	// The parameters are parsed again when connecting, so loc and the
+	// extra ones reach the driver like they would in a hand-written DSN
+	if server.TimeZone != "" || len(server.Params) > 0 {
+		cfg.Params = make(map[string]string, len(server.Params)+1)
+		if server.TimeZone != "" {
+			cfg.Params["loc"] = server.TimeZone
+		}
+		for key, value := range server.Params {
+			cfg.Params[key] = value
+		}
+	}
+	return cfg.FormatDSN()
+}
+
+// open registers the TLS settings of the server with the driver, then
+// connects directly or through the dialer registered for sshNetwork, which
+// finds the tunnel by its ID in the DSN.
+func (d mysqlDriver) open(server config.ServerConfig, tunnel *sshTunnel) (*sqlx.DB, error) {
+	tlsCfg, err := tlsConfig(server)
+	if err != nil {
+		return nil, err
+	}
+	if tlsCfg != nil {
+		// Registering again replaces the settings, so certificate files
+		// are read again when a pool reconnects
+		if err := mysql.RegisterTLSConfig(tlsConfigName(server), tlsCfg); err != nil {
+			return nil, err
+		}
+	}
+
+	return sqlx.Open(d.DriverName(), d.dsn(server, tunnel))
+}
+
+func (mysqlDriver) DefaultPort() int {
+	return 3306
+}
+
+func (mysqlDriver) QuoteIdentifier(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
+
+func (mysqlDriver) QuoteLiteral(value string) string {
+	// Backslashes are escapes unless NO_BACKSLASH_ESCAPES is set
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", "''").Replace(value) + "'"
+}
+
+func (d mysqlDriver) QualifyTable(database, tableName string) string {
+	if database == "" {
+		return d.QuoteIdentifier(tableName)
+	}
+	return d.QuoteIdentifier(database) + "." + d.QuoteIdentifier(tableName)
+}
+
+func (mysqlDriver) UseDatabase(conn *Conn, database string) (*sqlx.DB, error) {
+	return conn.DB, nil
+}
+
+func (mysqlDriver) GetDatabases(db *sqlx.DB, includeSystem bool) ([]DatabaseInfo, error) {
+	var databases []DatabaseInfo
+	query := `SELECT SCHEMA_NAME FROM information_schema.SCHEMATA
+	          WHERE SCHEMA_NAME NOT IN ('information_schema', 'mysql', 'performance_schema', 'sys')
+	          ORDER BY SCHEMA_NAME`
+	if includeSystem {
+		query = `SELECT SCHEMA_NAME FROM information_schema.SCHEMATA ORDER BY SCHEMA_NAME`
+	}
+
+	err := db.Select(&databases, query)
+	if err != nil {
+		return nil, err
+	}
+
+	return databases, nil
+}
+
+func (mysqlDriver) GetTables(db *sqlx.DB, database string) ([]TableInfo, error) {
+	var tables []TableInfo
+	query := `SELECT TABLE_NAME FROM information_schema.TABLES WHERE TABLE_SCHEMA = ? ORDER BY TABLE_NAME`
+
+	err := db.Select(&tables, query, database)
+	if err != nil {
+		return nil, err
+	}
+
+	return tables, nil
+}
+
+func (mysqlDriver) GetAllTables(db *sqlx.DB) (map[string][]TableInfo, error) {
+	var rows []struct {
+		Schema string `db:"TABLE_SCHEMA"`
+		Name   string `db:"TABLE_NAME"`
+	}
+	query := `SELECT TABLE_SCHEMA, TABLE_NAME FROM information_schema.TABLES ORDER BY TABLE_SCHEMA, TABLE_NAME`
+
+	err := db.Select(&rows, query)
+	if err != nil {
+		return nil, err
+	}
+
+	tables := make(map[string][]TableInfo)
+	for _, row := range rows {
+		tables[row.Schema] = append(tables[row.Schema], TableInfo{TableName: row.Name})
+	}
+	return tables, nil
+}
+
+func (d mysqlDriver) GetTableColumns(db *sqlx.DB, database, tableName string) ([]ColumnInfo, error) {
+	var columns []ColumnInfo
+	query := fmt.Sprintf("SHOW COLUMNS FROM %s", d.QualifyTable(database, tableName))
+	err := db.Select(&columns, query)
+	if err != nil {
+		return nil, err
+	}
+
+	return columns, nil
+}
+
+func (mysqlDriver) GetPrimaryKeyColumns(db *sqlx.DB, database, tableName string) ([]string, error) {
+	var pkColumns []string
+	query := `SELECT COLUMN_NAME
+	          FROM information_schema.KEY_COLUMN_USAGE
+	          WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ? AND CONSTRAINT_NAME = 'PRIMARY'
+	          ORDER BY ORDINAL_POSITION`
+
+	err := db.Select(&pkColumns, query, database, tableName)
+	if err != nil {
+		return nil, err
+	}
+
+	return pkColumns, nil
+}
+
+func (d mysqlDriver) GetTableCreateStatement(db *sqlx.DB, database, tableName string) (string, error) {
+	// Use QueryRow and scan into map to handle any number of columns
+	query := fmt.Sprintf("SHOW CREATE TABLE %s", d.QualifyTable(database, tableName))
+
+	var tblName string
+	var createStmt string
+
+	err := db.QueryRow(query).Scan(&tblName, &createStmt)
+	if err != nil {
+		return "", err
+	}
+
+	return createStmt, nil
+}
+
+func (mysqlDriver) EstimateRowCount(db *sqlx.DB, database, tableName string) (int64, error) {
+	// TABLE_ROWS is exact for MyISAM, an estimate for InnoDB and NULL for views
+	var rows sql.NullInt64
+	query := `SELECT TABLE_ROWS FROM information_schema.TABLES WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ?`
+	err := db.Get(&rows, query, database, tableName)
+	if err != nil {
+		return 0, err
+	}
+	if !rows.Valid {
+		return 0, errors.New("no row count statistics")
+	}
+
+	return rows.Int64, nil
+}
+
+func (mysqlDriver) GetServerInfo(db *sqlx.DB) (*ServerInfo, error) {
+	info := &ServerInfo{}
+
+	// Get version
+	var version string
+	err := db.Get(&version, "SELECT VERSION()")
+	if err == nil {
+		info.Version = version
+	}
+
+	// Get version comment
+	var versionComment string
+	err = db.Get(&versionComment, "SELECT @@version_comment")
+	if err == nil {
+		info.VersionComment = versionComment
+	}
+
+	// Get protocol version
+	var protocolVersion string
+	err = db.Get(&protocolVersion, "SELECT @@protocol_version")
+	if err == nil {
+		info.ProtocolVersion = protocolVersion
+	}
+
+	// Get connection ID
+	var connectionID int
+	err = db.Get(&connectionID, "SELECT CONNECTION_ID()")
+	if err == nil {
+		info.ConnectionID = fmt.Sprintf("%d", connectionID)
+	}
+
+	// Get current user
+	var currentUser string
+	err = db.Get(&currentUser, "SELECT CURRENT_USER()")
+	if err == nil {
+		info.CurrentUser = currentUser
+	}
+
+	// Get character set
+	var charsetServer string
+	err = db.Get(&charsetServer, "SELECT @@character_set_server")
+	if err == nil {
+		info.CharacterSetServer = charsetServer
+	}
+
+	// Get collation
+	var collationServer string
+	err = db.Get(&collationServer, "SELECT @@collation_server")
+	if err == nil {
+		info.CollationServer = collationServer
+	}
+
+	// Get connection character set
+	var charsetConnection string
+	err = db.Get(&charsetConnection, "SELECT @@character_set_connection")
+	if err == nil {
+		info.CharacterSetConnection = charsetConnection
+	}
+
+	// Get connection collation
+	var collationConnection string
+	err = db.Get(&collationConnection, "SELECT @@collation_connection")
+	if err == nil {
+		info.CollationConnection = collationConnection
+	}
+
+	// Get SSL cipher and protocol (empty if not using SSL). SHOW STATUS
+	// returns the name and value of each variable.
+	var sslStatus []struct {
+		Name  string `db:"Variable_name"`
+		Value string `db:"Value"`
+	}
+	err = db.Select(&sslStatus, "SHOW SESSION STATUS WHERE Variable_name IN ('Ssl_cipher', 'Ssl_version')")
+	if err == nil {
+		for _, status := range sslStatus {
+			switch status.Name {
+			case "Ssl_cipher":
+				info.SSLCipher = status.Value
+			case "Ssl_version":
+				info.SSLVersion = status.Value
+			}
+		}
+	}
+
+	return info, nil
+}
+
+func (d mysqlDriver) GetUserPrivileges(db *sqlx.DB) ([]UserPrivilege, error) {
+	// Get all users
+	type MySQLUser struct {
+		User string `db:"User"`
+		Host string `db:"Host"`
+	}
+
+	var users []MySQLUser
+	err := db.Select(&users, "SELECT User, Host FROM mysql.user ORDER BY User, Host")
+	if err != nil {
+		return nil, err
+	}
+
+	var userPrivileges []UserPrivilege
+	for _, user := range users {
+		// Get grants for each user
+		grants, err := d.GetUserGrants(db, user.User, user.Host)
+		if err != nil {
+			// Skip users we can't query
+			continue
+		}
+
+		userPrivileges = append(userPrivileges, UserPrivilege{
+			User:       user.User,
+			Host:       user.Host,
+			Privileges: fmt.Sprintf("%d grants", len(grants)),
+		})
+	}
+
+	return userPrivileges, nil
+}
+
+func (d mysqlDriver) GetUserGrants(db *sqlx.DB, user, host string) ([]string, error) {
+	query := fmt.Sprintf("SHOW GRANTS FOR %s@%s", d.QuoteLiteral(user), d.QuoteLiteral(host))
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var grants []string
+	for rows.Next() {
+		var grant string
+		if err := rows.Scan(&grant); err == nil {
+			grants = append(grants, grant)
+		}
+	}
+
+	return grants, nil
+}
+
+// RowIDColumn returns none: InnoDB reads a table without a primary key in
+// the order of its hidden row ID, which cannot be selected.
+func (mysqlDriver) RowIDColumn(db *sqlx.DB, database, tableName string) (string, error) {
+	return "", nil
+}
+
+// charsetNamePattern matches the names of MySQL character sets and
+// collations, which cannot be quoted in CREATE DATABASE
+var charsetNamePattern = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+func (d mysqlDriver) CreateDatabase(name, charset, collation string) (string, error) {
+	if charset != "" && !charsetNamePattern.MatchString(charset) {
+		return "", fmt.Errorf("invalid character set %q", charset)
+	}
+	if collation != "" && !charsetNamePattern.MatchString(collation) {
+		return "", fmt.Errorf("invalid collation %q", collation)
+	}
+
+	// Build CREATE DATABASE query
+	query := fmt.Sprintf("CREATE DATABASE %s", d.QuoteIdentifier(name))
+	if charset != "" {
+		query += fmt.Sprintf(" CHARACTER SET %s", charset)
+	}
+	if collation != "" {
+		query += fmt.Sprintf(" COLLATE %s", collation)
+	}
+
+	return query, nil
+}
+
+func (d mysqlDriver) AlterColumn(tableName string, current *ColumnInfo, edit ColumnEdit) ([]string, error) {
+	table := d.QuoteIdentifier(tableName)
+
+	if current == nil {
+		return []string{fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, d.QuoteIdentifier(edit.Name), d.columnDefinition(edit, ""))}, nil
+	}
+	if edit.Drop {
+		return []string{fmt.Sprintf("ALTER TABLE %s DROP COLUMN %s", table, d.QuoteIdentifier(current.Field))}, nil
+	}
+
+	var statements []string
+	diff := diffColumn(*current, edit)
+	if diff.Rename {
+		statements = append(statements, fmt.Sprintf("ALTER TABLE %s RENAME COLUMN %s TO %s", table, d.QuoteIdentifier(current.Field), d.QuoteIdentifier(edit.Name)))
+	}
+	if diff.modified() {
+		// MODIFY replaces the whole definition, so carry over AUTO_INCREMENT and ON UPDATE
+		statements = append(statements, fmt.Sprintf("ALTER TABLE %s MODIFY COLUMN %s %s", table, d.QuoteIdentifier(edit.Name), d.columnDefinition(edit, current.Extra)))
+	}
+
+	return statements, nil
+}
+
+func (mysqlDriver) columnDefinition(edit ColumnEdit, extra string) string {
+	def := edit.Type
+	if edit.Nullable {
+		def += " NULL"
+	} else {
+		def += " NOT NULL"
+	}
+	if edit.Default != "" {
+		def += " DEFAULT " + mysqlDefault(edit.Default)
+	}
+
+	lowerExtra := strings.ToLower(extra)
+	if strings.Contains(lowerExtra, "auto_increment") {
+		def += " AUTO_INCREMENT"
+	}
+	if i := strings.Index(lowerExtra, "on update "); i != -1 {
+		def += " " + extra[i:]
+	}
+
+	return def
+}
+
+// mysqlDefault turns a default as shown by SHOW COLUMNS back into SQL. Plain
+// values are shown unquoted, so everything except NULL, numbers and
+// expressions is quoted as a string.
+func mysqlDefault(value string) string {
+	upper := strings.ToUpper(value)
+	switch {
+	case upper == "NULL",
+		strings.HasPrefix(upper, "CURRENT_TIMESTAMP"),
+		strings.HasPrefix(upper, "NOW("),
+		strings.HasPrefix(value, "("):
+		return value
+	}
+	if _, err := strconv.ParseFloat(value, 64); err == nil {
+		return value
+	}
+
+	return mysqlDriver{}.QuoteLiteral(value)
+}
@@ -0,0 +1,402 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"godbadmin/config"
+	"godbadmin/redact"
+	"log"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// HealthCheckInterval is how often open pools are pinged.
+const HealthCheckInterval = time.Minute
+
+// MaxDatabasePools is how many databases of one server keep connections of
+// their own. The least recently used one not in use is closed beyond that.
+const MaxDatabasePools = 8
+
+// pool holds the connections to one server. Handlers share it across
+// requests through Open, so each page view does not pay for a new handshake.
+type pool struct {
+	server config.ServerConfig
+	driver Driver
+	dsn    string
+	db     *sqlx.DB
+	// tunnel is the SSH tunnel the connections go through, if any
+	tunnel *sshTunnel
+
+	// refs counts the Conns using a saved server's pool. A pool replaced or
+	// invalidated is retired, and closed once the last of them is released.
+	// Both are guarded by poolsMu.
+	refs    int
+	retired bool
+
+	mu sync.Mutex
+	// Connections to other databases, opened when the driver selects the
+	// database when connecting (PostgreSQL) or for scripts naming tables
+	// without their database.
+	databases map[string]*databasePool
+	closed    bool
+}
+
+// databasePool is the connections to one database other than the default.
+type databasePool struct {
+	db       *sqlx.DB
+	refs     int
+	lastUsed time.Time
+}
+
+var (
+	poolsMu sync.Mutex
+	pools   = make(map[string]*pool)
+)
+
+// newPool connects to the server. Errors never contain its passwords, which
+// some drivers echo back with the DSN.
+func newPool(server config.ServerConfig) (*pool, error) {
+	p, err := connectPool(server)
+	return p, redact.Error(err, server.Secrets()...)
+}
+
+func connectPool(server config.ServerConfig) (*pool, error) {
+	driver, err := GetDriver(server.DBType)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &pool{server: server, driver: driver, dsn: driver.DSN(server)}
+	if server.UsesSSH() {
+		p.tunnel, err = openTunnel(server)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	p.db, err = p.connect(server)
+	if err != nil {
+		if p.tunnel != nil {
+			p.tunnel.close()
+		}
+		return nil, err
+	}
+	return p, nil
+}
+
+// connect opens a connection pool with the server's limits.
+func (p *pool) connect(server config.ServerConfig) (*sqlx.DB, error) {
+	var db *sqlx.DB
+	var err error
+	if o, ok := p.driver.(opener); ok {
+		db, err = o.open(server, p.tunnel)
+	} else if p.tunnel != nil {
+		return nil, fmt.Errorf("SSH tunnels are not supported for %s", server.DBType)
+	} else {
+		db, err = sqlx.Open(p.driver.DriverName(), p.driver.DSN(server))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	maxOpen, maxIdle, idleTimeout := server.PoolLimits()
+	db.SetMaxOpenConns(maxOpen)
+	db.SetMaxIdleConns(maxIdle)
+	db.SetConnMaxIdleTime(idleTimeout)
+	return db, nil
+}
+
+// opener is implemented by drivers that need more than their DSN to connect,
+// such as TLS settings or an SSH tunnel.
+type opener interface {
+	// open opens a connection pool to the server, through the tunnel unless
+	// it is nil.
+	open(server config.ServerConfig, tunnel *sshTunnel) (*sqlx.DB, error)
+}
+
+// database returns the connections whose default database is the given one,
+// and the function releasing them once they are no longer used.
+func (p *pool) database(database string) (*sqlx.DB, func(), error) {
+	server := p.server
+	server.Database = database
+	// SQLite ignores the database and PostgreSQL's default is named
+	if p.driver.DSN(server) == p.dsn {
+		return p.db, func() {}, nil
+	}
+
+	if db, ok := p.useDatabase(database, nil); ok {
+		return db, p.releaser(database), nil
+	}
+
+	// Connect without holding the lock, so a slow server does not hold up
+	// the other databases
+	db, err := p.connect(server)
+	if err != nil {
+		return nil, nil, redact.Error(err, server.Secrets()...)
+	}
+	if db, ok := p.useDatabase(database, db); ok {
+		return db, p.releaser(database), nil
+	}
+	return nil, nil, fmt.Errorf("the connections to %s were closed", p.server.Name)
+}
+
+// useDatabase takes the connections to a database, adding db unless another
+// request connected first. It closes db when it is not needed, and the least
+// recently used connections beyond MaxDatabasePools.
+func (p *pool) useDatabase(database string, db *sqlx.DB) (*sqlx.DB, bool) {
+	p.mu.Lock()
+	d, ok := p.databases[database]
+	switch {
+	case ok:
+		d.refs++
+		d.lastUsed = time.Now()
+	case db != nil && !p.closed:
+		if p.databases == nil {
+			p.databases = make(map[string]*databasePool)
+		}
+		d = &databasePool{db: db, refs: 1, lastUsed: time.Now()}
+		p.databases[database] = d
+		ok = true
+	}
+	evicted := p.evict()
+	p.mu.Unlock()
+
+	if db != nil && (!ok || d.db != db) {
+		db.Close()
+	}
+	for _, db := range evicted {
+		db.Close()
+	}
+	if !ok {
+		return nil, false
+	}
+	return d.db, true
+}
+
+// releaser returns the function releasing the connections to a database
+// taken by useDatabase.
+func (p *pool) releaser(database string) func() {
+	return func() {
+		p.mu.Lock()
+		if d, ok := p.databases[database]; ok {
+			d.refs--
+		}
+		evicted := p.evict()
+		p.mu.Unlock()
+
+		for _, db := range evicted {
+			db.Close()
+		}
+	}
+}
+
+// evict removes the least recently used databases not in use beyond
+// MaxDatabasePools, and returns their connections to close. p.mu is held.
+func (p *pool) evict() []*sqlx.DB {
+	var evicted []*sqlx.DB
+	for len(p.databases) > MaxDatabasePools {
+		oldest := ""
+		for name, d := range p.databases {
+			if d.refs == 0 && (oldest == "" || d.lastUsed.Before(p.databases[oldest].lastUsed)) {
+				oldest = name
+			}
+		}
+		if oldest == "" {
+			break
+		}
+		evicted = append(evicted, p.databases[oldest].db)
+		delete(p.databases, oldest)
+	}
+	return evicted
+}
+
+// ping checks the connections that are open. Pools whose connections all
+// timed out are left alone rather than reconnected.
+func (p *pool) ping(ctx context.Context) error {
+	p.mu.Lock()
+	dbs := []*sqlx.DB{p.db}
+	for _, d := range p.databases {
+		dbs = append(dbs, d.db)
+	}
+	p.mu.Unlock()
+
+	for _, db := range dbs {
+		if db.Stats().OpenConnections == 0 {
+			continue
+		}
+		if err := db.PingContext(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *pool) close() error {
+	p.mu.Lock()
+	for _, d := range p.databases {
+		d.db.Close()
+	}
+	p.databases = nil
+	p.closed = true
+	p.mu.Unlock()
+
+	err := p.db.Close()
+	if p.tunnel != nil {
+		p.tunnel.close()
+	}
+	return err
+}
+
+// serverPool returns the pool of a saved server, connecting on first use,
+// for a Conn that releases it when closed. A pool opened with different
+// settings is replaced, so edits made outside the UI are picked up too.
+func serverPool(server config.ServerConfig) (*pool, error) {
+	poolsMu.Lock()
+	if p, ok := pools[server.ID]; ok && reflect.DeepEqual(p.server, server) {
+		p.refs++
+		poolsMu.Unlock()
+		return p, nil
+	}
+	poolsMu.Unlock()
+
+	// Connect without holding the lock, so a slow server does not hold up the others
+	p, err := newPool(server)
+	if err != nil {
+		return nil, err
+	}
+
+	poolsMu.Lock()
+	existing, ok := pools[server.ID]
+	if ok && reflect.DeepEqual(existing.server, server) {
+		existing.refs++
+		poolsMu.Unlock()
+		p.close()
+		return existing, nil
+	}
+	idle := ok && existing.retire()
+	p.refs++
+	pools[server.ID] = p
+	poolsMu.Unlock()
+
+	if idle {
+		existing.close()
+	}
+	return p, nil
+}
+
+// retire marks a pool removed from pools, and reports whether no Conn uses
+// it any more so that it can be closed now. poolsMu is held.
+func (p *pool) retire() bool {
+	p.retired = true
+	return p.refs == 0
+}
+
+// release is called when a Conn using the pool is closed, and closes a
+// retired pool after its last Conn.
+func (p *pool) release() {
+	poolsMu.Lock()
+	p.refs--
+	idle := p.retired && p.refs == 0
+	poolsMu.Unlock()
+
+	if idle {
+		p.close()
+	}
+}
+
+// Open returns a connection to a saved server from its pool, without a
+// default database. Queries name tables with their database.
+func Open(server config.ServerConfig) (*Conn, error) {
+	server.Database = ""
+	p, err := serverPool(server)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Conn{DB: p.db, Server: server, driver: p.driver, pool: p}, nil
+}
+
+// OpenDatabase returns a connection to a saved server from its pool, on which
+// statements naming tables without their database find them in database.
+// It is meant for user scripts such as the SQL console and imports.
+func OpenDatabase(server config.ServerConfig, database string) (*Conn, error) {
+	server.Database = ""
+	p, err := serverPool(server)
+	if err != nil {
+		return nil, err
+	}
+
+	db, release, err := p.database(database)
+	if err != nil {
+		p.release()
+		return nil, err
+	}
+
+	server.Database = database
+	return &Conn{DB: db, Server: server, driver: p.driver, pool: p, releases: []func(){release}}, nil
+}
+
+// Invalidate closes the pool of a server, once the requests using it are
+// done, and drops its cached metadata. Call it when the server is edited or
+// deleted.
+func Invalidate(serverID string) {
+	poolsMu.Lock()
+	p, ok := pools[serverID]
+	delete(pools, serverID)
+	idle := ok && p.retire()
+	poolsMu.Unlock()
+
+	if idle {
+		p.close()
+	}
+	InvalidateMetadata(serverID)
+}
+
+// StartHealthChecks pings the open pools at the given interval and closes
+// those whose server stopped answering, so the next request reconnects.
+func StartHealthChecks(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			checkPools()
+		}
+	}()
+}
+
+func checkPools() {
+	poolsMu.Lock()
+	current := make(map[string]*pool, len(pools))
+	for id, p := range pools {
+		current[id] = p
+	}
+	poolsMu.Unlock()
+
+	for id, p := range current {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err := p.ping(ctx)
+		cancel()
+		if err == nil {
+			continue
+		}
+
+		log.Printf("db: health check of %s failed, closing its connections: %v", p.server.Name, redact.Error(err, p.server.Secrets()...))
+		poolsMu.Lock()
+		idle := false
+		if pools[id] == p {
+			delete(pools, id)
+			idle = p.retire()
+		}
+		poolsMu.Unlock()
+		if idle {
+			p.close()
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"godbadmin/config"
+	"path/filepath"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// newSQLiteFile creates an SQLite database file holding a table t.
+func newSQLiteFile(t *testing.T) string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "test.db")
+	sqlDB, err := sql.Open("sqlite", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqlDB.Close()
+	if _, err := sqlDB.Exec(`CREATE TABLE t (id INTEGER PRIMARY KEY)`); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+// isClosed reports whether db was closed rather than just unused.
+func isClosed(db *sqlx.DB) bool {
+	return db.Ping() != nil
+}
+
+func TestPoolClosedAfterLastConn(t *testing.T) {
+	server := config.ServerConfig{ID: "pool-test", Name: "test", DBType: "sqlite", Host: newSQLiteFile(t)}
+	t.Cleanup(func() { Invalidate(server.ID) })
+
+	tests := []struct {
+		name string
+		// retire replaces or drops the pool the connections use
+		retire func()
+	}{
+		{"invalidated", func() { Invalidate(server.ID) }},
+		{"replaced by an edited server", func() {
+			edited := server
+			edited.Name = "renamed"
+			conn, err := Open(edited)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.Close()
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			first, err := Open(server)
+			if err != nil {
+				t.Fatal(err)
+			}
+			second, err := Open(server)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if first.pool != second.pool {
+				t.Fatal("the connections do not share the pool")
+			}
+			tt.retire()
+
+			var n int
+			if err := first.Get(&n, `SELECT count(*) FROM t`); err != nil {
+				t.Fatalf("query after the pool was retired: %v", err)
+			}
+			first.Close()
+			first.Close()
+			if isClosed(second.DB) {
+				t.Fatal("the pool was closed while a connection still used it")
+			}
+			second.Close()
+			if !isClosed(second.DB) {
+				t.Error("the pool was not closed after its last connection")
+			}
+			Invalidate(server.ID)
+		})
+	}
+}
+
+// databaseFileDriver is SQLite with a file per database, standing in for
+// servers that connect to each database separately.
+type databaseFileDriver struct {
+	sqliteDriver
+	dir string
+}
+
+func (d databaseFileDriver) DSN(server config.ServerConfig) string {
+	name := server.Database
+	if name == "" {
+		name = "default"
+	}
+	return "file:" + filepath.Join(d.dir, name+".db")
+}
+
+func TestPoolEvictsDatabases(t *testing.T) {
+	driver := databaseFileDriver{dir: t.TempDir()}
+	server := config.ServerConfig{Name: "test"}
+	p := &pool{server: server, driver: driver, dsn: driver.DSN(server)}
+	var err error
+	if p.db, err = p.connect(server); err != nil {
+		t.Fatal(err)
+	}
+	defer p.close()
+
+	// The first database stays in use while more than MaxDatabasePools are
+	// opened and released
+	inUse, releaseInUse, err := p.database("db0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbs := map[string]*sqlx.DB{}
+	for i := 1; i <= MaxDatabasePools+2; i++ {
+		name := fmt.Sprintf("db%d", i)
+		db, release, err := p.database(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dbs[name] = db
+		release()
+	}
+
+	if len(p.databases) != MaxDatabasePools {
+		t.Errorf("%d databases open, want %d", len(p.databases), MaxDatabasePools)
+	}
+	if isClosed(inUse) {
+		t.Error("a database in use was closed")
+	}
+	for _, name := range []string{"db1", "db2", "db3"} {
+		if !isClosed(dbs[name]) {
+			t.Errorf("%s is still open, want the least recently used closed", name)
+		}
+	}
+	if isClosed(dbs[fmt.Sprintf("db%d", MaxDatabasePools+2)]) {
+		t.Error("the most recently used database was closed")
+	}
+
+	// Reusing a database returns the same connections
+	again, release, err := p.database("db0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != inUse {
+		t.Error("db0 was connected again")
+	}
+	release()
+	releaseInUse()
+}
@@ -0,0 +1,623 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	sqldriver "database/sql/driver"
+	"errors"
+	"fmt"
+	"godbadmin/config"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// postgresDriver implements Driver for PostgreSQL. A PostgreSQL connection is
+// bound to one database, so every database shown in the tree gets its own
+// connection, and the tables listed are the ones on the search_path.
+type postgresDriver struct{}
+
+// defaultPostgresDatabase is used when the server has no database configured.
+const defaultPostgresDatabase = "postgres"
+
+func (postgresDriver) DriverName() string {
+	return "postgres"
+}
+
+func (postgresDriver) DSN(server config.ServerConfig) string {
+	database := server.Database
+	if database == "" {
+		database = defaultPostgresDatabase
+	}
+
+	query := url.Values{"sslmode": {postgresSSLModes[server.TLS()]}}
+	switch server.TLS() {
+	case config.TLSVerifyCA, config.TLSVerifyIdentity:
+		// lib/pq verifies against sslrootcert even for sslmode=require,
+		// so the CA is only passed to the modes that verify
+		if server.TLSCACert != "" {
+			query.Set("sslrootcert", expandHome(server.TLSCACert))
+		}
+	}
+	if server.TLS() != config.TLSDisabled && server.TLSClientCert != "" {
+		query.Set("sslcert", expandHome(server.TLSClientCert))
+		query.Set("sslkey", expandHome(server.TLSClientKey))
+	}
+	if server.ConnectTimeout > 0 {
+		query.Set("connect_timeout", strconv.Itoa(server.ConnectTimeout))
+	}
+	if server.TimeZone != "" {
+		// Unknown parameters are sent to the server as session settings
+		query.Set("timezone", server.TimeZone)
+	}
+	for key, value := range server.Params {
+		query.Set(key, value)
+	}
+
+	dsn := url.URL{
+		Scheme: "postgres",
+		User:   url.UserPassword(server.User, server.Password),
+		Path:   "/" + database,
+	}
+	if server.Socket != "" {
+		// lib/pq connects to the socket in the host directory
+		query.Set("host", server.Socket)
+		query.Set("port", strconv.Itoa(server.Port))
+	} else {
+		dsn.Host = net.JoinHostPort(server.Host, strconv.Itoa(server.Port))
+	}
+	dsn.RawQuery = query.Encode()
+	return dsn.String()
+}
+
+// postgresSSLModes maps the TLS modes to sslmode. lib/pq has no "prefer",
+// so preferred connections fall back to plaintext in open.
+var postgresSSLModes = map[string]string{
+	config.TLSDisabled:       "disable",
+	config.TLSPreferred:      "require",
+	config.TLSRequired:       "require",
+	config.TLSVerifyCA:       "verify-ca",
+	config.TLSVerifyIdentity: "verify-full",
+}
+
+func (d postgresDriver) open(server config.ServerConfig, tunnel *sshTunnel) (*sqlx.DB, error) {
+	connector, err := d.connector(server, tunnel)
+	if err != nil {
+		return nil, err
+	}
+
+	if server.TLS() == config.TLSPreferred {
+		plainServer := server
+		plainServer.TLSMode = config.TLSDisabled
+		plain, err := d.connector(plainServer, tunnel)
+		if err != nil {
+			return nil, err
+		}
+		connector = preferTLSConnector{tls: connector, plain: plain}
+	}
+	return sqlx.NewDb(sql.OpenDB(connector), d.DriverName()), nil
+}
+
+func (d postgresDriver) connector(server config.ServerConfig, tunnel *sshTunnel) (sqldriver.Connector, error) {
+	connector, err := pq.NewConnector(d.DSN(server))
+	if err != nil {
+		return nil, err
+	}
+	if tunnel != nil {
+		connector.Dialer(tunnel)
+	}
+	return connector, nil
+}
+
+// preferTLSConnector connects with TLS and falls back to plaintext when the
+// server does not support it, like libpq's sslmode=prefer.
+type preferTLSConnector struct {
+	tls, plain sqldriver.Connector
+}
+
+func (c preferTLSConnector) Connect(ctx context.Context) (sqldriver.Conn, error) {
+	conn, err := c.tls.Connect(ctx)
+	if errors.Is(err, pq.ErrSSLNotSupported) {
+		return c.plain.Connect(ctx)
+	}
+	return conn, err
+}
+
+func (c preferTLSConnector) Driver() sqldriver.Driver {
+	return c.tls.Driver()
+}
+
+func (postgresDriver) DefaultPort() int {
+	return 5432
+}
+
+func (postgresDriver) QuoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+func (postgresDriver) QuoteLiteral(value string) string {
+	return quoteLiteral(value)
+}
+
+// QualifyTable leaves the database out, as each database has its own
+// connection and tables are found through the search_path.
+func (d postgresDriver) QualifyTable(database, tableName string) string {
+	return d.QuoteIdentifier(tableName)
+}
+
+func (postgresDriver) UseDatabase(conn *Conn, database string) (*sqlx.DB, error) {
+	current := conn.Server.Database
+	if current == "" {
+		current = defaultPostgresDatabase
+	}
+	if database == current {
+		return conn.DB, nil
+	}
+
+	return conn.openDatabase(database)
+}
+
+func (postgresDriver) GetDatabases(db *sqlx.DB, includeSystem bool) ([]DatabaseInfo, error) {
+	var databases []DatabaseInfo
+	query := `SELECT datname AS "SCHEMA_NAME" FROM pg_database
+	          WHERE datallowconn AND NOT datistemplate
+	          ORDER BY datname`
+	if includeSystem {
+		query = `SELECT datname AS "SCHEMA_NAME" FROM pg_database WHERE datallowconn ORDER BY datname`
+	}
+
+	err := db.Select(&databases, query)
+	if err != nil {
+		return nil, err
+	}
+
+	return databases, nil
+}
+
+func (postgresDriver) GetTables(db *sqlx.DB, database string) ([]TableInfo, error) {
+	var tables []TableInfo
+	query := `SELECT table_name AS "TABLE_NAME" FROM information_schema.tables
+	          WHERE table_schema = ANY (current_schemas(false))
+	          ORDER BY table_name`
+
+	err := db.Select(&tables, query)
+	if err != nil {
+		return nil, err
+	}
+
+	return tables, nil
+}
+
+func (d postgresDriver) GetTableColumns(db *sqlx.DB, database, tableName string) ([]ColumnInfo, error) {
+	var columns []ColumnInfo
+	query := `SELECT a.attname AS "Field",
+	                 format_type(a.atttypid, a.atttypmod) AS "Type",
+	                 CASE WHEN a.attnotnull THEN 'NO' ELSE 'YES' END AS "Null",
+	                 CASE
+	                     WHEN EXISTS (SELECT 1 FROM pg_index i WHERE i.indrelid = a.attrelid AND i.indisprimary AND a.attnum = ANY (i.indkey)) THEN 'PRI'
+	                     WHEN EXISTS (SELECT 1 FROM pg_index i WHERE i.indrelid = a.attrelid AND i.indisunique AND a.attnum = ANY (i.indkey)) THEN 'UNI'
+	                     ELSE ''
+	                 END AS "Key",
+	                 pg_get_expr(ad.adbin, ad.adrelid) AS "Default",
+	                 CASE
+	                     WHEN a.attidentity <> '' OR pg_get_expr(ad.adbin, ad.adrelid) LIKE 'nextval(%' THEN 'auto_increment'
+	                     ELSE ''
+	                 END AS "Extra"
+	          FROM pg_attribute a
+	          LEFT JOIN pg_attrdef ad ON ad.adrelid = a.attrelid AND ad.adnum = a.attnum
+	          WHERE a.attrelid = to_regclass($1) AND a.attnum > 0 AND NOT a.attisdropped
+	          ORDER BY a.attnum`
+
+	err := db.Select(&columns, query, d.QuoteIdentifier(tableName))
+	if err != nil {
+		return nil, err
+	}
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("table %s does not exist", tableName)
+	}
+
+	return columns, nil
+}
+
+func (d postgresDriver) GetPrimaryKeyColumns(db *sqlx.DB, database, tableName string) ([]string, error) {
+	var pkColumns []string
+	query := `SELECT a.attname
+	          FROM pg_index i
+	          JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = ANY (i.indkey)
+	          WHERE i.indrelid = to_regclass($1) AND i.indisprimary
+	          ORDER BY array_position(i.indkey::int2[], a.attnum)`
+
+	err := db.Select(&pkColumns, query, d.QuoteIdentifier(tableName))
+	if err != nil {
+		return nil, err
+	}
+
+	return pkColumns, nil
+}
+
+// RowIDColumn returns ctid for tables and materialized views. The rows of a
+// partitioned table are told apart by their partition too; views have none.
+func (d postgresDriver) RowIDColumn(db *sqlx.DB, database, tableName string) (string, error) {
+	var kind string
+	if err := db.Get(&kind, `SELECT relkind FROM pg_class WHERE oid = to_regclass($1)`, d.QuoteIdentifier(tableName)); err != nil {
+		return "", err
+	}
+	switch kind {
+	case "r", "m":
+		return "ctid", nil
+	case "p":
+		return "tableoid, ctid", nil
+	}
+	return "", nil
+}
+
+// GetTableCreateStatement rebuilds a CREATE TABLE statement from the catalog,
+// since PostgreSQL has no SHOW CREATE TABLE.
+func (d postgresDriver) GetTableCreateStatement(db *sqlx.DB, database, tableName string) (string, error) {
+	columns, err := d.GetTableColumns(db, database, tableName)
+	if err != nil {
+		return "", err
+	}
+
+	// Identity columns have no default; their sequence comes with the table
+	identities := map[string]string{}
+	sequences, err := d.ownedSequences(db, tableName)
+	if err != nil {
+		return "", err
+	}
+	for _, seq := range sequences {
+		switch seq.Identity {
+		case "a":
+			identities[seq.Column] = " GENERATED ALWAYS AS IDENTITY"
+		case "d":
+			identities[seq.Column] = " GENERATED BY DEFAULT AS IDENTITY"
+		}
+	}
+
+	var definitions []string
+	for _, col := range columns {
+		def := fmt.Sprintf("    %s %s", d.QuoteIdentifier(col.Field), col.Type)
+		if col.Null == "NO" {
+			def += " NOT NULL"
+		}
+		if col.Default != nil {
+			def += " DEFAULT " + *col.Default
+		}
+		def += identities[col.Field]
+		definitions = append(definitions, def)
+	}
+
+	// Table constraints, primary key first
+	type constraint struct {
+		Name       string `db:"conname"`
+		Definition string `db:"definition"`
+	}
+	var constraints []constraint
+	err = db.Select(&constraints, `SELECT conname, pg_get_constraintdef(oid) AS definition
+	                               FROM pg_constraint
+	                               WHERE conrelid = to_regclass($1)
+	                               ORDER BY contype <> 'p', conname`, d.QuoteIdentifier(tableName))
+	if err != nil {
+		return "", err
+	}
+	for _, con := range constraints {
+		definitions = append(definitions, fmt.Sprintf("    CONSTRAINT %s %s", d.QuoteIdentifier(con.Name), con.Definition))
+	}
+
+	stmt := fmt.Sprintf("CREATE TABLE %s (\n%s\n);", d.QuoteIdentifier(tableName), strings.Join(definitions, ",\n"))
+
+	// Indexes that are not backing a constraint
+	var indexes []string
+	err = db.Select(&indexes, `SELECT pg_get_indexdef(i.indexrelid)
+	                           FROM pg_index i
+	                           WHERE i.indrelid = to_regclass($1)
+	                             AND NOT EXISTS (SELECT 1 FROM pg_constraint c WHERE c.conindid = i.indexrelid)
+	                           ORDER BY i.indexrelid`, d.QuoteIdentifier(tableName))
+	if err != nil {
+		return "", err
+	}
+	for _, index := range indexes {
+		stmt += "\n" + index + ";"
+	}
+
+	return stmt, nil
+}
+
+// pgSequence is a sequence owned by a column of a table: the sequence
+// behind a serial column, or the one of an identity column.
+type pgSequence struct {
+	Name   string `db:"name"`
+	Column string `db:"column_name"`
+	// Identity is 'a' (ALWAYS) or 'd' (BY DEFAULT) for an identity column,
+	// empty for a serial one
+	Identity  string        `db:"identity"`
+	Type      string        `db:"type"`
+	Start     int64         `db:"start"`
+	Increment int64         `db:"increment"`
+	Min       int64         `db:"min_value"`
+	Max       int64         `db:"max_value"`
+	Cache     int64         `db:"cache"`
+	Cycle     bool          `db:"cycle"`
+	LastValue sql.NullInt64 `db:"last_value"`
+}
+
+// ownedSequences returns the sequences owned by the columns of a table, in
+// column order. LastValue is NULL until the sequence is first used.
+func (d postgresDriver) ownedSequences(db *sqlx.DB, tableName string) ([]pgSequence, error) {
+	var sequences []pgSequence
+	query := `SELECT s.oid::regclass::text AS name,
+	                 a.attname AS column_name,
+	                 a.attidentity::text AS identity,
+	                 format_type(q.seqtypid, NULL) AS type,
+	                 q.seqstart AS start,
+	                 q.seqincrement AS increment,
+	                 q.seqmin AS min_value,
+	                 q.seqmax AS max_value,
+	                 q.seqcache AS cache,
+	                 q.seqcycle AS cycle,
+	                 pg_sequence_last_value(s.oid) AS last_value
+	          FROM pg_depend dep
+	          JOIN pg_class s ON s.oid = dep.objid AND s.relkind = 'S'
+	          JOIN pg_sequence q ON q.seqrelid = s.oid
+	          JOIN pg_attribute a ON a.attrelid = dep.refobjid AND a.attnum = dep.refobjsubid
+	          WHERE dep.classid = 'pg_class'::regclass
+	            AND dep.refclassid = 'pg_class'::regclass
+	            AND dep.refobjid = to_regclass($1)
+	            AND dep.deptype IN ('a', 'i')
+	          ORDER BY a.attnum`
+
+	if err := db.Select(&sequences, query, d.QuoteIdentifier(tableName)); err != nil {
+		return nil, err
+	}
+	return sequences, nil
+}
+
+func (d postgresDriver) EstimateRowCount(db *sqlx.DB, database, tableName string) (int64, error) {
+	// reltuples is -1 (or 0 before PostgreSQL 14) until the table is analyzed
+	var rows float64
+	err := db.Get(&rows, `SELECT reltuples FROM pg_class WHERE oid = to_regclass($1)`, d.QuoteIdentifier(tableName))
+	if err != nil {
+		return 0, err
+	}
+	if rows < 0 {
+		return 0, errors.New("table has not been analyzed")
+	}
+
+	return int64(rows), nil
+}
+
+func (postgresDriver) GetServerInfo(db *sqlx.DB) (*ServerInfo, error) {
+	info := &ServerInfo{}
+
+	// Get version
+	var version string
+	err := db.Get(&version, "SHOW server_version")
+	if err == nil {
+		info.Version = version
+	}
+
+	// Get full version string
+	var versionComment string
+	err = db.Get(&versionComment, "SELECT version()")
+	if err == nil {
+		info.VersionComment = versionComment
+	}
+
+	// lib/pq always speaks the version 3 frontend/backend protocol
+	info.ProtocolVersion = "3"
+
+	// Get backend process ID
+	var connectionID int
+	err = db.Get(&connectionID, "SELECT pg_backend_pid()")
+	if err == nil {
+		info.ConnectionID = fmt.Sprintf("%d", connectionID)
+	}
+
+	// Get current user
+	var currentUser string
+	err = db.Get(&currentUser, "SELECT current_user")
+	if err == nil {
+		info.CurrentUser = currentUser
+	}
+
+	// Get server encoding
+	var charsetServer string
+	err = db.Get(&charsetServer, "SHOW server_encoding")
+	if err == nil {
+		info.CharacterSetServer = charsetServer
+	}
+
+	// Get collation of the current database
+	var collation string
+	err = db.Get(&collation, "SELECT datcollate FROM pg_database WHERE datname = current_database()")
+	if err == nil {
+		info.CollationServer = collation
+		info.CollationConnection = collation
+	}
+
+	// Get client encoding
+	var charsetConnection string
+	err = db.Get(&charsetConnection, "SHOW client_encoding")
+	if err == nil {
+		info.CharacterSetConnection = charsetConnection
+	}
+
+	// Get SSL cipher (NULL if not using SSL)
+	var ssl struct {
+		Cipher  sql.NullString `db:"cipher"`
+		Version sql.NullString `db:"version"`
+	}
+	err = db.Get(&ssl, "SELECT cipher, version FROM pg_stat_ssl WHERE pid = pg_backend_pid()")
+	if err == nil {
+		info.SSLCipher = ssl.Cipher.String
+		info.SSLVersion = ssl.Version.String
+	}
+
+	return info, nil
+}
+
+func (d postgresDriver) GetUserPrivileges(db *sqlx.DB) ([]UserPrivilege, error) {
+	var roles []string
+	err := db.Select(&roles, `SELECT rolname FROM pg_roles WHERE rolname !~ '^pg_' ORDER BY rolname`)
+	if err != nil {
+		return nil, err
+	}
+
+	var userPrivileges []UserPrivilege
+	for _, role := range roles {
+		grants, err := d.GetUserGrants(db, role, "")
+		if err != nil {
+			// Skip roles we can't query
+			continue
+		}
+
+		userPrivileges = append(userPrivileges, UserPrivilege{
+			User:       role,
+			Privileges: fmt.Sprintf("%d grants", len(grants)),
+		})
+	}
+
+	return userPrivileges, nil
+}
+
+// GetUserGrants describes a role as the statements that would recreate its
+// attributes, memberships and table privileges. PostgreSQL roles have no host.
+func (d postgresDriver) GetUserGrants(db *sqlx.DB, user, host string) ([]string, error) {
+	var role struct {
+		Super       bool `db:"rolsuper"`
+		CreateRole  bool `db:"rolcreaterole"`
+		CreateDB    bool `db:"rolcreatedb"`
+		CanLogin    bool `db:"rolcanlogin"`
+		Replication bool `db:"rolreplication"`
+	}
+	err := db.Get(&role, `SELECT rolsuper, rolcreaterole, rolcreatedb, rolcanlogin, rolreplication
+	                      FROM pg_roles WHERE rolname = $1`, user)
+	if err != nil {
+		return nil, err
+	}
+
+	var grants []string
+
+	var attributes []string
+	for _, attr := range []struct {
+		set  bool
+		name string
+	}{
+		{role.Super, "SUPERUSER"},
+		{role.CreateRole, "CREATEROLE"},
+		{role.CreateDB, "CREATEDB"},
+		{role.CanLogin, "LOGIN"},
+		{role.Replication, "REPLICATION"},
+	} {
+		if attr.set {
+			attributes = append(attributes, attr.name)
+		}
+	}
+	if len(attributes) > 0 {
+		grants = append(grants, fmt.Sprintf("ALTER ROLE %s WITH %s", d.QuoteIdentifier(user), strings.Join(attributes, " ")))
+	}
+
+	// Role memberships
+	var memberOf []string
+	err = db.Select(&memberOf, `SELECT r.rolname
+	                            FROM pg_auth_members m
+	                            JOIN pg_roles r ON r.oid = m.roleid
+	                            JOIN pg_roles u ON u.oid = m.member
+	                            WHERE u.rolname = $1
+	                            ORDER BY r.rolname`, user)
+	if err != nil {
+		return nil, err
+	}
+	for _, parent := range memberOf {
+		grants = append(grants, fmt.Sprintf("GRANT %s TO %s", d.QuoteIdentifier(parent), d.QuoteIdentifier(user)))
+	}
+
+	// Table privileges in the connected database
+	type tableGrant struct {
+		Schema     string `db:"table_schema"`
+		Table      string `db:"table_name"`
+		Privileges string `db:"privileges"`
+	}
+	var tableGrants []tableGrant
+	err = db.Select(&tableGrants, `SELECT table_schema, table_name, string_agg(privilege_type, ', ' ORDER BY privilege_type) AS privileges
+	                               FROM information_schema.role_table_grants
+	                               WHERE grantee = $1
+	                               GROUP BY table_schema, table_name
+	                               ORDER BY table_schema, table_name`, user)
+	if err != nil {
+		return nil, err
+	}
+	for _, g := range tableGrants {
+		grants = append(grants, fmt.Sprintf("GRANT %s ON %s.%s TO %s",
+			g.Privileges, d.QuoteIdentifier(g.Schema), d.QuoteIdentifier(g.Table), d.QuoteIdentifier(user)))
+	}
+
+	return grants, nil
+}
+
+func (d postgresDriver) CreateDatabase(name, charset, collation string) (string, error) {
+	query := fmt.Sprintf("CREATE DATABASE %s", d.QuoteIdentifier(name))
+	if charset != "" {
+		query += fmt.Sprintf(" ENCODING %s", quoteLiteral(charset))
+	}
+	if collation != "" {
+		// template1 may use a different locale, so copy from template0
+		query += fmt.Sprintf(" LC_COLLATE %s TEMPLATE template0", quoteLiteral(collation))
+	}
+
+	return query, nil
+}
+
+func (d postgresDriver) AlterColumn(tableName string, current *ColumnInfo, edit ColumnEdit) ([]string, error) {
+	table := d.QuoteIdentifier(tableName)
+
+	if current == nil {
+		def := edit.Type
+		if !edit.Nullable {
+			def += " NOT NULL"
+		}
+		if edit.Default != "" {
+			def += " DEFAULT " + edit.Default
+		}
+		return []string{fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, d.QuoteIdentifier(edit.Name), def)}, nil
+	}
+	if edit.Drop {
+		return []string{fmt.Sprintf("ALTER TABLE %s DROP COLUMN %s", table, d.QuoteIdentifier(current.Field))}, nil
+	}
+
+	// Defaults are expressions as returned by pg_get_expr, so they are used as is
+	var statements []string
+	diff := diffColumn(*current, edit)
+	column := d.QuoteIdentifier(edit.Name)
+	if diff.Rename {
+		statements = append(statements, fmt.Sprintf("ALTER TABLE %s RENAME COLUMN %s TO %s", table, d.QuoteIdentifier(current.Field), column))
+	}
+	if diff.Type {
+		statements = append(statements, fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s TYPE %s", table, column, edit.Type))
+	}
+	if diff.Null {
+		action := "SET NOT NULL"
+		if edit.Nullable {
+			action = "DROP NOT NULL"
+		}
+		statements = append(statements, fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s %s", table, column, action))
+	}
+	if diff.Default {
+		action := "DROP DEFAULT"
+		if edit.Default != "" {
+			action = "SET DEFAULT " + edit.Default
+		}
+		statements = append(statements, fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s %s", table, column, action))
+	}
+
+	return statements, nil
+}
+
+// quoteLiteral quotes a string literal using standard SQL escaping.
+func quoteLiteral(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
@@ -0,0 +1,277 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	sqldriver "database/sql/driver"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// MaxQueryRows is the maximum number of rows kept for each result set of the SQL console.
+const MaxQueryRows = 1000
+
+// StatementResult is the outcome of one statement run from the SQL console.
+type StatementResult struct {
+	SQL          string          `json:"sql"`
+	Columns      []string        `json:"columns,omitempty"`
+	Rows         [][]interface{} `json:"rows,omitempty"`
+	HasResultSet bool            `json:"has_result_set"`
+	Truncated    bool            `json:"truncated,omitempty"`
+	RowsAffected int64           `json:"rows_affected"`
+	Elapsed      time.Duration   `json:"elapsed_ns"`
+	Error        string          `json:"error,omitempty"`
+}
+
+// ElapsedMillis returns the elapsed time in milliseconds for display.
+func (r StatementResult) ElapsedMillis() float64 {
+	return float64(r.Elapsed.Microseconds()) / 1000
+}
+
+// ExecuteSQL runs the statements in script one after another on a single
+// connection, so session state such as SET or temporary tables carries over.
+// Execution stops at the first failing statement.
+func ExecuteSQL(ctx context.Context, conn *Conn, script string) ([]StatementResult, error) {
+	_, backslashEscapes := conn.driver.(mysqlDriver)
+	return ExecuteStatements(ctx, conn, SplitStatements(script, backslashEscapes))
+}
+
+// ExecuteStatements runs already split statements the same way as ExecuteSQL.
+func ExecuteStatements(ctx context.Context, conn *Conn, statements []string) ([]StatementResult, error) {
+	session, err := conn.DB.Connx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer discard(session)
+
+	var results []StatementResult
+	for _, stmt := range statements {
+		result := StatementResult{SQL: stmt}
+		start := time.Now()
+
+		if returnsRows(stmt) {
+			// A result set may still come with changes, as from CALL or a
+			// data-modifying WITH, so these are reported too
+			err = queryStatement(ctx, session, stmt, &result)
+			conn.report(stmt, nil, -1, err)
+		} else {
+			var res sql.Result
+			res, err = conn.exec(ctx, session, stmt)
+			if err == nil {
+				result.RowsAffected, _ = res.RowsAffected()
+			}
+		}
+
+		result.Elapsed = time.Since(start)
+		if err != nil {
+			result.Error = err.Error()
+			results = append(results, result)
+			break
+		}
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+// discard closes a session instead of returning it to the pool, as the script
+// may have changed its default database or session variables.
+func discard(session *sqlx.Conn) {
+	session.Raw(func(interface{}) error {
+		return sqldriver.ErrBadConn
+	})
+	session.Close()
+}
+
+func queryStatement(ctx context.Context, session *sqlx.Conn, stmt string, result *StatementResult) error {
+	rows, err := session.QueryxContext(ctx, stmt)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	result.Columns = columns
+	result.HasResultSet = len(columns) > 0
+
+	for rows.Next() {
+		if len(result.Rows) >= MaxQueryRows {
+			result.Truncated = true
+			break
+		}
+
+		row, err := rows.SliceScan()
+		if err != nil {
+			return err
+		}
+
+		// Convert []byte to string for display
+		for i, val := range row {
+			if b, ok := val.([]byte); ok {
+				row[i] = string(b)
+			}
+		}
+
+		result.Rows = append(result.Rows, row)
+	}
+	result.RowsAffected = int64(len(result.Rows))
+
+	return rows.Err()
+}
+
+// returnsRows reports whether a statement produces a result set, judged by
+// its first keyword.
+func returnsRows(stmt string) bool {
+	switch firstKeyword(stmt) {
+	case "SELECT", "WITH", "SHOW", "DESCRIBE", "DESC", "EXPLAIN", "PRAGMA", "VALUES", "TABLE", "CALL":
+		return true
+	}
+	return false
+}
+
+// changesSchema reports whether a statement may create, drop or change a
+// database or table, judged by its first keyword.
+func changesSchema(stmt string) bool {
+	switch firstKeyword(stmt) {
+	case "CREATE", "DROP", "ALTER", "RENAME", "ATTACH", "DETACH":
+		return true
+	}
+	return false
+}
+
+// firstKeyword returns the first keyword of a statement in upper case.
+func firstKeyword(stmt string) string {
+	stmt = strings.TrimLeft(stripLeadingComments(stmt), "( \t\r\n")
+	end := strings.IndexFunc(stmt, func(r rune) bool {
+		return !unicode.IsLetter(r)
+	})
+	if end == -1 {
+		end = len(stmt)
+	}
+	return strings.ToUpper(stmt[:end])
+}
+
+// stripLeadingComments removes comments that precede the first keyword.
+func stripLeadingComments(stmt string) string {
+	for {
+		stmt = strings.TrimSpace(stmt)
+		switch {
+		case strings.HasPrefix(stmt, "--"), strings.HasPrefix(stmt, "#"):
+			i := strings.IndexByte(stmt, '\n')
+			if i == -1 {
+				return ""
+			}
+			stmt = stmt[i+1:]
+		case strings.HasPrefix(stmt, "/*"):
+			i := strings.Index(stmt, "*/")
+			if i == -1 {
+				return ""
+			}
+			stmt = stmt[i+2:]
+		default:
+			return stmt
+		}
+	}
+}
+
+// SplitStatements splits a script on semicolons that are not inside quotes,
+// comments or PostgreSQL dollar-quoted strings. backslashEscapes enables
+// MySQL-style backslash escapes inside string literals.
+func SplitStatements(script string, backslashEscapes bool) []string {
+	var statements []string
+	start := 0
+
+	add := func(end int) {
+		stmt := strings.TrimSpace(script[start:end])
+		if stripLeadingComments(stmt) != "" {
+			statements = append(statements, stmt)
+		}
+	}
+
+	for i := 0; i < len(script); i++ {
+		switch c := script[i]; c {
+		case '\'', '"', '`':
+			for i++; i < len(script); i++ {
+				if backslashEscapes && script[i] == '\\' && c != '`' {
+					i++
+					continue
+				}
+				if script[i] == c {
+					// A doubled quote is an escaped quote
+					if i+1 < len(script) && script[i+1] == c {
+						i++
+						continue
+					}
+					break
+				}
+			}
+		case '-':
+			if strings.HasPrefix(script[i:], "--") {
+				i = skipLine(script, i)
+			}
+		case '/':
+			if strings.HasPrefix(script[i:], "/*") {
+				end := strings.Index(script[i+2:], "*/")
+				if end == -1 {
+					i = len(script)
+				} else {
+					i += end + 3
+				}
+			}
+		case '$':
+			if tag, ok := dollarQuoteTag(script, i); ok {
+				end := strings.Index(script[i+len(tag):], tag)
+				if end == -1 {
+					i = len(script)
+				} else {
+					i += len(tag) + end + len(tag) - 1
+				}
+			}
+		case ';':
+			add(i)
+			start = i + 1
+		}
+	}
+	add(len(script))
+
+	return statements
+}
+
+func skipLine(script string, i int) int {
+	end := strings.IndexByte(script[i:], '\n')
+	if end == -1 {
+		return len(script)
+	}
+	return i + end
+}
+
+// dollarQuoteTag returns the opening tag of a dollar-quoted string ($$ or $tag$) at position i.
+func dollarQuoteTag(script string, i int) (string, bool) {
+	// $1 placeholders and identifiers containing $ are not quotes
+	if i > 0 && isIdentChar(script[i-1]) {
+		return "", false
+	}
+	for j := i + 1; j < len(script); j++ {
+		if script[j] == '$' {
+			tag := script[i : j+1]
+			if len(tag) > 2 && tag[1] >= '0' && tag[1] <= '9' {
+				return "", false
+			}
+			return tag, true
+		}
+		if !isIdentChar(script[j]) {
+			return "", false
+		}
+	}
+	return "", false
+}
+
+func isIdentChar(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
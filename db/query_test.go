@@ -0,0 +1,146 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"godbadmin/config"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSplitStatements(t *testing.T) {
+	tests := []struct {
+		name             string
+		script           string
+		backslashEscapes bool
+		want             []string
+	}{
+		{
+			name:   "statements",
+			script: "SELECT 1; SELECT 2;\nSELECT 3",
+			want:   []string{"SELECT 1", "SELECT 2", "SELECT 3"},
+		},
+		{
+			name:   "empty statements",
+			script: " ; ;\n;",
+			want:   nil,
+		},
+		{
+			name:   "semicolons in quotes",
+			script: `INSERT INTO t VALUES ('a;b', "c;d", ` + "`e;f`" + `); SELECT 1`,
+			want:   []string{`INSERT INTO t VALUES ('a;b', "c;d", ` + "`e;f`" + `)`, "SELECT 1"},
+		},
+		{
+			name:   "doubled quotes",
+			script: "SELECT 'it''s;'; SELECT 2",
+			want:   []string{"SELECT 'it''s;'", "SELECT 2"},
+		},
+		{
+			name:             "backslash escapes",
+			script:           `SELECT 'a\';b'; SELECT 2`,
+			backslashEscapes: true,
+			want:             []string{`SELECT 'a\';b'`, "SELECT 2"},
+		},
+		{
+			name:   "backslash without escapes",
+			script: `SELECT 'a\'; SELECT 2`,
+			want:   []string{`SELECT 'a\'`, "SELECT 2"},
+		},
+		{
+			name:   "line comments",
+			script: "-- first; still a comment\nSELECT 1; -- second\nSELECT 2",
+			want:   []string{"-- first; still a comment\nSELECT 1", "-- second\nSELECT 2"},
+		},
+		{
+			name:   "block comments",
+			script: "/* a; b */ SELECT 1; SELECT /* ; */ 2",
+			want:   []string{"/* a; b */ SELECT 1", "SELECT /* ; */ 2"},
+		},
+		{
+			name:   "comment only",
+			script: "SELECT 1;\n-- trailing comment",
+			want:   []string{"SELECT 1"},
+		},
+		{
+			name:   "unterminated block comment",
+			script: "SELECT 1; /* never closed; SELECT 2",
+			want:   []string{"SELECT 1"},
+		},
+		{
+			name:   "dollar quotes",
+			script: "CREATE FUNCTION f() RETURNS int AS $$ SELECT 1; $$ LANGUAGE sql; SELECT 2",
+			want:   []string{"CREATE FUNCTION f() RETURNS int AS $$ SELECT 1; $$ LANGUAGE sql", "SELECT 2"},
+		},
+		{
+			name:   "tagged dollar quotes",
+			script: "DO $body$ BEGIN RAISE NOTICE '$$;'; END $body$; SELECT 2",
+			want:   []string{"DO $body$ BEGIN RAISE NOTICE '$$;'; END $body$", "SELECT 2"},
+		},
+		{
+			name:   "placeholders are not dollar quotes",
+			script: "SELECT $1; SELECT $2",
+			want:   []string{"SELECT $1", "SELECT $2"},
+		},
+		{
+			name:   "dollar in identifier",
+			script: "SELECT a$b$c FROM t; SELECT 2",
+			want:   []string{"SELECT a$b$c FROM t", "SELECT 2"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := SplitStatements(tt.script, tt.backslashEscapes)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("SplitStatements(%q) = %q, want %q", tt.script, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExecuteStatementsReportsEveryStatement(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "test.db")
+	sqlDB, err := sql.Open("sqlite", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sqlDB.Exec(`CREATE TABLE t (id INTEGER PRIMARY KEY); INSERT INTO t VALUES (1), (2), (3)`); err != nil {
+		t.Fatal(err)
+	}
+	sqlDB.Close()
+
+	conn, err := Connect(config.ServerConfig{DBType: "sqlite", Host: filename})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	type report struct {
+		query  string
+		failed bool
+	}
+	var reports []report
+	conn.OnExec = func(query string, args []interface{}, rowsAffected int64, err error) {
+		reports = append(reports, report{query, err != nil})
+	}
+
+	statements := []string{
+		"DELETE FROM t WHERE id = 1",
+		"WITH gone AS (SELECT 2 AS id) DELETE FROM t WHERE id IN (SELECT id FROM gone) RETURNING id",
+		"SELECT count(*) FROM t",
+		"CALL cleanup()",
+	}
+	results, err := ExecuteStatements(context.Background(), conn, statements)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 4 || results[1].Error != "" || len(results[1].Rows) != 1 || results[3].Error == "" {
+		t.Fatalf("results = %+v", results)
+	}
+
+	want := []report{{statements[0], false}, {statements[1], false}, {statements[2], false}, {statements[3], true}}
+	if !reflect.DeepEqual(reports, want) {
+		t.Errorf("reported %v, want %v", reports, want)
+	}
+}
@@ -0,0 +1,278 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"godbadmin/config"
+	"net/url"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	_ "modernc.org/sqlite"
+)
+
+func init() {
+	// sqlx only knows the cgo driver name; modernc.org/sqlite registers "sqlite"
+	sqlx.BindDriver("sqlite", sqlx.QUESTION)
+}
+
+// sqliteDriver implements Driver for SQLite database files. ServerConfig.Host
+// holds the file path and the schemas of the connection (normally just
+// "main") are shown as databases.
+type sqliteDriver struct{}
+
+func (sqliteDriver) DriverName() string {
+	return "sqlite"
+}
+
+func (sqliteDriver) DSN(server config.ServerConfig) string {
+	// mode=rw refuses to create a new file when the path is mistyped
+	query := url.Values{"mode": {"rw"}}
+	for key, value := range server.Params {
+		query.Set(key, value)
+	}
+
+	dsn := url.URL{
+		Scheme:   "file",
+		Path:     server.Host,
+		RawQuery: query.Encode(),
+	}
+	return dsn.String()
+}
+
+// DefaultPort is 0 as SQLite servers are files
+func (sqliteDriver) DefaultPort() int {
+	return 0
+}
+
+func (sqliteDriver) QuoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+func (sqliteDriver) QuoteLiteral(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
+
+func (d sqliteDriver) QualifyTable(database, tableName string) string {
+	if database == "" {
+		return d.QuoteIdentifier(tableName)
+	}
+	return d.QuoteIdentifier(database) + "." + d.QuoteIdentifier(tableName)
+}
+
+func (sqliteDriver) UseDatabase(conn *Conn, database string) (*sqlx.DB, error) {
+	return conn.DB, nil
+}
+
+func (sqliteDriver) GetDatabases(db *sqlx.DB, includeSystem bool) ([]DatabaseInfo, error) {
+	var databases []DatabaseInfo
+	query := `SELECT name AS SCHEMA_NAME FROM pragma_database_list WHERE name <> 'temp' ORDER BY seq`
+	if includeSystem {
+		query = `SELECT name AS SCHEMA_NAME FROM pragma_database_list ORDER BY seq`
+	}
+
+	err := db.Select(&databases, query)
+	if err != nil {
+		return nil, err
+	}
+
+	return databases, nil
+}
+
+func (d sqliteDriver) GetTables(db *sqlx.DB, database string) ([]TableInfo, error) {
+	if database == "" {
+		database = "main"
+	}
+
+	var tables []TableInfo
+	query := fmt.Sprintf(`SELECT name AS TABLE_NAME FROM %s.sqlite_master
+	                      WHERE type IN ('table', 'view') AND name NOT LIKE 'sqlite\_%%' ESCAPE '\'
+	                      ORDER BY name`, d.QuoteIdentifier(database))
+
+	err := db.Select(&tables, query)
+	if err != nil {
+		return nil, err
+	}
+
+	return tables, nil
+}
+
+func (sqliteDriver) GetTableColumns(db *sqlx.DB, database, tableName string) ([]ColumnInfo, error) {
+	if database == "" {
+		database = "main"
+	}
+
+	type tableInfo struct {
+		Name    string  `db:"name"`
+		Type    string  `db:"type"`
+		NotNull bool    `db:"notnull"`
+		Default *string `db:"dflt_value"`
+		PK      int     `db:"pk"`
+	}
+
+	var info []tableInfo
+	err := db.Select(&info, `SELECT name, type, "notnull", dflt_value, pk FROM pragma_table_info(?, ?) ORDER BY cid`, tableName, database)
+	if err != nil {
+		return nil, err
+	}
+	if len(info) == 0 {
+		return nil, fmt.Errorf("no such table: %s", tableName)
+	}
+
+	pkCount := 0
+	for _, col := range info {
+		if col.PK > 0 {
+			pkCount++
+		}
+	}
+
+	columns := make([]ColumnInfo, len(info))
+	for i, col := range info {
+		column := ColumnInfo{
+			Field:   col.Name,
+			Type:    col.Type,
+			Null:    "YES",
+			Default: col.Default,
+		}
+		if col.NotNull {
+			column.Null = "NO"
+		}
+		if col.PK > 0 {
+			column.Key = "PRI"
+			// A single INTEGER PRIMARY KEY column is an alias for the rowid
+			if pkCount == 1 && strings.EqualFold(col.Type, "INTEGER") {
+				column.Extra = "auto_increment"
+			}
+		}
+		columns[i] = column
+	}
+
+	return columns, nil
+}
+
+func (sqliteDriver) GetPrimaryKeyColumns(db *sqlx.DB, database, tableName string) ([]string, error) {
+	if database == "" {
+		database = "main"
+	}
+
+	var pkColumns []string
+	err := db.Select(&pkColumns, `SELECT name FROM pragma_table_info(?, ?) WHERE pk > 0 ORDER BY pk`, tableName, database)
+	if err != nil {
+		return nil, err
+	}
+
+	return pkColumns, nil
+}
+
+// RowIDColumn returns rowid for tables; views have none.
+func (d sqliteDriver) RowIDColumn(db *sqlx.DB, database, tableName string) (string, error) {
+	if database == "" {
+		database = "main"
+	}
+
+	var kind string
+	query := fmt.Sprintf(`SELECT type FROM %s.sqlite_master WHERE name = ?`, d.QuoteIdentifier(database))
+	if err := db.Get(&kind, query, tableName); err != nil {
+		return "", err
+	}
+	if kind != "table" {
+		return "", nil
+	}
+	return "rowid", nil
+}
+
+func (d sqliteDriver) GetTableCreateStatement(db *sqlx.DB, database, tableName string) (string, error) {
+	if database == "" {
+		database = "main"
+	}
+
+	var createStmt string
+	query := fmt.Sprintf(`SELECT sql FROM %s.sqlite_master WHERE type IN ('table', 'view') AND name = ?`, d.QuoteIdentifier(database))
+	err := db.Get(&createStmt, query, tableName)
+	if err != nil {
+		return "", err
+	}
+	createStmt += ";"
+
+	// Indexes created with CREATE INDEX (automatic indexes have no SQL)
+	var indexes []string
+	query = fmt.Sprintf(`SELECT sql FROM %s.sqlite_master WHERE type = 'index' AND tbl_name = ? AND sql IS NOT NULL ORDER BY name`, d.QuoteIdentifier(database))
+	err = db.Select(&indexes, query, tableName)
+	if err != nil {
+		return "", err
+	}
+	for _, index := range indexes {
+		createStmt += "\n" + index + ";"
+	}
+
+	return createStmt, nil
+}
+
+func (sqliteDriver) EstimateRowCount(db *sqlx.DB, database, tableName string) (int64, error) {
+	return 0, errors.New("SQLite keeps no row count statistics")
+}
+
+func (sqliteDriver) GetServerInfo(db *sqlx.DB) (*ServerInfo, error) {
+	info := &ServerInfo{}
+
+	// Get library version
+	var version string
+	err := db.Get(&version, "SELECT sqlite_version()")
+	if err == nil {
+		info.Version = version
+		info.VersionComment = "SQLite"
+	}
+
+	// Get text encoding of the main database
+	var encoding string
+	err = db.Get(&encoding, "PRAGMA encoding")
+	if err == nil {
+		info.CharacterSetServer = encoding
+		info.CharacterSetConnection = encoding
+	}
+
+	return info, nil
+}
+
+// SQLite has no user accounts; access is governed by file permissions.
+func (sqliteDriver) GetUserPrivileges(db *sqlx.DB) ([]UserPrivilege, error) {
+	return nil, nil
+}
+
+func (sqliteDriver) GetUserGrants(db *sqlx.DB, user, host string) ([]string, error) {
+	return nil, nil
+}
+
+func (sqliteDriver) CreateDatabase(name, charset, collation string) (string, error) {
+	return "", errors.New("SQLite does not support CREATE DATABASE; add a new server for another database file")
+}
+
+func (d sqliteDriver) AlterColumn(tableName string, current *ColumnInfo, edit ColumnEdit) ([]string, error) {
+	table := d.QuoteIdentifier(tableName)
+
+	if current == nil {
+		def := edit.Type
+		if !edit.Nullable {
+			def += " NOT NULL"
+		}
+		if edit.Default != "" {
+			def += " DEFAULT " + edit.Default
+		}
+		return []string{fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, d.QuoteIdentifier(edit.Name), def)}, nil
+	}
+	if edit.Drop {
+		return []string{fmt.Sprintf("ALTER TABLE %s DROP COLUMN %s", table, d.QuoteIdentifier(current.Field))}, nil
+	}
+
+	diff := diffColumn(*current, edit)
+	if diff.modified() {
+		return nil, fmt.Errorf("SQLite cannot change the type, NULL or default of existing column %s; recreate the table from the SQL console instead", current.Field)
+	}
+
+	var statements []string
+	if diff.Rename {
+		statements = append(statements, fmt.Sprintf("ALTER TABLE %s RENAME COLUMN %s TO %s", table, d.QuoteIdentifier(current.Field), d.QuoteIdentifier(edit.Name)))
+	}
+
+	return statements, nil
+}
@@ -0,0 +1,184 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"godbadmin/config"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sshNetwork is the network of the dialer registered with the MySQL driver.
+// The address in the DSN is the ID of the tunnel to dial through.
+const sshNetwork = "ssh"
+
+// sshTimeout bounds the connection and handshake with the jump host
+const sshTimeout = 10 * time.Second
+
+// sshTunnel forwards connections to a database server through an SSH jump
+// host. A pool opens one tunnel and shares it between its connections.
+type sshTunnel struct {
+	id     string
+	client *ssh.Client
+	// target is the database server as seen from the jump host
+	target string
+}
+
+var (
+	tunnelsMu sync.Mutex
+	tunnels   = make(map[string]*sshTunnel)
+	tunnelSeq int
+)
+
+func init() {
+	mysql.RegisterDialContext(sshNetwork, func(ctx context.Context, addr string) (net.Conn, error) {
+		tunnelsMu.Lock()
+		t, ok := tunnels[addr]
+		tunnelsMu.Unlock()
+		if !ok {
+			return nil, fmt.Errorf("ssh tunnel %s is closed", addr)
+		}
+		return t.DialContext(ctx, "tcp", t.target)
+	})
+}
+
+// openTunnel connects to the jump host of the server.
+func openTunnel(server config.ServerConfig) (*sshTunnel, error) {
+	if server.Socket != "" {
+		return nil, errors.New("a Unix socket cannot be used through an SSH tunnel")
+	}
+
+	auth, err := sshAuthMethods(server)
+	if err != nil {
+		return nil, err
+	}
+
+	hostKeyCallback, err := sshHostKeyCallback(server)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := ssh.Dial("tcp", server.SSHAddress(), &ssh.ClientConfig{
+		User:            server.SSHUser,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         sshTimeout,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("ssh %s: %w", server.SSHAddress(), err)
+	}
+
+	tunnelsMu.Lock()
+	defer tunnelsMu.Unlock()
+	tunnelSeq++
+	t := &sshTunnel{
+		id:     strconv.Itoa(tunnelSeq),
+		client: client,
+		target: net.JoinHostPort(server.Host, strconv.Itoa(server.Port)),
+	}
+	tunnels[t.id] = t
+	return t, nil
+}
+
+// sshAuthMethods returns the password and private key authentication
+// configured for the server. The key is tried first when both are set.
+func sshAuthMethods(server config.ServerConfig) ([]ssh.AuthMethod, error) {
+	var methods []ssh.AuthMethod
+
+	if server.SSHKeyFile != "" {
+		key, err := os.ReadFile(expandHome(server.SSHKeyFile))
+		if err != nil {
+			return nil, fmt.Errorf("ssh private key: %w", err)
+		}
+
+		var signer ssh.Signer
+		if server.SSHKeyPassphrase != "" {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(server.SSHKeyPassphrase))
+		} else {
+			signer, err = ssh.ParsePrivateKey(key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("ssh private key %s: %w", server.SSHKeyFile, err)
+		}
+		methods = append(methods, ssh.PublicKeys(signer))
+	}
+
+	if server.SSHPassword != "" {
+		methods = append(methods, ssh.Password(server.SSHPassword))
+	}
+
+	if len(methods) == 0 {
+		return nil, errors.New("ssh tunnel needs a password or a private key")
+	}
+	return methods, nil
+}
+
+// sshHostKeyCallback checks the jump host's key against the known_hosts
+// file, unless checking was turned off for the server.
+func sshHostKeyCallback(server config.ServerConfig) (ssh.HostKeyCallback, error) {
+	if server.SSHSkipHostKeyCheck {
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+
+	file := server.SSHKnownHosts
+	if file == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("ssh known_hosts: %w", err)
+		}
+		file = filepath.Join(home, ".ssh", "known_hosts")
+	}
+
+	callback, err := knownhosts.New(expandHome(file))
+	if err != nil {
+		return nil, fmt.Errorf("ssh known_hosts: %w", err)
+	}
+	return callback, nil
+}
+
+// expandHome replaces a leading ~/ with the home directory.
+func expandHome(path string) string {
+	if !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, path[2:])
+}
+
+// Dial, DialTimeout and DialContext make the tunnel a dialer for lib/pq.
+// address is resolved by the jump host.
+
+func (t *sshTunnel) Dial(network, address string) (net.Conn, error) {
+	return t.client.Dial(network, address)
+}
+
+func (t *sshTunnel) DialTimeout(network, address string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return t.client.DialContext(ctx, network, address)
+}
+
+func (t *sshTunnel) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return t.client.DialContext(ctx, network, address)
+}
+
+func (t *sshTunnel) close() error {
+	tunnelsMu.Lock()
+	delete(tunnels, t.id)
+	tunnelsMu.Unlock()
+
+	return t.client.Close()
+}
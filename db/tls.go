@@ -0,0 +1,96 @@
+package db
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"godbadmin/config"
+	"os"
+	"strings"
+)
+
+// tlsConfig builds the client TLS settings of a server for drivers that take
+// a crypto/tls configuration. It returns nil when TLS is disabled.
+func tlsConfig(server config.ServerConfig) (*tls.Config, error) {
+	mode := server.TLS()
+	if mode == config.TLSDisabled {
+		return nil, nil
+	}
+
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if server.TLSClientCert != "" || server.TLSClientKey != "" {
+		if server.TLSClientCert == "" || server.TLSClientKey == "" {
+			return nil, errors.New("TLS client certificate and key must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(expandHome(server.TLSClientCert), expandHome(server.TLSClientKey))
+		if err != nil {
+			return nil, fmt.Errorf("TLS client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	if server.TLSCACert != "" {
+		pem, err := os.ReadFile(expandHome(server.TLSCACert))
+		if err != nil {
+			return nil, fmt.Errorf("TLS CA certificate: %w", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("TLS CA certificate %s: no certificate found", server.TLSCACert)
+		}
+	}
+
+	switch mode {
+	case config.TLSPreferred, config.TLSRequired:
+		cfg.InsecureSkipVerify = true
+	case config.TLSVerifyCA:
+		// Check the chain but not the host name, which crypto/tls only
+		// allows by skipping its own verification
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyPeerCertificate = verifyChain(cfg.RootCAs)
+	case config.TLSVerifyIdentity:
+		cfg.ServerName = server.Host
+	default:
+		return nil, fmt.Errorf("unknown TLS mode %q", mode)
+	}
+	return cfg, nil
+}
+
+// verifyChain checks the server certificate was issued by one of roots, or
+// the system roots when roots is nil.
+func verifyChain(roots *x509.CertPool) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("tls: server sent no certificate")
+		}
+
+		certs := make([]*x509.Certificate, len(rawCerts))
+		for i, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return err
+			}
+			certs[i] = cert
+		}
+
+		intermediates := x509.NewCertPool()
+		for _, cert := range certs[1:] {
+			intermediates.AddCert(cert)
+		}
+		_, err := certs[0].Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates})
+		return err
+	}
+}
+
+// tlsConfigName names the TLS settings of a server for drivers keeping them
+// in a registry. Servers with the same settings share the name.
+func tlsConfigName(server config.ServerConfig) string {
+	sum := sha256.Sum256([]byte(strings.Join([]string{
+		server.TLS(), server.Host, server.TLSCACert, server.TLSClientCert, server.TLSClientKey,
+	}, "\x00")))
+	return "godbadmin-" + hex.EncodeToString(sum[:8])
+}
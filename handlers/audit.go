@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"fmt"
+	"godbadmin/audit"
+	"godbadmin/auth"
+	"godbadmin/config"
+	"godbadmin/db"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// auditPageSize is the number of entries shown on the audit page
+const auditPageSize = 500
+
+// auditConn records every statement changing data or schema on a connection
+// in the audit log, on behalf of the user of the request
+func auditConn(c echo.Context, conn *db.Conn, serverID, dbName, action string) {
+	auditConnAs(c, conn, audit.Entry{ServerID: serverID, Database: dbName, Action: action})
+}
+
+// auditImportConn is auditConn for the statements of an import, which also
+// record the uploaded file
+func auditImportConn(c echo.Context, conn *db.Conn, serverID, dbName, source string) {
+	auditConnAs(c, conn, audit.Entry{ServerID: serverID, Database: dbName, Action: audit.ActionImport, Source: source})
+}
+
+// auditConnAs records the statements as copies of base
+func auditConnAs(c echo.Context, conn *db.Conn, base audit.Entry) {
+	conn.OnExec = func(query string, args []interface{}, rowsAffected int64, err error) {
+		entry := base
+		entry.SQL = query
+		entry.Args = args
+		entry.RowsAffected = rowsAffected
+		if err != nil {
+			entry.Error = err.Error()
+		}
+		recordAudit(c, entry)
+	}
+}
+
+// recordAudit adds the user and client address of the request to an entry
+// and appends it to the audit log
+func recordAudit(c echo.Context, entry audit.Entry) {
+	if user := auth.CurrentUser(c); user != nil {
+		entry.User = user.Username
+	}
+	entry.ClientIP = c.RealIP()
+	audit.Record(entry)
+}
+
+// parseAuditFilter reads the filter of the audit page for a server. Dates
+// are whole days in local time; the to date is included.
+func parseAuditFilter(c echo.Context, serverID string) audit.Filter {
+	f := audit.Filter{
+		ServerID: serverID,
+		User:     c.QueryParam("user"),
+		Action:   c.QueryParam("action"),
+		Search:   c.QueryParam("q"),
+	}
+	if from, err := time.ParseInLocation("2006-01-02", c.QueryParam("from"), time.Local); err == nil {
+		f.From = from
+	}
+	if to, err := time.ParseInLocation("2006-01-02", c.QueryParam("to"), time.Local); err == nil {
+		f.To = to.AddDate(0, 0, 1)
+	}
+	return f
+}
+
+// AuditPage shows the statements run on a server, newest first
+func AuditPage(c echo.Context) error {
+	serverID := c.Param("id")
+	if err := requireRole(c, serverID, config.RoleAdmin); err != nil {
+		return err
+	}
+
+	server, found := config.GetSettings().GetServer(serverID)
+	if !found {
+		return echo.NewHTTPError(http.StatusNotFound, "Server not found")
+	}
+
+	data := map[string]interface{}{
+		"Server":      server,
+		"Error":       "",
+		"Entries":     nil,
+		"More":        false,
+		"PageSize":    auditPageSize,
+		"Actions":     audit.Actions,
+		"Filter":      c.QueryParams(),
+		"DownloadURL": "/servers/" + url.PathEscape(serverID) + "/audit/download?" + c.QueryParams().Encode(),
+		"ActiveMenu":  "servers",
+	}
+
+	entries, more, err := audit.Entries(parseAuditFilter(c, serverID), auditPageSize)
+	if err != nil {
+		data["Error"] = "監査ログの読み込みエラー: " + err.Error()
+	} else {
+		data["Entries"] = entries
+		data["More"] = more
+	}
+
+	return c.Render(http.StatusOK, "audit.html", addI18nContext(c, data))
+}
+
+// AuditDownload sends the matching entries of a server as JSON lines
+func AuditDownload(c echo.Context) error {
+	serverID := c.Param("id")
+	if err := requireRole(c, serverID, config.RoleAdmin); err != nil {
+		return err
+	}
+
+	if _, found := config.GetSettings().GetServer(serverID); !found {
+		return echo.NewHTTPError(http.StatusNotFound, "Server not found")
+	}
+
+	filename := fmt.Sprintf("audit_%s_%s.jsonl", serverID, time.Now().Format("20060102_150405"))
+	c.Response().Header().Set("Content-Type", "application/x-ndjson")
+	c.Response().Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", filename))
+	c.Response().WriteHeader(http.StatusOK)
+
+	return audit.WriteEntries(c.Response(), parseAuditFilter(c, serverID))
+}
@@ -0,0 +1,289 @@
+package handlers
+
+import (
+	"errors"
+	"godbadmin/auth"
+	"godbadmin/config"
+	"godbadmin/i18n"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// UsersFile is where account changes are saved, set from the options at
+// startup
+var UsersFile = "users.json"
+
+// userErrorKeys maps account errors to their i18n messages
+var userErrorKeys = map[error]string{
+	config.ErrInvalidUsername:  "error_invalid_username",
+	config.ErrPasswordTooShort: "error_password_too_short",
+	config.ErrUserExists:       "error_user_exists",
+	config.ErrUserNotFound:     "error_user_not_found",
+	config.ErrLastAdmin:        "error_last_admin",
+}
+
+// userError translates an account error for display
+func userError(c echo.Context, err error) string {
+	for target, key := range userErrorKeys {
+		if errors.Is(err, target) {
+			return i18n.T(c, key)
+		}
+	}
+	return err.Error()
+}
+
+// safeNext returns the page to go to after logging in, accepting only local paths
+func safeNext(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/servers"
+	}
+	return next
+}
+
+// LoginPage shows the login form
+func LoginPage(c echo.Context) error {
+	if config.GetUsers().Count() == 0 {
+		return c.Redirect(http.StatusSeeOther, "/setup")
+	}
+
+	return c.Render(http.StatusOK, "login.html", addI18nContext(c, map[string]interface{}{
+		"Setup":    false,
+		"Error":    "",
+		"Username": "",
+		"Next":     c.QueryParam("next"),
+	}))
+}
+
+// Login checks the credentials and starts a session
+func Login(c echo.Context) error {
+	username := strings.TrimSpace(c.FormValue("username"))
+	next := c.FormValue("next")
+
+	user, ok := config.GetUsers().Authenticate(username, c.FormValue("password"))
+	if !ok {
+		return c.Render(http.StatusUnauthorized, "login.html", addI18nContext(c, map[string]interface{}{
+			"Setup":    false,
+			"Error":    i18n.T(c, "error_login_failed"),
+			"Username": username,
+			"Next":     next,
+		}))
+	}
+
+	if err := auth.Login(c, user.Username); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	return c.Redirect(http.StatusSeeOther, safeNext(next))
+}
+
+// Logout ends the session
+func Logout(c echo.Context) error {
+	auth.Logout(c)
+	return c.Redirect(http.StatusSeeOther, "/login")
+}
+
+// SetupPage shows the form creating the first administrator. It needs the
+// setup token printed at startup.
+func SetupPage(c echo.Context) error {
+	if config.GetUsers().Count() > 0 {
+		return c.Redirect(http.StatusSeeOther, "/login")
+	}
+
+	return c.Render(http.StatusOK, "login.html", addI18nContext(c, map[string]interface{}{
+		"Setup":    true,
+		"Error":    "",
+		"Username": "admin",
+		"Token":    c.QueryParam("token"),
+	}))
+}
+
+// Setup creates the first administrator and logs it in
+func Setup(c echo.Context) error {
+	users := config.GetUsers()
+	if users.Count() > 0 {
+		return c.Redirect(http.StatusSeeOther, "/login")
+	}
+
+	username := strings.TrimSpace(c.FormValue("username"))
+	token := c.FormValue("token")
+	render := func(message string) error {
+		return c.Render(http.StatusOK, "login.html", addI18nContext(c, map[string]interface{}{
+			"Setup":    true,
+			"Error":    message,
+			"Username": username,
+			"Token":    token,
+		}))
+	}
+
+	if !auth.CheckSetupToken(token) {
+		return render(i18n.T(c, "error_setup_token"))
+	}
+	if c.FormValue("password") != c.FormValue("password_confirm") {
+		return render(i18n.T(c, "error_password_mismatch"))
+	}
+
+	if err := users.AddUser(username, c.FormValue("password"), true); err != nil {
+		return render(userError(c, err))
+	}
+	if err := users.Save(UsersFile); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	auth.ClearSetupToken()
+
+	if err := auth.Login(c, username); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	return c.Redirect(http.StatusSeeOther, "/servers")
+}
+
+// AccountPage shows the password change form and, for administrators, the
+// list of accounts
+func AccountPage(c echo.Context) error {
+	user := auth.CurrentUser(c)
+
+	data := map[string]interface{}{
+		"User":       user,
+		"Users":      nil,
+		"Message":    "",
+		"Error":      c.QueryParam("error"),
+		"ActiveMenu": "account",
+	}
+	if key := c.QueryParam("message"); key != "" {
+		data["Message"] = i18n.T(c, key)
+	}
+	if user.Admin {
+		data["Users"] = config.GetUsers().GetUsers()
+		data["Servers"] = config.GetSettings().GetServers()
+		data["Roles"] = config.Roles
+	}
+
+	return c.Render(http.StatusOK, "account.html", addI18nContext(c, data))
+}
+
+// ChangePassword changes the password of the logged-in user, ending their
+// other sessions
+func ChangePassword(c echo.Context) error {
+	user := auth.CurrentUser(c)
+	users := config.GetUsers()
+
+	if _, ok := users.Authenticate(user.Username, c.FormValue("current_password")); !ok {
+		return redirectAccount(c, "", i18n.T(c, "error_current_password"))
+	}
+	if c.FormValue("password") != c.FormValue("password_confirm") {
+		return redirectAccount(c, "", i18n.T(c, "error_password_mismatch"))
+	}
+
+	if err := users.SetPassword(user.Username, c.FormValue("password")); err != nil {
+		return redirectAccount(c, "", userError(c, err))
+	}
+	if err := users.Save(UsersFile); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	auth.EndSessions(user.Username, c)
+
+	return redirectAccount(c, "password_changed", "")
+}
+
+// CreateUser adds an account (administrators only)
+func CreateUser(c echo.Context) error {
+	if !auth.CurrentUser(c).Admin {
+		return echo.NewHTTPError(http.StatusForbidden, "Forbidden")
+	}
+	users := config.GetUsers()
+
+	if c.FormValue("password") != c.FormValue("password_confirm") {
+		return redirectAccount(c, "", i18n.T(c, "error_password_mismatch"))
+	}
+	if err := users.AddUser(c.FormValue("username"), c.FormValue("password"), c.FormValue("admin") == "true"); err != nil {
+		return redirectAccount(c, "", userError(c, err))
+	}
+	if err := users.Save(UsersFile); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	return redirectAccount(c, "user_created", "")
+}
+
+// ResetPassword sets a new password for another account (administrators only)
+func ResetPassword(c echo.Context) error {
+	if !auth.CurrentUser(c).Admin {
+		return echo.NewHTTPError(http.StatusForbidden, "Forbidden")
+	}
+	username := c.Param("username")
+	users := config.GetUsers()
+
+	if err := users.SetPassword(username, c.FormValue("password")); err != nil {
+		return redirectAccount(c, "", userError(c, err))
+	}
+	if err := users.Save(UsersFile); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	auth.EndSessions(username, nil)
+
+	return redirectAccount(c, "password_reset", "")
+}
+
+// UpdateRoles sets the role of an account on every server from the posted
+// role_<server ID> fields (administrators only)
+func UpdateRoles(c echo.Context) error {
+	if !auth.CurrentUser(c).Admin {
+		return echo.NewHTTPError(http.StatusForbidden, "Forbidden")
+	}
+	username := c.Param("username")
+	users := config.GetUsers()
+
+	roles := make(map[string]config.Role)
+	for _, server := range config.GetSettings().GetServers() {
+		role, ok := config.ParseRole(c.FormValue("role_" + server.ID))
+		if !ok {
+			return redirectAccount(c, "", i18n.T(c, "error_invalid_role"))
+		}
+		roles[server.ID] = role
+	}
+
+	if err := users.SetRoles(username, roles); err != nil {
+		return redirectAccount(c, "", userError(c, err))
+	}
+	if err := users.Save(UsersFile); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	return redirectAccount(c, "roles_updated", "")
+}
+
+// DeleteUser removes an account and its sessions (administrators only)
+func DeleteUser(c echo.Context) error {
+	if !auth.CurrentUser(c).Admin {
+		return echo.NewHTTPError(http.StatusForbidden, "Forbidden")
+	}
+	username := c.Param("username")
+	users := config.GetUsers()
+
+	if err := users.DeleteUser(username); err != nil {
+		return redirectAccount(c, "", userError(c, err))
+	}
+	if err := users.Save(UsersFile); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	auth.EndSessions(username, nil)
+
+	if username == auth.CurrentUser(c).Username {
+		auth.Logout(c)
+		return c.Redirect(http.StatusSeeOther, "/login")
+	}
+	return redirectAccount(c, "user_deleted", "")
+}
+
+// redirectAccount returns to the account page with a message key or an error
+func redirectAccount(c echo.Context, message, errorMessage string) error {
+	target := "/account"
+	if message != "" {
+		target += "?message=" + url.QueryEscape(message)
+	} else if errorMessage != "" {
+		target += "?error=" + url.QueryEscape(errorMessage)
+	}
+	return c.Redirect(http.StatusSeeOther, target)
+}
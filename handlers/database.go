@@ -1,16 +1,21 @@
 package handlers
 
 import (
-	"encoding/csv"
+	"encoding/hex"
 	"fmt"
+	"godbadmin/audit"
+	"godbadmin/auth"
 	"godbadmin/config"
 	"godbadmin/db"
 	"godbadmin/i18n"
+	"html/template"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/labstack/echo/v4"
-	"golang.org/x/text/encoding/japanese"
-	"golang.org/x/text/transform"
 )
 
 // Helper function to add Context and Lang to template data
@@ -20,11 +25,35 @@ func addI18nContext(c echo.Context, data map[string]interface{}) map[string]inte
 	return data
 }
 
+// sidebarTree loads the databases of the sidebar tree with the tables of the
+// current database. The tables of the other databases are loaded from the
+// tree API when they are expanded.
+func sidebarTree(dbConn *db.Conn, current string) ([]db.DatabaseWithTables, error) {
+	databases, err := db.CachedDatabases(dbConn)
+	if err != nil {
+		return nil, err
+	}
+
+	tree := make([]db.DatabaseWithTables, len(databases))
+	for i, database := range databases {
+		tree[i].DatabaseName = database.DatabaseName
+		if database.DatabaseName == current {
+			tree[i].Tables, _ = db.CachedTables(dbConn, current)
+		}
+	}
+
+	return tree, nil
+}
+
 func DatabasePage(c echo.Context) error {
 	serverID := c.Param("id")
 	dbName := c.QueryParam("db")
 	settings := config.GetSettings()
 
+	if err := requireRole(c, serverID, config.RoleViewer); err != nil {
+		return err
+	}
+
 	server, found := settings.GetServer(serverID)
 	if !found {
 		return echo.NewHTTPError(http.StatusNotFound, "Server not found")
@@ -35,7 +64,7 @@ func DatabasePage(c echo.Context) error {
 		dbName = server.Database
 	}
 
-	dbConn, err := db.ConnectWithoutDB(server.Host, server.Port, server.User, server.Password)
+	dbConn, err := db.Open(*server)
 	if err != nil {
 		return c.Render(http.StatusOK, "database_overview.html", addI18nContext(c, map[string]interface{}{
 			"Server":              server,
@@ -50,8 +79,8 @@ func DatabasePage(c echo.Context) error {
 	}
 	defer dbConn.Close()
 
-	// Get all databases
-	databases, err := db.GetAllDatabases(dbConn)
+	// Load the sidebar tree
+	dbWithTables, err := sidebarTree(dbConn, dbName)
 	if err != nil {
 		return c.Render(http.StatusOK, "database_overview.html", addI18nContext(c, map[string]interface{}{
 			"Server":              server,
@@ -65,22 +94,12 @@ func DatabasePage(c echo.Context) error {
 		}))
 	}
 
-	// Get tables for each database
-	var dbWithTables []db.DatabaseWithTables
-	for _, database := range databases {
-		tables, _ := db.GetTables(dbConn, database.DatabaseName)
-		dbWithTables = append(dbWithTables, db.DatabaseWithTables{
-			DatabaseName: database.DatabaseName,
-			Tables:       tables,
-		})
-	}
-
 	// Get tables for current database
-	currentTables, _ := db.GetTables(dbConn, dbName)
+	currentTables, _ := db.CachedTables(dbConn, dbName)
 
 	return c.Render(http.StatusOK, "database_overview.html", addI18nContext(c, map[string]interface{}{
 		"Server":              server,
-		"Error":               "",
+		"Error":               c.QueryParam("error"),
 		"DatabasesWithTables": dbWithTables,
 		"CurrentDatabase":     dbName,
 		"CurrentTable":        "",
@@ -97,6 +116,10 @@ func TableDataPage(c echo.Context) error {
 	tableName := c.Param("table")
 	settings := config.GetSettings()
 
+	if err := requireRole(c, serverID, config.RoleViewer); err != nil {
+		return err
+	}
+
 	server, found := settings.GetServer(serverID)
 	if !found {
 		return echo.NewHTTPError(http.StatusNotFound, "Server not found")
@@ -107,7 +130,7 @@ func TableDataPage(c echo.Context) error {
 		dbName = server.Database
 	}
 
-	dbConn, err := db.ConnectWithoutDB(server.Host, server.Port, server.User, server.Password)
+	dbConn, err := db.Open(*server)
 	if err != nil {
 		return c.Render(http.StatusOK, "table_data.html", addI18nContext(c, map[string]interface{}{
 			"Server":              server,
@@ -119,8 +142,8 @@ func TableDataPage(c echo.Context) error {
 	}
 	defer dbConn.Close()
 
-	// Get all databases and their tables
-	databases, err := db.GetAllDatabases(dbConn)
+	// Load the sidebar tree
+	dbWithTables, err := sidebarTree(dbConn, dbName)
 	if err != nil {
 		return c.Render(http.StatusOK, "table_data.html", addI18nContext(c, map[string]interface{}{
 			"Server":              server,
@@ -131,17 +154,30 @@ func TableDataPage(c echo.Context) error {
 		}))
 	}
 
-	var dbWithTables []db.DatabaseWithTables
-	for _, database := range databases {
-		tables, _ := db.GetTables(dbConn, database.DatabaseName)
-		dbWithTables = append(dbWithTables, db.DatabaseWithTables{
-			DatabaseName: database.DatabaseName,
-			Tables:       tables,
-		})
+	// Get column information for the header and the filter bar, which are
+	// shown even when no row matches
+	columnInfo, err := db.GetTableColumns(dbConn, dbName, tableName)
+	if err != nil {
+		return c.Render(http.StatusOK, "table_data.html", addI18nContext(c, map[string]interface{}{
+			"Server":              server,
+			"Error":               "カラム情報の取得エラー: " + err.Error(),
+			"DatabasesWithTables": dbWithTables,
+			"CurrentDatabase":     dbName,
+			"CurrentTable":        tableName,
+			"TableData":           nil,
+			"Columns":             nil,
+			"PrimaryKeys":         nil,
+		}))
 	}
 
+	columns := make([]string, len(columnInfo))
+	for i, col := range columnInfo {
+		columns[i] = col.Field
+	}
+	query := parseTableQuery(c, columns)
+
 	// Get table data
-	tableData, columns, err := db.GetTableData(dbConn, dbName, tableName, 100)
+	tableData, _, err := db.GetTableData(dbConn, dbName, tableName, query)
 	if err != nil {
 		return c.Render(http.StatusOK, "table_data.html", addI18nContext(c, map[string]interface{}{
 			"Server":              server,
@@ -150,26 +186,158 @@ func TableDataPage(c echo.Context) error {
 			"CurrentDatabase":     dbName,
 			"CurrentTable":        tableName,
 			"TableData":           nil,
-			"Columns":             nil,
+			"Columns":             columns,
 			"PrimaryKeys":         nil,
+			"Query":               query,
+			"Filters":             filtersByColumn(query.Filters),
+			"PageSizes":           pageSizes,
 		}))
 	}
 
+	totalRows, estimated, err := db.CountTableRows(dbConn, dbName, tableName, query.Filters, c.QueryParam("count") == "exact")
+	if err != nil {
+		totalRows, estimated = int64(query.Offset+len(tableData)), true
+	}
+
 	// Get primary key columns
 	pkColumns, _ := db.GetPrimaryKeyColumns(dbConn, dbName, tableName)
+	types := columnTypes(columnInfo)
+	rowKeys := make([]template.URL, len(tableData))
+	for i, row := range tableData {
+		rowKeys[i] = rowKey(pkColumns, types, row)
+	}
+
+	page := query.Offset/query.Limit + 1
+	totalPages := int((totalRows + int64(query.Limit) - 1) / int64(query.Limit))
+	if totalPages < page {
+		totalPages = page
+	}
+	hasNext := int64(query.Offset+len(tableData)) < totalRows || (estimated && len(tableData) == query.Limit)
+
+	var pageLinks []pageLink
+	for p := max(1, page-2); p <= min(totalPages, page+2); p++ {
+		pageLinks = append(pageLinks, pageLink{Page: p, URL: tableDataURL(c, map[string]string{"page": strconv.Itoa(p)})})
+	}
+
+	sortURLs := make(map[string]string, len(columns))
+	for _, col := range columns {
+		order := "asc"
+		if query.OrderBy == col && !query.Desc {
+			order = "desc"
+		}
+		sortURLs[col] = tableDataURL(c, map[string]string{"sort": col, "order": order, "page": "1"})
+	}
 
 	return c.Render(http.StatusOK, "table_data.html", addI18nContext(c, map[string]interface{}{
 		"Server":              server,
-		"Error":               "",
+		"Error":               c.QueryParam("error"),
 		"DatabasesWithTables": dbWithTables,
 		"CurrentDatabase":     dbName,
 		"CurrentTable":        tableName,
 		"TableData":           tableData,
 		"Columns":             columns,
 		"PrimaryKeys":         pkColumns,
+		"RowKeys":             rowKeys,
+		"Query":               query,
+		"Filters":             filtersByColumn(query.Filters),
+		"SortURLs":            sortURLs,
+		"PageSizes":           pageSizes,
+		"Page":                page,
+		"TotalPages":          totalPages,
+		"TotalRows":           totalRows,
+		"Estimated":           estimated,
+		"FirstRow":            query.Offset + 1,
+		"LastRow":             query.Offset + len(tableData),
+		"PageLinks":           pageLinks,
+		"PrevURL":             pageURLIf(c, page > 1, page-1),
+		"NextURL":             pageURLIf(c, hasNext, page+1),
+		"FirstURL":            pageURLIf(c, page > 1, 1),
+		"LastURL":             pageURLIf(c, !estimated && page < totalPages, totalPages),
+		"ExactCountURL":       tableDataURL(c, map[string]string{"count": "exact", "page": strconv.Itoa(page)}),
 	}))
 }
 
+// pageSizes are the row counts per page offered on the table data page
+var pageSizes = []int{25, 50, 100, 250, 500, 1000}
+
+// pageLink is a numbered link of the table data pagination
+type pageLink struct {
+	Page int
+	URL  string
+}
+
+// parseTableQuery reads paging, sorting and filters from the query string.
+// Filters are given per column as op:<column>, v:<column> and v2:<column>;
+// columns that are not in the table are ignored.
+func parseTableQuery(c echo.Context, columns []string) db.TableQuery {
+	query := db.TableQuery{Limit: 100}
+
+	if limit, err := strconv.Atoi(c.QueryParam("limit")); err == nil && limit > 0 {
+		query.Limit = min(limit, pageSizes[len(pageSizes)-1])
+	}
+
+	if offset, err := strconv.Atoi(c.QueryParam("offset")); err == nil && offset > 0 {
+		// Pages start at multiples of the limit
+		query.Offset = offset / query.Limit * query.Limit
+	} else if page, err := strconv.Atoi(c.QueryParam("page")); err == nil && page > 1 {
+		query.Offset = (page - 1) * query.Limit
+	}
+
+	for _, col := range columns {
+		if c.QueryParam("sort") == col {
+			query.OrderBy = col
+			query.Desc = c.QueryParam("order") == "desc"
+		}
+
+		filter := db.Filter{
+			Column:   col,
+			Operator: c.QueryParam("op:" + col),
+			Value:    c.QueryParam("v:" + col),
+			Value2:   c.QueryParam("v2:" + col),
+		}
+		switch filter.Operator {
+		case db.FilterEquals, db.FilterNotEquals, db.FilterLike, db.FilterNotLike, db.FilterNull, db.FilterNotNull:
+			query.Filters = append(query.Filters, filter)
+		case db.FilterRange:
+			if filter.Value != "" || filter.Value2 != "" {
+				query.Filters = append(query.Filters, filter)
+			}
+		}
+	}
+
+	return query
+}
+
+// filtersByColumn indexes filters by column for filling in the filter bar
+func filtersByColumn(filters []db.Filter) map[string]db.Filter {
+	byColumn := make(map[string]db.Filter, len(filters))
+	for _, f := range filters {
+		byColumn[f.Column] = f
+	}
+	return byColumn
+}
+
+// tableDataURL returns the current table data URL with some query parameters replaced
+func tableDataURL(c echo.Context, params map[string]string) string {
+	query := c.Request().URL.Query()
+	for key, value := range params {
+		query.Set(key, value)
+	}
+	// Moving to another page or sort order should not repeat a one-off error
+	query.Del("error")
+	query.Del("offset")
+
+	return c.Request().URL.Path + "?" + query.Encode()
+}
+
+// pageURLIf returns the URL of a page, or an empty string when the link is not available
+func pageURLIf(c echo.Context, available bool, page int) string {
+	if !available {
+		return ""
+	}
+	return tableDataURL(c, map[string]string{"page": strconv.Itoa(page)})
+}
+
 // Legacy function for backward compatibility
 func TablesPage(c echo.Context) error {
 	return DatabasePage(c)
@@ -191,6 +359,10 @@ func CreateDatabaseAPI(c echo.Context) error {
 		})
 	}
 
+	if !auth.CurrentUser(c).Can(req.ServerID, config.RoleAdmin) {
+		return forbiddenJSON(c)
+	}
+
 	settings := config.GetSettings()
 	server, found := settings.GetServer(req.ServerID)
 	if !found {
@@ -200,7 +372,7 @@ func CreateDatabaseAPI(c echo.Context) error {
 		})
 	}
 
-	dbConn, err := db.ConnectWithoutDB(server.Host, server.Port, server.User, server.Password)
+	dbConn, err := db.Open(*server)
 	if err != nil {
 		return c.JSON(http.StatusOK, map[string]interface{}{
 			"success": false,
@@ -208,17 +380,9 @@ func CreateDatabaseAPI(c echo.Context) error {
 		})
 	}
 	defer dbConn.Close()
+	auditConn(c, dbConn, req.ServerID, req.DBName, audit.ActionCreateDatabase)
 
-	// Build CREATE DATABASE query
-	query := fmt.Sprintf("CREATE DATABASE `%s`", req.DBName)
-	if req.Charset != "" {
-		query += fmt.Sprintf(" CHARACTER SET %s", req.Charset)
-	}
-	if req.Collation != "" {
-		query += fmt.Sprintf(" COLLATE %s", req.Collation)
-	}
-
-	_, err = dbConn.Exec(query)
+	err = db.CreateDatabase(dbConn, req.DBName, req.Charset, req.Collation)
 	if err != nil {
 		return c.JSON(http.StatusOK, map[string]interface{}{
 			"success": false,
@@ -238,6 +402,10 @@ func TableDetailsPage(c echo.Context) error {
 	tableName := c.Param("table")
 	settings := config.GetSettings()
 
+	if err := requireRole(c, serverID, config.RoleViewer); err != nil {
+		return err
+	}
+
 	server, found := settings.GetServer(serverID)
 	if !found {
 		return echo.NewHTTPError(http.StatusNotFound, "Server not found")
@@ -248,7 +416,7 @@ func TableDetailsPage(c echo.Context) error {
 		dbName = server.Database
 	}
 
-	dbConn, err := db.ConnectWithoutDB(server.Host, server.Port, server.User, server.Password)
+	dbConn, err := db.Open(*server)
 	if err != nil {
 		return c.Render(http.StatusOK, "table_details.html", addI18nContext(c, map[string]interface{}{
 			"Server":              server,
@@ -263,8 +431,8 @@ func TableDetailsPage(c echo.Context) error {
 	}
 	defer dbConn.Close()
 
-	// Get all databases and their tables
-	databases, err := db.GetAllDatabases(dbConn)
+	// Load the sidebar tree
+	dbWithTables, err := sidebarTree(dbConn, dbName)
 	if err != nil {
 		return c.Render(http.StatusOK, "table_details.html", addI18nContext(c, map[string]interface{}{
 			"Server":              server,
@@ -278,15 +446,6 @@ func TableDetailsPage(c echo.Context) error {
 		}))
 	}
 
-	var dbWithTables []db.DatabaseWithTables
-	for _, database := range databases {
-		tables, _ := db.GetTables(dbConn, database.DatabaseName)
-		dbWithTables = append(dbWithTables, db.DatabaseWithTables{
-			DatabaseName: database.DatabaseName,
-			Tables:       tables,
-		})
-	}
-
 	// Get table columns
 	columns, err := db.GetTableColumns(dbConn, dbName, tableName)
 	if err != nil {
@@ -341,6 +500,10 @@ func RowDetailsPage(c echo.Context) error {
 	tableName := c.Param("table")
 	settings := config.GetSettings()
 
+	if err := requireRole(c, serverID, config.RoleViewer); err != nil {
+		return err
+	}
+
 	server, found := settings.GetServer(serverID)
 	if !found {
 		return echo.NewHTTPError(http.StatusNotFound, "Server not found")
@@ -351,7 +514,7 @@ func RowDetailsPage(c echo.Context) error {
 		dbName = server.Database
 	}
 
-	dbConn, err := db.ConnectWithoutDB(server.Host, server.Port, server.User, server.Password)
+	dbConn, err := db.Open(*server)
 	if err != nil {
 		return c.Render(http.StatusOK, "row_details.html", addI18nContext(c, map[string]interface{}{
 			"Server":              server,
@@ -366,8 +529,8 @@ func RowDetailsPage(c echo.Context) error {
 	}
 	defer dbConn.Close()
 
-	// Get all databases and their tables
-	databases, err := db.GetAllDatabases(dbConn)
+	// Load the sidebar tree
+	dbWithTables, err := sidebarTree(dbConn, dbName)
 	if err != nil {
 		return c.Render(http.StatusOK, "row_details.html", addI18nContext(c, map[string]interface{}{
 			"Server":              server,
@@ -381,15 +544,6 @@ func RowDetailsPage(c echo.Context) error {
 		}))
 	}
 
-	var dbWithTables []db.DatabaseWithTables
-	for _, database := range databases {
-		tables, _ := db.GetTables(dbConn, database.DatabaseName)
-		dbWithTables = append(dbWithTables, db.DatabaseWithTables{
-			DatabaseName: database.DatabaseName,
-			Tables:       tables,
-		})
-	}
-
 	// Get primary key columns
 	pkColumns, err := db.GetPrimaryKeyColumns(dbConn, dbName, tableName)
 	if err != nil || len(pkColumns) == 0 {
@@ -406,21 +560,9 @@ func RowDetailsPage(c echo.Context) error {
 	}
 
 	// Get primary key values from query parameters
-	pkValues := make([]string, len(pkColumns))
-	for i, col := range pkColumns {
-		pkValues[i] = c.QueryParam(col)
-		if pkValues[i] == "" {
-			return c.Render(http.StatusOK, "row_details.html", addI18nContext(c, map[string]interface{}{
-				"Server":              server,
-				"Error":               "主キー値が指定されていません",
-				"DatabasesWithTables": dbWithTables,
-				"CurrentDatabase":     dbName,
-				"CurrentTable":        tableName,
-				"ActiveMenu":          "database",
-				"ShowDatabaseDropdown": true,
-				"ShowCreateDatabase":  false,
-			}))
-		}
+	pkValues, err := primaryKeyValues(c, pkColumns)
+	if err != nil {
+		return err
 	}
 
 	// Get row data
@@ -442,31 +584,413 @@ func RowDetailsPage(c echo.Context) error {
 	columns, _ := db.GetTableColumns(dbConn, dbName, tableName)
 
 	return c.Render(http.StatusOK, "row_details.html", addI18nContext(c, map[string]interface{}{
-		"Server":              server,
-		"Error":               "",
-		"DatabasesWithTables": dbWithTables,
-		"CurrentDatabase":     dbName,
-		"CurrentTable":        tableName,
-		"RowData":             rowData,
-		"Columns":             columns,
-		"ActiveMenu":          "database",
+		"Server":               server,
+		"Error":                "",
+		"DatabasesWithTables":  dbWithTables,
+		"CurrentDatabase":      dbName,
+		"CurrentTable":         tableName,
+		"RowData":              rowData,
+		"RowKey":               keyQuery(pkColumns, pkValues),
+		"Columns":              columns,
+		"PrimaryKeys":          pkColumns,
+		"ActiveMenu":           "database",
 		"ShowDatabaseDropdown": true,
-		"ShowCreateDatabase":  false,
+		"ShowCreateDatabase":   false,
 	}))
 }
 
+// rowField is one column input of the row insert and edit form
+type rowField struct {
+	Column    db.ColumnInfo
+	Value     string
+	Mode      string // "value", "null", "default" or, for binary columns, "keep"
+	InputType string
+	// Original and OriginalMode are the value and mode the edit form showed,
+	// so that only the columns changed in the form are written
+	Original     string
+	OriginalMode string
+}
+
+// InsertRowPage shows the form for inserting a row and inserts it when posted
+func InsertRowPage(c echo.Context) error {
+	return handleRowForm(c, true)
+}
+
+// EditRowPage shows the form for editing the row selected by its primary key
+// and saves it when posted
+func EditRowPage(c echo.Context) error {
+	return handleRowForm(c, false)
+}
+
+// handleRowForm renders the row form on GET and writes the row on POST
+func handleRowForm(c echo.Context, isNew bool) error {
+	serverID := c.Param("id")
+	dbName := c.Param("db")
+	tableName := c.Param("table")
+	settings := config.GetSettings()
+
+	if err := requireRole(c, serverID, config.RoleEditor); err != nil {
+		return err
+	}
+
+	server, found := settings.GetServer(serverID)
+	if !found {
+		return echo.NewHTTPError(http.StatusNotFound, "Server not found")
+	}
+
+	data := map[string]interface{}{
+		"Server":               server,
+		"Error":                "",
+		"DatabasesWithTables":  nil,
+		"CurrentDatabase":      dbName,
+		"CurrentTable":         tableName,
+		"IsNew":                isNew,
+		"Fields":               nil,
+		"PrimaryKeys":          nil,
+		"RowData":              nil,
+		"ActiveMenu":           "database",
+		"ShowDatabaseDropdown": true,
+		"ShowCreateDatabase":   false,
+	}
+
+	dbConn, err := db.Open(*server)
+	if err != nil {
+		data["Error"] = "データベース接続エラー: " + err.Error()
+		return c.Render(http.StatusOK, "row_form.html", addI18nContext(c, data))
+	}
+	defer dbConn.Close()
+
+	dbWithTables, err := sidebarTree(dbConn, dbName)
+	if err != nil {
+		data["Error"] = "データベース一覧の取得エラー: " + err.Error()
+		return c.Render(http.StatusOK, "row_form.html", addI18nContext(c, data))
+	}
+	data["DatabasesWithTables"] = dbWithTables
+
+	columns, err := db.GetTableColumns(dbConn, dbName, tableName)
+	if err != nil {
+		data["Error"] = "カラム情報の取得エラー: " + err.Error()
+		return c.Render(http.StatusOK, "row_form.html", addI18nContext(c, data))
+	}
+
+	// Editing needs a primary key so that exactly one row is changed
+	pkColumns, _ := db.GetPrimaryKeyColumns(dbConn, dbName, tableName)
+	data["PrimaryKeys"] = pkColumns
+
+	var pkValues []string
+	if !isNew {
+		if len(pkColumns) == 0 {
+			data["Error"] = "主キーが見つかりません"
+			return c.Render(http.StatusOK, "row_form.html", addI18nContext(c, data))
+		}
+
+		pkValues, err = primaryKeyValues(c, pkColumns)
+		if err != nil {
+			return err
+		}
+		data["RowKey"] = keyQuery(pkColumns, pkValues)
+
+		rowData, err := db.GetRowData(dbConn, dbName, tableName, pkColumns, pkValues)
+		if err != nil {
+			data["Error"] = "行データの取得エラー: " + err.Error()
+			return c.Render(http.StatusOK, "row_form.html", addI18nContext(c, data))
+		}
+		data["RowData"] = rowData
+		data["Fields"] = rowFieldsFromRow(columns, rowData)
+	} else {
+		data["Fields"] = rowFieldsForInsert(columns)
+	}
+
+	if c.Request().Method != http.MethodPost {
+		return c.Render(http.StatusOK, "row_form.html", addI18nContext(c, data))
+	}
+
+	fields, values, err := rowFieldsFromForm(c, columns, isNew)
+	data["Fields"] = fields
+	if err != nil {
+		data["Error"] = err.Error()
+		return c.Render(http.StatusOK, "row_form.html", addI18nContext(c, data))
+	}
+
+	tableURL := fmt.Sprintf("/servers/%s/db/%s/table/%s", serverID, url.PathEscape(dbName), url.PathEscape(tableName))
+	if isNew {
+		auditConn(c, dbConn, serverID, dbName, audit.ActionInsertRow)
+		err = db.InsertRow(dbConn, dbName, tableName, values)
+		if err != nil {
+			data["Error"] = "行の追加エラー: " + err.Error()
+			return c.Render(http.StatusOK, "row_form.html", addI18nContext(c, data))
+		}
+		return c.Redirect(http.StatusSeeOther, tableURL)
+	}
+
+	auditConn(c, dbConn, serverID, dbName, audit.ActionUpdateRow)
+	err = db.UpdateRow(dbConn, dbName, tableName, pkColumns, pkValues, values)
+	if err != nil {
+		data["Error"] = "行の更新エラー: " + err.Error()
+		return c.Render(http.StatusOK, "row_form.html", addI18nContext(c, data))
+	}
+
+	// The primary key itself may have been edited
+	query := url.Values{}
+	for i, col := range pkColumns {
+		query.Set(col, pkValues[i])
+		for _, v := range values {
+			if v.Column == col && v.Value != nil {
+				query.Set(col, *v.Value)
+			}
+		}
+	}
+	return c.Redirect(http.StatusSeeOther, tableURL+"/row?"+query.Encode())
+}
+
+// DeleteRow deletes the row selected by its primary key
+func DeleteRow(c echo.Context) error {
+	serverID := c.Param("id")
+	dbName := c.Param("db")
+	tableName := c.Param("table")
+	settings := config.GetSettings()
+
+	if err := requireRole(c, serverID, config.RoleEditor); err != nil {
+		return err
+	}
+
+	server, found := settings.GetServer(serverID)
+	if !found {
+		return echo.NewHTTPError(http.StatusNotFound, "Server not found")
+	}
+
+	tableURL := fmt.Sprintf("/servers/%s/db/%s/table/%s", serverID, url.PathEscape(dbName), url.PathEscape(tableName))
+
+	dbConn, err := db.Open(*server)
+	if err != nil {
+		return c.Redirect(http.StatusSeeOther, tableURL+"?error="+url.QueryEscape("データベース接続エラー"))
+	}
+	defer dbConn.Close()
+
+	pkColumns, err := db.GetPrimaryKeyColumns(dbConn, dbName, tableName)
+	if err != nil || len(pkColumns) == 0 {
+		return c.Redirect(http.StatusSeeOther, tableURL+"?error="+url.QueryEscape("主キーが見つかりません"))
+	}
+
+	pkValues, err := primaryKeyValues(c, pkColumns)
+	if err != nil {
+		return err
+	}
+
+	auditConn(c, dbConn, serverID, dbName, audit.ActionDeleteRow)
+	err = db.DeleteRow(dbConn, dbName, tableName, pkColumns, pkValues)
+	if err != nil {
+		return c.Redirect(http.StatusSeeOther, tableURL+"?error="+url.QueryEscape("行の削除エラー: "+err.Error()))
+	}
+
+	return c.Redirect(http.StatusSeeOther, tableURL)
+}
+
+// primaryKeyValues reads the primary key values from the query string, where
+// each value is keyed by its column name. A missing value is a bad request
+// rather than an empty key.
+func primaryKeyValues(c echo.Context, pkColumns []string) ([]string, error) {
+	params := c.QueryParams()
+	pkValues := make([]string, len(pkColumns))
+	for i, col := range pkColumns {
+		values, ok := params[col]
+		if !ok {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "主キー値が指定されていません: "+col)
+		}
+		pkValues[i] = values[0]
+	}
+	return pkValues, nil
+}
+
+// keyQuery is the query string read by primaryKeyValues
+func keyQuery(pkColumns, pkValues []string) template.URL {
+	query := url.Values{}
+	for i, col := range pkColumns {
+		query.Set(col, pkValues[i])
+	}
+	return template.URL(query.Encode())
+}
+
+// rowKey is the query string selecting a row by its primary key, with the
+// values formatted as in the row form. It is empty when a key is NULL, as
+// such a row cannot be selected.
+func rowKey(pkColumns []string, types map[string]string, row map[string]interface{}) template.URL {
+	if len(pkColumns) == 0 {
+		return ""
+	}
+	pkValues := make([]string, len(pkColumns))
+	for i, col := range pkColumns {
+		if row[col] == nil {
+			return ""
+		}
+		pkValues[i] = formatFieldValue(row[col], types[col])
+	}
+	return keyQuery(pkColumns, pkValues)
+}
+
+// columnTypes maps column names to their types
+func columnTypes(columns []db.ColumnInfo) map[string]string {
+	types := make(map[string]string, len(columns))
+	for _, col := range columns {
+		types[col.Field] = col.Type
+	}
+	return types
+}
+
+// rowFieldsForInsert prepares empty inputs, leaving generated columns and
+// columns with a default to the database
+func rowFieldsForInsert(columns []db.ColumnInfo) []rowField {
+	fields := make([]rowField, len(columns))
+	for i, col := range columns {
+		fields[i] = rowField{Column: col, Mode: "value", InputType: inputType(col.Type)}
+		if col.Default != nil || strings.Contains(col.Extra, "auto_increment") {
+			fields[i].Mode = "default"
+		}
+	}
+	return fields
+}
+
+// rowFieldsFromRow prepares inputs holding the current values of a row.
+// Binary values are shown in hex and kept unless replaced.
+func rowFieldsFromRow(columns []db.ColumnInfo, row map[string]interface{}) []rowField {
+	fields := make([]rowField, len(columns))
+	for i, col := range columns {
+		fields[i] = rowField{Column: col, Mode: "value", InputType: inputType(col.Type)}
+		switch {
+		case row[col.Field] == nil:
+			fields[i].Mode = "null"
+		case fields[i].InputType == "hex":
+			fields[i].Mode = "keep"
+			fields[i].Value = hex.EncodeToString([]byte(fmt.Sprint(row[col.Field])))
+		default:
+			fields[i].Value = formatFieldValue(row[col.Field], col.Type)
+		}
+		fields[i].Original, fields[i].OriginalMode = fields[i].Value, fields[i].Mode
+	}
+	return fields
+}
+
+// rowFieldsFromForm reads the submitted inputs. Each column has a mode:<column>
+// choice and a value:<column> input; columns left on "default" or "keep" are
+// not written. When editing, columns still holding the original:<column> and
+// original_mode:<column> the form was shown with are not written either, so
+// that the update does not overwrite them with their formatted text. Binary
+// values are entered in hex.
+func rowFieldsFromForm(c echo.Context, columns []db.ColumnInfo, isNew bool) ([]rowField, []db.ColumnValue, error) {
+	form, err := c.FormParams()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fields := make([]rowField, len(columns))
+	var values []db.ColumnValue
+	var invalid []string
+	for i, col := range columns {
+		value := form.Get("value:" + col.Field)
+		mode := form.Get("mode:" + col.Field)
+		fields[i] = rowField{Column: col, Value: value, Mode: mode, InputType: inputType(col.Type)}
+		binary := fields[i].InputType == "hex"
+
+		switch {
+		case mode == "null":
+		case mode == "default":
+			if !isNew {
+				// Defaults only apply to new rows; keep the current value
+				fields[i].Mode = "value"
+			}
+			continue
+		case mode == "keep" && binary && !isNew:
+			continue
+		default:
+			mode = "value"
+			fields[i].Mode = mode
+		}
+
+		if !isNew {
+			original, shown := form["original:"+col.Field]
+			fields[i].Original, fields[i].OriginalMode = form.Get("original:"+col.Field), form.Get("original_mode:"+col.Field)
+			if shown && mode == fields[i].OriginalMode && (mode == "null" || value == original[0]) {
+				continue
+			}
+		}
+
+		if mode == "null" {
+			values = append(values, db.ColumnValue{Column: col.Field})
+			continue
+		}
+		v := value
+		if binary {
+			b, err := hex.DecodeString(strings.TrimPrefix(strings.Join(strings.Fields(value), ""), "0x"))
+			if err != nil {
+				invalid = append(invalid, col.Field)
+				continue
+			}
+			v = string(b)
+		}
+		values = append(values, db.ColumnValue{Column: col.Field, Value: &v, Binary: binary})
+	}
+
+	if len(invalid) > 0 {
+		return fields, nil, fmt.Errorf("16進数として読めない値です: %s", strings.Join(invalid, ", "))
+	}
+	return fields, values, nil
+}
+
+// inputType picks the form input for a column type
+func inputType(columnType string) string {
+	baseType := strings.ToLower(columnType)
+	if i := strings.IndexAny(baseType, "( "); i != -1 {
+		baseType = baseType[:i]
+	}
+
+	if db.IsBinaryColumn(columnType) {
+		return "hex"
+	}
+
+	switch baseType {
+	case "tinyint", "smallint", "mediumint", "int", "integer", "bigint", "int2", "int4", "int8",
+		"decimal", "numeric", "float", "double", "real", "float4", "float8":
+		return "number"
+	case "date":
+		return "date"
+	case "tinytext", "text", "mediumtext", "longtext", "json", "jsonb", "xml":
+		return "textarea"
+	}
+	return "text"
+}
+
+// formatFieldValue formats a value the way the database accepts it back
+func formatFieldValue(value interface{}, columnType string) string {
+	t, ok := value.(time.Time)
+	if !ok {
+		return fmt.Sprintf("%v", value)
+	}
+
+	switch {
+	case inputType(columnType) == "date":
+		return t.Format("2006-01-02")
+	case strings.Contains(strings.ToLower(columnType), "with time zone"):
+		return t.Format("2006-01-02 15:04:05.999999Z07:00")
+	}
+	return t.Format("2006-01-02 15:04:05.999999")
+}
+
 func ExportPage(c echo.Context) error {
 	serverID := c.Param("id")
 	dbName := c.Param("db")
 	selectedTable := c.QueryParam("table")
 	settings := config.GetSettings()
 
+	if err := requireRole(c, serverID, config.RoleViewer); err != nil {
+		return err
+	}
+
 	server, found := settings.GetServer(serverID)
 	if !found {
 		return echo.NewHTTPError(http.StatusNotFound, "Server not found")
 	}
 
-	dbConn, err := db.ConnectWithoutDB(server.Host, server.Port, server.User, server.Password)
+	dbConn, err := db.Open(*server)
 	if err != nil {
 		return c.Render(http.StatusOK, "export.html", addI18nContext(c, map[string]interface{}{
 			"Server":              server,
@@ -482,8 +1006,8 @@ func ExportPage(c echo.Context) error {
 	}
 	defer dbConn.Close()
 
-	// Get all databases and their tables
-	databases, err := db.GetAllDatabases(dbConn)
+	// Load the sidebar tree
+	dbWithTables, err := sidebarTree(dbConn, dbName)
 	if err != nil {
 		return c.Render(http.StatusOK, "export.html", addI18nContext(c, map[string]interface{}{
 			"Server":              server,
@@ -498,17 +1022,8 @@ func ExportPage(c echo.Context) error {
 		}))
 	}
 
-	var dbWithTables []db.DatabaseWithTables
-	for _, database := range databases {
-		tables, _ := db.GetTables(dbConn, database.DatabaseName)
-		dbWithTables = append(dbWithTables, db.DatabaseWithTables{
-			DatabaseName: database.DatabaseName,
-			Tables:       tables,
-		})
-	}
-
 	// Get tables for current database
-	tables, err := db.GetTables(dbConn, dbName)
+	tables, err := db.CachedTables(dbConn, dbName)
 	if err != nil {
 		return c.Render(http.StatusOK, "export.html", addI18nContext(c, map[string]interface{}{
 			"Server":              server,
@@ -541,6 +1056,10 @@ func ExportData(c echo.Context) error {
 	dbName := c.Param("db")
 	settings := config.GetSettings()
 
+	if err := requireRole(c, serverID, config.RoleViewer); err != nil {
+		return err
+	}
+
 	server, found := settings.GetServer(serverID)
 	if !found {
 		return echo.NewHTTPError(http.StatusNotFound, "Server not found")
@@ -553,96 +1072,46 @@ func ExportData(c echo.Context) error {
 
 	// Get form data
 	tables := c.Request().Form["tables"]
-	_ = c.FormValue("format") // Currently only CSV is supported
-	delimiter := c.FormValue("delimiter")
-	includeHeaders := c.FormValue("include_headers") == "true"
-	encoding := c.FormValue("encoding")
+	formatName := c.FormValue("format")
+	if formatName == "" {
+		formatName = "csv"
+	}
 
 	if len(tables) == 0 {
 		return echo.NewHTTPError(http.StatusBadRequest, "テーブルが選択されていません")
 	}
 
-	// Convert delimiter
-	if delimiter == "\\t" {
-		delimiter = "\t"
+	format, ok := exportFormats[formatName]
+	if !ok {
+		return echo.NewHTTPError(http.StatusBadRequest, "不明なフォーマット: "+formatName)
 	}
 
-	dbConn, err := db.ConnectWithoutDB(server.Host, server.Port, server.User, server.Password)
+	dbConn, err := db.Open(*server)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "データベース接続エラー: "+err.Error())
 	}
 	defer dbConn.Close()
 
-	// Set response headers
-	c.Response().Header().Set("Content-Type", "text/csv")
-	c.Response().Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s_export.csv", dbName))
-	c.Response().WriteHeader(http.StatusOK)
-
-	// Create CSV writer
-	writer := csv.NewWriter(c.Response().Writer)
-	writer.Comma = rune(delimiter[0])
-
-	// Handle encoding
-	var w *csv.Writer
-	if encoding == "sjis" {
-		encoder := japanese.ShiftJIS.NewEncoder()
-		w = csv.NewWriter(transform.NewWriter(c.Response().Writer, encoder))
-		w.Comma = rune(delimiter[0])
-	} else if encoding == "eucjp" {
-		encoder := japanese.EUCJP.NewEncoder()
-		w = csv.NewWriter(transform.NewWriter(c.Response().Writer, encoder))
-		w.Comma = rune(delimiter[0])
-	} else {
-		w = writer
+	// Check the tables up front rather than failing in the middle of the download
+	existing, err := db.GetTables(dbConn, dbName)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "テーブル一覧の取得エラー: "+err.Error())
 	}
-
-	// Export each table
-	for tableIndex, tableName := range tables {
-		// Get table data
-		data, err := db.GetTableDataAll(dbConn, dbName, tableName)
-		if err != nil {
-			continue
-		}
-
-		if len(data) == 0 {
-			continue
-		}
-
-		// Get column names
-		columns, err := db.GetTableColumns(dbConn, dbName, tableName)
-		if err != nil {
-			continue
-		}
-
-		var columnNames []string
-		for _, col := range columns {
-			columnNames = append(columnNames, col.Field)
-		}
-
-		// Write headers
-		if includeHeaders {
-			w.Write(columnNames)
-		}
-
-		// Write data
-		for _, row := range data {
-			var record []string
-			for _, colName := range columnNames {
-				val := row[colName]
-				valStr := fmt.Sprintf("%v", val)
-				record = append(record, valStr)
-			}
-			w.Write(record)
-		}
-
-		// Add blank line between tables (except for the last table)
-		if tableIndex < len(tables)-1 {
-			w.Write([]string{})
+	exists := make(map[string]bool, len(existing))
+	for _, table := range existing {
+		exists[table.TableName] = true
+	}
+	var missing []string
+	for _, tableName := range tables {
+		if !exists[tableName] {
+			missing = append(missing, tableName)
 		}
 	}
+	if len(missing) > 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "テーブルが見つかりません: "+strings.Join(missing, ", "))
+	}
 
-	w.Flush()
-	return nil
+	return runExport(c, dbConn, dbName, tables, format)
 }
 
 // TableEditPage shows the table edit page
@@ -652,12 +1121,16 @@ func TableEditPage(c echo.Context) error {
 	tableName := c.Param("table")
 	settings := config.GetSettings()
 
+	if err := requireRole(c, serverID, config.RoleAdmin); err != nil {
+		return err
+	}
+
 	server, found := settings.GetServer(serverID)
 	if !found {
 		return echo.NewHTTPError(http.StatusNotFound, "Server not found")
 	}
 
-	dbConn, err := db.ConnectWithoutDB(server.Host, server.Port, server.User, server.Password)
+	dbConn, err := db.Open(*server)
 	if err != nil {
 		return c.Render(http.StatusOK, "table_edit.html", addI18nContext(c, map[string]interface{}{
 			"Server":              server,
@@ -673,8 +1146,8 @@ func TableEditPage(c echo.Context) error {
 	}
 	defer dbConn.Close()
 
-	// Get all databases and their tables for the sidebar
-	databases, err := db.GetAllDatabases(dbConn)
+	// Load the sidebar tree
+	dbWithTables, err := sidebarTree(dbConn, dbName)
 	if err != nil {
 		return c.Render(http.StatusOK, "table_edit.html", addI18nContext(c, map[string]interface{}{
 			"Server":              server,
@@ -689,15 +1162,6 @@ func TableEditPage(c echo.Context) error {
 		}))
 	}
 
-	var dbWithTables []db.DatabaseWithTables
-	for _, database := range databases {
-		tables, _ := db.GetTables(dbConn, database.DatabaseName)
-		dbWithTables = append(dbWithTables, db.DatabaseWithTables{
-			DatabaseName: database.DatabaseName,
-			Tables:       tables,
-		})
-	}
-
 	// Get column information
 	columns, err := db.GetTableColumns(dbConn, dbName, tableName)
 	if err != nil {
@@ -720,36 +1184,183 @@ func TableEditPage(c echo.Context) error {
 		"DatabasesWithTables": dbWithTables,
 		"CurrentDatabase":     dbName,
 		"CurrentTable":        tableName,
-		"Columns":             columns,
+		"Columns":             db.ColumnEditsFromColumns(columns),
 		"ActiveMenu":          "database",
 		"ShowDatabaseDropdown": true,
 		"ShowCreateDatabase":  false,
 	}))
 }
 
-// DeleteTable handles table deletion
+// TableEditSave previews the ALTER TABLE statements for the submitted columns
+// and runs them when the preview is confirmed
+func TableEditSave(c echo.Context) error {
+	serverID := c.Param("id")
+	dbName := c.Param("db")
+	tableName := c.Param("table")
+	settings := config.GetSettings()
+
+	if err := requireRole(c, serverID, config.RoleAdmin); err != nil {
+		return err
+	}
+
+	server, found := settings.GetServer(serverID)
+	if !found {
+		return echo.NewHTTPError(http.StatusNotFound, "Server not found")
+	}
+
+	form, err := c.FormParams()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid form")
+	}
+	edits := parseColumnEdits(form)
+
+	data := map[string]interface{}{
+		"Server":               server,
+		"Error":                "",
+		"Message":              "",
+		"DatabasesWithTables":  nil,
+		"CurrentDatabase":      dbName,
+		"CurrentTable":         tableName,
+		"Columns":              edits,
+		"Statements":           nil,
+		"Results":              nil,
+		"Skipped":              nil,
+		"ActiveMenu":           "database",
+		"ShowDatabaseDropdown": true,
+		"ShowCreateDatabase":   false,
+	}
+
+	dbConn, err := db.Open(*server)
+	if err != nil {
+		data["Error"] = "データベース接続エラー: " + err.Error()
+		return c.Render(http.StatusOK, "table_edit.html", addI18nContext(c, data))
+	}
+	defer dbConn.Close()
+
+	dbWithTables, err := sidebarTree(dbConn, dbName)
+	if err != nil {
+		data["Error"] = "データベース一覧の取得エラー: " + err.Error()
+		return c.Render(http.StatusOK, "table_edit.html", addI18nContext(c, data))
+	}
+	data["DatabasesWithTables"] = dbWithTables
+
+	current, err := db.GetTableColumns(dbConn, dbName, tableName)
+	if err != nil {
+		data["Error"] = "カラム情報の取得エラー: " + err.Error()
+		return c.Render(http.StatusOK, "table_edit.html", addI18nContext(c, data))
+	}
+
+	statements, err := db.BuildAlterTable(dbConn, tableName, current, edits)
+	if err != nil {
+		data["Error"] = "テーブル構造の変更エラー: " + err.Error()
+		return c.Render(http.StatusOK, "table_edit.html", addI18nContext(c, data))
+	}
+	if len(statements) == 0 {
+		data["Message"] = "no_changes"
+		return c.Render(http.StatusOK, "table_edit.html", addI18nContext(c, data))
+	}
+	data["Statements"] = statements
+
+	// Only show the generated DDL until the preview is confirmed
+	if c.FormValue("action") != "execute" {
+		return c.Render(http.StatusOK, "table_edit.html", addI18nContext(c, data))
+	}
+
+	results, err := executeStatements(c, *server, dbName, statements)
+	if err != nil {
+		data["Error"] = "データベース接続エラー: " + err.Error()
+		return c.Render(http.StatusOK, "table_edit.html", addI18nContext(c, data))
+	}
+	data["Results"] = results
+	data["Skipped"] = statements[len(results):]
+
+	if len(results) == len(statements) && results[len(results)-1].Error == "" {
+		data["Message"] = "table_altered"
+		data["Statements"] = nil
+	}
+
+	// Once any statement succeeded the submitted rows no longer match the
+	// table, so show the structure as it is now
+	if len(results) > 1 || results[0].Error == "" {
+		if columns, err := db.GetTableColumns(dbConn, dbName, tableName); err == nil {
+			data["Columns"] = db.ColumnEditsFromColumns(columns)
+		}
+	}
+
+	return c.Render(http.StatusOK, "table_edit.html", addI18nContext(c, data))
+}
+
+// parseColumnEdits reads the editor rows, which are submitted as parallel
+// col_* fields with one value per row
+func parseColumnEdits(form map[string][]string) []db.ColumnEdit {
+	names := form["col_name"]
+	field := func(key string, i int) string {
+		if i < len(form[key]) {
+			return strings.TrimSpace(form[key][i])
+		}
+		return ""
+	}
+
+	edits := make([]db.ColumnEdit, len(names))
+	for i := range names {
+		edits[i] = db.ColumnEdit{
+			Original: field("col_original", i),
+			Name:     field("col_name", i),
+			Type:     field("col_type", i),
+			Nullable: field("col_null", i) == "YES",
+			Default:  field("col_default", i),
+			Drop:     field("col_drop", i) == "1",
+		}
+	}
+
+	return edits
+}
+
+// executeStatements runs generated ALTER TABLE statements on a connection
+// opened to the given database
+func executeStatements(c echo.Context, server config.ServerConfig, dbName string, statements []string) ([]db.StatementResult, error) {
+	dbConn, err := db.OpenDatabase(server, dbName)
+	if err != nil {
+		return nil, err
+	}
+	defer dbConn.Close()
+	auditConn(c, dbConn, server.ID, dbName, audit.ActionAlterTable)
+
+	return db.ExecuteStatements(c.Request().Context(), dbConn, statements)
+}
+
+// DeleteTable drops a table once its name has been typed in the confirm field
 func DeleteTable(c echo.Context) error {
 	serverID := c.Param("id")
 	dbName := c.Param("db")
 	tableName := c.Param("table")
 	settings := config.GetSettings()
 
+	if err := requireRole(c, serverID, config.RoleAdmin); err != nil {
+		return err
+	}
+
 	server, found := settings.GetServer(serverID)
 	if !found {
 		return echo.NewHTTPError(http.StatusNotFound, "Server not found")
 	}
 
-	dbConn, err := db.ConnectWithoutDB(server.Host, server.Port, server.User, server.Password)
+	// The table name must be typed to confirm
+	if c.FormValue("confirm") != tableName {
+		return c.Redirect(http.StatusSeeOther, fmt.Sprintf("/servers/%s/database?db=%s&error=%s", serverID, dbName, url.QueryEscape("テーブル名が一致しないため削除しませんでした")))
+	}
+
+	dbConn, err := db.Open(*server)
 	if err != nil {
 		return c.Redirect(http.StatusSeeOther, fmt.Sprintf("/servers/%s/database?db=%s&error=%s", serverID, dbName, "データベース接続エラー"))
 	}
 	defer dbConn.Close()
 
 	// Execute DROP TABLE
-	query := fmt.Sprintf("DROP TABLE `%s`.`%s`", dbName, tableName)
-	_, err = dbConn.Exec(query)
+	auditConn(c, dbConn, serverID, dbName, audit.ActionDropTable)
+	err = db.DropTable(dbConn, dbName, tableName)
 	if err != nil {
-		return c.Redirect(http.StatusSeeOther, fmt.Sprintf("/servers/%s/database?db=%s&error=%s", serverID, dbName, "テーブル削除エラー: "+err.Error()))
+		return c.Redirect(http.StatusSeeOther, fmt.Sprintf("/servers/%s/database?db=%s&error=%s", serverID, dbName, url.QueryEscape("テーブル削除エラー: "+err.Error())))
 	}
 
 	// Redirect back to database overview
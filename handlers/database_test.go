@@ -0,0 +1,439 @@
+package handlers
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"godbadmin/config"
+	"godbadmin/db"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+// newSQLiteServer saves a server for an in-memory SQLite database holding
+// an items table, for the duration of the test. The database lives as long
+// as one connection to it is open.
+func newSQLiteServer(t *testing.T) config.ServerConfig {
+	t.Helper()
+	name := strings.NewReplacer("/", "-", " ", "-").Replace(t.Name())
+	server := config.ServerConfig{
+		ID:     "test-" + name,
+		Name:   "test",
+		DBType: "sqlite",
+		Host:   "/" + name,
+		Params: map[string]string{"mode": "memory", "cache": "shared"},
+	}
+
+	driver, _ := db.GetDriver(server.DBType)
+	sqlDB, err := sql.Open("sqlite", driver.DSN(server))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range []string{
+		`CREATE TABLE items (id INTEGER PRIMARY KEY, name TEXT NOT NULL, price REAL)`,
+		`INSERT INTO items VALUES (1, 'apple', 1.5), (2, 'pen, "blue"', NULL), (3, 'cup', 3)`,
+		`CREATE TABLE empty (id INTEGER PRIMARY KEY)`,
+	} {
+		if _, err := sqlDB.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	config.GetSettings().AddServer(server)
+	t.Cleanup(func() {
+		config.GetSettings().DeleteServer(server.ID)
+		db.Invalidate(server.ID)
+		sqlDB.Close()
+	})
+	return server
+}
+
+// execSQLite runs statements on the in-memory database of a server from
+// newSQLiteServer
+func execSQLite(t *testing.T, server config.ServerConfig, statements ...string) {
+	t.Helper()
+	driver, _ := db.GetDriver(server.DBType)
+	sqlDB, err := sql.Open("sqlite", driver.DSN(server))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqlDB.Close()
+	for _, stmt := range statements {
+		if _, err := sqlDB.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// testRenderer keeps the page a handler rendered instead of executing its
+// template
+type testRenderer struct {
+	name string
+	data map[string]interface{}
+}
+
+func (r *testRenderer) Render(w io.Writer, name string, data interface{}, c echo.Context) error {
+	r.name = name
+	r.data, _ = data.(map[string]interface{})
+	return nil
+}
+
+// serve runs handler on a request by user to target, routed as route. A JSON
+// body is sent as is; form values as a posted form.
+func serve(handler echo.HandlerFunc, method, route, target string, body interface{}, user *config.User) (*httptest.ResponseRecorder, *testRenderer) {
+	var req *http.Request
+	switch body := body.(type) {
+	case url.Values:
+		req = httptest.NewRequest(method, target, strings.NewReader(body.Encode()))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	case nil:
+		req = httptest.NewRequest(method, target, nil)
+	default:
+		data, _ := json.Marshal(body)
+		req = httptest.NewRequest(method, target, strings.NewReader(string(data)))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	}
+	rec := httptest.NewRecorder()
+
+	e := echo.New()
+	renderer := &testRenderer{}
+	e.Renderer = renderer
+	e.Add(method, route, handler, func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			c.Set("user", user)
+			return next(c)
+		}
+	})
+	e.ServeHTTP(rec, req)
+	return rec, renderer
+}
+
+// decodeJSON decodes the JSON response of an API
+func decodeJSON(t *testing.T, rec *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+		t.Fatalf("response %q: %v", rec.Body, err)
+	}
+}
+
+var testAdmin = &config.User{Username: "admin", Admin: true}
+
+func TestTableDataPageSQLite(t *testing.T) {
+	server := newSQLiteServer(t)
+	route := "/servers/:id/db/:db/table/:table"
+
+	tests := []struct {
+		name      string
+		table     string
+		query     string
+		wantIDs   []int64
+		wantError bool
+	}{
+		{
+			name:    "unsorted",
+			table:   "items",
+			wantIDs: []int64{1, 2, 3},
+		},
+		{
+			name:    "sorted descending",
+			table:   "items",
+			query:   "sort=name&order=desc",
+			wantIDs: []int64{2, 3, 1},
+		},
+		{
+			name:    "second page",
+			table:   "items",
+			query:   "sort=id&limit=2&page=2",
+			wantIDs: []int64{3},
+		},
+		{
+			name:    "empty table",
+			table:   "empty",
+			wantIDs: []int64{},
+		},
+		{
+			name:      "missing table",
+			table:     "nope",
+			wantError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := "/servers/" + server.ID + "/db/main/table/" + tt.table + "?" + tt.query
+			rec, page := serve(TableDataPage, http.MethodGet, route, target, nil, testAdmin)
+			if rec.Code != http.StatusOK || page.name != "table_data.html" {
+				t.Fatalf("status %d, page %q (%s)", rec.Code, page.name, rec.Body)
+			}
+			if tt.wantError {
+				if page.data["Error"] == "" {
+					t.Error("no error shown for a missing table")
+				}
+				return
+			}
+			if page.data["Error"] != "" {
+				t.Fatalf("Error = %v", page.data["Error"])
+			}
+
+			rows, _ := page.data["TableData"].([]map[string]interface{})
+			ids := []int64{}
+			for _, row := range rows {
+				id, _ := row["id"].(int64)
+				ids = append(ids, id)
+			}
+			if !reflect.DeepEqual(ids, tt.wantIDs) {
+				t.Errorf("ids = %v, want %v", ids, tt.wantIDs)
+			}
+		})
+	}
+}
+
+func TestTableDetailsPageSQLite(t *testing.T) {
+	server := newSQLiteServer(t)
+	target := "/servers/" + server.ID + "/db/main/table/items/details"
+	rec, page := serve(TableDetailsPage, http.MethodGet, "/servers/:id/db/:db/table/:table/details", target, nil, testAdmin)
+	if rec.Code != http.StatusOK || page.data["Error"] != "" {
+		t.Fatalf("status %d, error %v", rec.Code, page.data["Error"])
+	}
+
+	columns, _ := page.data["Columns"].([]db.ColumnInfo)
+	var names []string
+	for _, col := range columns {
+		names = append(names, col.Field+" "+col.Type+" "+col.Null+" "+col.Key)
+	}
+	want := []string{"id INTEGER YES PRI", "name TEXT NO ", "price REAL YES "}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("columns = %q, want %q", names, want)
+	}
+	if stmt, _ := page.data["CreateStatement"].(string); !strings.HasPrefix(stmt, "CREATE TABLE items") {
+		t.Errorf("CreateStatement = %q", stmt)
+	}
+}
+
+func TestGetDatabasesAPISQLite(t *testing.T) {
+	server := newSQLiteServer(t)
+	rec, _ := serve(GetDatabasesAPI, http.MethodPost, "/api/databases", "/api/databases", map[string]string{"id": server.ID}, testAdmin)
+
+	var got struct {
+		Success   bool     `json:"success"`
+		Databases []string `json:"databases"`
+	}
+	decodeJSON(t, rec, &got)
+	if !got.Success || !reflect.DeepEqual(got.Databases, []string{"main"}) {
+		t.Errorf("GetDatabasesAPI() = %s, want main", rec.Body)
+	}
+}
+
+func TestTreeAPISQLite(t *testing.T) {
+	server := newSQLiteServer(t)
+	rec, _ := serve(TreeAPI, http.MethodGet, "/api/tree", "/api/tree?server_id="+server.ID+"&db=main", nil, testAdmin)
+
+	var got struct {
+		Success bool     `json:"success"`
+		Tables  []string `json:"tables"`
+	}
+	decodeJSON(t, rec, &got)
+	if !got.Success || !reflect.DeepEqual(got.Tables, []string{"empty", "items"}) {
+		t.Errorf("TreeAPI() = %s, want the tables empty and items", rec.Body)
+	}
+}
+
+func TestConnectionAPISQLite(t *testing.T) {
+	existing := filepath.Join(t.TempDir(), "existing.db")
+	sqlDB, err := sql.Open("sqlite", existing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sqlDB.Exec(`CREATE TABLE t (id INTEGER)`); err != nil {
+		t.Fatal(err)
+	}
+	sqlDB.Close()
+
+	tests := []struct {
+		name string
+		path string
+		want bool
+	}{
+		{"existing file", existing, true},
+		// mode=rw refuses to create a file for a mistyped path
+		{"missing file", filepath.Join(t.TempDir(), "missing.db"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := map[string]string{"db_type": "sqlite", "host": tt.path}
+			rec, _ := serve(TestConnectionAPI, http.MethodPost, "/api/test-connection", "/api/test-connection", body, testAdmin)
+
+			var got struct {
+				Success bool   `json:"success"`
+				Error   string `json:"error"`
+			}
+			decodeJSON(t, rec, &got)
+			if got.Success != tt.want {
+				t.Errorf("TestConnectionAPI() = %s, want success %v", rec.Body, tt.want)
+			}
+		})
+	}
+}
+
+func TestEditRowSQLite(t *testing.T) {
+	server := newSQLiteServer(t)
+	route := "/servers/:id/db/:db/table/:table/row/edit"
+	target := "/servers/" + server.ID + "/db/main/table/files/row/edit?id=1"
+
+	tests := []struct {
+		name string
+		// edit changes the form as posted by a browser, and the row behind
+		// the form's back
+		edit      func(form url.Values)
+		wantError bool
+		wantName  string
+		wantData  []byte
+		wantNote  string
+	}{
+		{
+			name:     "rename keeps the blob",
+			edit:     func(form url.Values) { form.Set("value:name", "b.bin") },
+			wantName: "b.bin",
+			wantData: []byte{0x00, 0xff, 0x10},
+			wantNote: "changed elsewhere",
+		},
+		{
+			name:     "nothing changed",
+			edit:     func(form url.Values) {},
+			wantName: "a.bin",
+			wantData: []byte{0x00, 0xff, 0x10},
+			wantNote: "changed elsewhere",
+		},
+		{
+			name: "blob replaced in hex",
+			edit: func(form url.Values) {
+				form.Set("mode:data", "value")
+				form.Set("value:data", "0x01 02")
+			},
+			wantName: "a.bin",
+			wantData: []byte{0x01, 0x02},
+			wantNote: "changed elsewhere",
+		},
+		{
+			name:     "blob set to NULL",
+			edit:     func(form url.Values) { form.Set("mode:data", "null") },
+			wantName: "a.bin",
+			wantNote: "changed elsewhere",
+		},
+		{
+			name:     "note edited",
+			edit:     func(form url.Values) { form.Set("value:note", "mine") },
+			wantName: "a.bin",
+			wantData: []byte{0x00, 0xff, 0x10},
+			wantNote: "mine",
+		},
+		{
+			name: "invalid hex",
+			edit: func(form url.Values) {
+				form.Set("mode:data", "value")
+				form.Set("value:data", "zz")
+			},
+			wantError: true,
+			wantName:  "a.bin",
+			wantData:  []byte{0x00, 0xff, 0x10},
+			wantNote:  "changed elsewhere",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			execSQLite(t, server,
+				`DROP TABLE IF EXISTS files`,
+				`CREATE TABLE files (id INTEGER PRIMARY KEY, name TEXT NOT NULL, data BLOB, note TEXT)`,
+				`INSERT INTO files VALUES (1, 'a.bin', x'00ff10', 'original')`,
+			)
+
+			_, page := serve(EditRowPage, http.MethodGet, route, target, nil, testAdmin)
+			fields, _ := page.data["Fields"].([]rowField)
+			if len(fields) != 4 {
+				t.Fatalf("fields = %+v, error %v", fields, page.data["Error"])
+			}
+			if fields[2].Mode != "keep" || fields[2].Value != "00ff10" {
+				t.Errorf("blob field = %+v, want kept and shown in hex", fields[2])
+			}
+
+			// A browser posts the mode and originals of every field, and only
+			// the values of the fields in the value mode
+			form := url.Values{}
+			for _, f := range fields {
+				form.Set("mode:"+f.Column.Field, f.Mode)
+				form.Set("original:"+f.Column.Field, f.Original)
+				form.Set("original_mode:"+f.Column.Field, f.OriginalMode)
+				if f.Mode == "value" {
+					form.Set("value:"+f.Column.Field, f.Value)
+				}
+			}
+			tt.edit(form)
+			execSQLite(t, server, `UPDATE files SET note = 'changed elsewhere'`)
+
+			rec, page := serve(EditRowPage, http.MethodPost, route, target, form, testAdmin)
+			if tt.wantError {
+				if rec.Code != http.StatusOK || page.data["Error"] == "" {
+					t.Errorf("status %d, error %v, want the form with an error", rec.Code, page.data["Error"])
+				}
+			} else if rec.Code != http.StatusSeeOther {
+				t.Fatalf("status %d, error %v", rec.Code, page.data["Error"])
+			}
+
+			driver, _ := db.GetDriver(server.DBType)
+			sqlDB, err := sql.Open("sqlite", driver.DSN(server))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sqlDB.Close()
+			var name, note string
+			var data []byte
+			if err := sqlDB.QueryRow(`SELECT name, data, note FROM files WHERE id = 1`).Scan(&name, &data, &note); err != nil {
+				t.Fatal(err)
+			}
+			if name != tt.wantName || !bytes.Equal(data, tt.wantData) || (data == nil) != (tt.wantData == nil) || note != tt.wantNote {
+				t.Errorf("row = %q, %x, %q, want %q, %x, %q", name, data, note, tt.wantName, tt.wantData, tt.wantNote)
+			}
+		})
+	}
+}
+
+func TestTreeAPIAllSQLite(t *testing.T) {
+	server := newSQLiteServer(t)
+	target := "/api/tree?server_id=" + server.ID
+
+	type treeResponse struct {
+		Success   bool `json:"success"`
+		Databases []struct {
+			Name   string   `json:"name"`
+			Tables []string `json:"tables"`
+		} `json:"databases"`
+	}
+	tree := func() treeResponse {
+		rec, _ := serve(TreeAPI, http.MethodGet, "/api/tree", target+"&all=1", nil, testAdmin)
+		var got treeResponse
+		decodeJSON(t, rec, &got)
+		if !got.Success || len(got.Databases) != 1 || got.Databases[0].Name != "main" {
+			t.Fatalf("TreeAPI(all=1) = %s", rec.Body)
+		}
+		return got
+	}
+
+	// SQLite lists tables one database at a time, so they wait for the
+	// database to be expanded
+	if got := tree(); got.Databases[0].Tables != nil {
+		t.Errorf("tables before loading = %q, want null", got.Databases[0].Tables)
+	}
+	serve(TreeAPI, http.MethodGet, "/api/tree", target+"&db=main", nil, testAdmin)
+	if got := tree(); !reflect.DeepEqual(got.Databases[0].Tables, []string{"empty", "items"}) {
+		t.Errorf("tables after loading = %q, want the cached empty and items", got.Databases[0].Tables)
+	}
+}
@@ -0,0 +1,709 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bufio"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"godbadmin/auth"
+	"godbadmin/config"
+	"godbadmin/db"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+	"github.com/xuri/excelize/v2"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/transform"
+)
+
+// maxCellLength is the longest text an Excel cell can hold
+const maxCellLength = 32767
+
+// exportFormat describes one output format of ExportData
+type exportFormat struct {
+	Extension   string
+	ContentType string
+	// Compressed formats are zip files already and are never compressed again
+	Compressed bool
+	Write      func(job *exportJob, w io.Writer) error
+}
+
+var exportFormats = map[string]exportFormat{
+	"csv":    {Extension: "csv", ContentType: "text/csv", Write: (*exportJob).writeCSV},
+	"sql":    {Extension: "sql", ContentType: "application/sql; charset=utf-8", Write: (*exportJob).writeSQL},
+	"json":   {Extension: "json", ContentType: "application/json; charset=utf-8", Write: (*exportJob).writeJSON},
+	"ndjson": {Extension: "ndjson", ContentType: "application/x-ndjson; charset=utf-8", Write: (*exportJob).writeNDJSON},
+	"xlsx": {
+		Extension:   "xlsx",
+		ContentType: "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+		Compressed:  true,
+		Write:       (*exportJob).writeXLSX,
+	},
+}
+
+// exportJob is one export request being written
+type exportJob struct {
+	c        echo.Context
+	conn     *db.Conn
+	dbName   string
+	tables   []string
+	progress *exportProgress
+}
+
+// runExport streams the tables in the given format, compressed as requested
+// by the compression form value. Rows go from the database cursor straight
+// to the response. An error before anything was sent becomes an error
+// response; after that the connection is aborted so the download fails
+// instead of ending as a complete-looking file.
+func runExport(c echo.Context, dbConn *db.Conn, dbName string, tables []string, format exportFormat) error {
+	job := &exportJob{
+		c:        c,
+		conn:     dbConn,
+		dbName:   dbName,
+		tables:   tables,
+		progress: startExportProgress(c, len(tables)),
+	}
+
+	filename := fmt.Sprintf("%s_export.%s", dbName, format.Extension)
+	out := &exportOutput{c: c, progress: job.progress}
+
+	var w io.Writer = out
+	var closer io.Closer
+	switch compression := c.FormValue("compression"); {
+	case format.Compressed || compression == "" || compression == "none":
+		out.contentType = format.ContentType
+		out.filename = filename
+	case compression == "gzip":
+		out.contentType = "application/gzip"
+		out.filename = filename + ".gz"
+		gz := gzip.NewWriter(out)
+		gz.Name = filename
+		gz.ModTime = time.Now()
+		w, closer = gz, gz
+	case compression == "zip":
+		out.contentType = "application/zip"
+		out.filename = fmt.Sprintf("%s_export.zip", dbName)
+		zw := &zipEntryWriter{zip: zip.NewWriter(out), name: filename}
+		w, closer = zw, zw
+	default:
+		job.progress.finish(fmt.Errorf("unknown compression %s", compression))
+		return echo.NewHTTPError(http.StatusBadRequest, "不明な圧縮形式: "+compression)
+	}
+
+	err := format.Write(job, w)
+	if err == nil && closer != nil {
+		err = closer.Close()
+	}
+	if err == nil {
+		// Send the headers even when the export wrote nothing
+		_, err = out.Write(nil)
+	}
+	job.progress.finish(err)
+
+	if err == nil {
+		return nil
+	}
+	if !c.Response().Committed {
+		return echo.NewHTTPError(http.StatusInternalServerError, "エクスポートエラー: "+err.Error())
+	}
+	c.Logger().Errorf("export of %s failed: %v", dbName, err)
+	panic(http.ErrAbortHandler)
+}
+
+// exportOutput writes to the response and sends the headers with the first
+// write, so errors before any output can still be reported as a page
+type exportOutput struct {
+	c           echo.Context
+	contentType string
+	filename    string
+	progress    *exportProgress
+}
+
+func (o *exportOutput) Write(p []byte) (int, error) {
+	res := o.c.Response()
+	if !res.Committed {
+		res.Header().Set("Content-Type", o.contentType)
+		res.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", o.filename))
+		res.WriteHeader(http.StatusOK)
+	}
+
+	n, err := res.Write(p)
+	o.progress.addBytes(n)
+	return n, err
+}
+
+// zipEntryWriter writes a zip file holding a single file. The entry is
+// created with the first write so nothing is sent before there is data.
+type zipEntryWriter struct {
+	zip   *zip.Writer
+	name  string
+	entry io.Writer
+}
+
+func (z *zipEntryWriter) Write(p []byte) (int, error) {
+	if z.entry == nil {
+		entry, err := z.zip.CreateHeader(&zip.FileHeader{
+			Name:     z.name,
+			Method:   zip.Deflate,
+			Modified: time.Now(),
+		})
+		if err != nil {
+			return 0, err
+		}
+		z.entry = entry
+	}
+	return z.entry.Write(p)
+}
+
+func (z *zipEntryWriter) Close() error {
+	if _, err := z.Write(nil); err != nil {
+		return err
+	}
+	return z.zip.Close()
+}
+
+// exportStatus is what the export page shows while a download runs
+type exportStatus struct {
+	Tables int `json:"tables"`
+	// TableIndex is the 1-based position of Table among the exported tables
+	TableIndex int    `json:"table_index"`
+	Table      string `json:"table"`
+	TableRows  int64  `json:"table_rows"`
+	Rows       int64  `json:"rows"`
+	Bytes      int64  `json:"bytes"`
+	Done       bool   `json:"done"`
+	Error      string `json:"error,omitempty"`
+}
+
+// exportProgress tracks a running export for ExportProgress. Only the user
+// who started it can read it, on the server it runs on.
+type exportProgress struct {
+	id      string
+	owner   string
+	server  string
+	mu      sync.Mutex
+	started bool
+	status  exportStatus
+}
+
+var (
+	exportsMu sync.Mutex
+	exports   = make(map[string]*exportProgress)
+)
+
+// exportProgressTTL is how long the final state of an export stays readable,
+// and how long an export ID is valid before its export starts
+const exportProgressTTL = time.Minute
+
+// StartExport issues the ID the export page sends with its download and then
+// polls ExportProgress with
+func StartExport(c echo.Context) error {
+	serverID := c.Param("id")
+	user := auth.CurrentUser(c)
+	if !user.Can(serverID, config.RoleViewer) {
+		return forbiddenJSON(c)
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		})
+	}
+	p := &exportProgress{id: hex.EncodeToString(b), owner: user.Username, server: serverID}
+
+	exportsMu.Lock()
+	exports[p.id] = p
+	exportsMu.Unlock()
+	p.expire(func() bool { return !p.started })
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"success":   true,
+		"export_id": p.id,
+	})
+}
+
+// startExportProgress tracks the progress of an export under the ID issued
+// by StartExport. Without an unused ID issued to the same user for the same
+// server the progress is tracked but not readable.
+func startExportProgress(c echo.Context, tables int) *exportProgress {
+	exportsMu.Lock()
+	p, found := exports[c.FormValue("export_id")]
+	exportsMu.Unlock()
+
+	if !found || !p.readableBy(c) {
+		return &exportProgress{status: exportStatus{Tables: tables}}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.started {
+		return &exportProgress{status: exportStatus{Tables: tables}}
+	}
+	p.started = true
+	p.status.Tables = tables
+	return p
+}
+
+// readableBy reports whether the request comes from the user who was issued
+// the export ID, for the same server
+func (p *exportProgress) readableBy(c echo.Context) bool {
+	user := auth.CurrentUser(c)
+	return user != nil && p.owner == user.Username && p.server == c.Param("id")
+}
+
+// expire forgets the export after exportProgressTTL when stale still holds
+func (p *exportProgress) expire(stale func() bool) {
+	time.AfterFunc(exportProgressTTL, func() {
+		p.mu.Lock()
+		remove := stale()
+		p.mu.Unlock()
+		if !remove {
+			return
+		}
+		exportsMu.Lock()
+		if exports[p.id] == p {
+			delete(exports, p.id)
+		}
+		exportsMu.Unlock()
+	})
+}
+
+func (p *exportProgress) update(tableName string, tableRows int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if tableRows == 0 {
+		p.status.TableIndex++
+		p.status.Table = tableName
+		p.status.TableRows = 0
+		return
+	}
+	p.status.Rows += tableRows - p.status.TableRows
+	p.status.TableRows = tableRows
+}
+
+func (p *exportProgress) addBytes(n int) {
+	p.mu.Lock()
+	p.status.Bytes += int64(n)
+	p.mu.Unlock()
+}
+
+func (p *exportProgress) finish(err error) {
+	p.mu.Lock()
+	p.status.Done = true
+	if err != nil {
+		p.status.Error = err.Error()
+	}
+	p.mu.Unlock()
+
+	if p.id != "" {
+		p.expire(func() bool { return true })
+	}
+}
+
+func (p *exportProgress) snapshot() exportStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.status
+}
+
+// ExportProgress reports the progress of the export started with export_id
+func ExportProgress(c echo.Context) error {
+	if !auth.CurrentUser(c).Can(c.Param("id"), config.RoleViewer) {
+		return forbiddenJSON(c)
+	}
+
+	exportsMu.Lock()
+	p, found := exports[c.QueryParam("export_id")]
+	exportsMu.Unlock()
+
+	if !found || !p.readableBy(c) {
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"success": false,
+			"error":   "Export not found",
+		})
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"success":  true,
+		"progress": p.snapshot(),
+	})
+}
+
+// writeCSV writes the tables one after another, separated by a blank line
+func (job *exportJob) writeCSV(out io.Writer) error {
+	delimiter := job.c.FormValue("delimiter")
+	if delimiter == "\\t" {
+		delimiter = "\t"
+	}
+	includeHeaders := job.c.FormValue("include_headers") == "true"
+
+	// Handle encoding
+	var encoded io.WriteCloser
+	switch job.c.FormValue("encoding") {
+	case "sjis":
+		encoded = transform.NewWriter(out, japanese.ShiftJIS.NewEncoder())
+	case "eucjp":
+		encoded = transform.NewWriter(out, japanese.EUCJP.NewEncoder())
+	}
+	if encoded != nil {
+		out = encoded
+	}
+
+	w := csv.NewWriter(out)
+	if r, _ := utf8.DecodeRuneInString(delimiter); r != utf8.RuneError {
+		w.Comma = r
+	}
+
+	for tableIndex, tableName := range job.tables {
+		err := job.eachRow(tableName, func(columns []string, row []interface{}) error {
+			record := make([]string, len(row))
+			for i, val := range row {
+				record[i] = csvValue(val)
+			}
+			return w.Write(record)
+		}, func(columns []string) error {
+			if includeHeaders {
+				return w.Write(columns)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// Add blank line between tables (except for the last table)
+		if tableIndex < len(job.tables)-1 {
+			w.Write([]string{})
+		}
+	}
+
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	if encoded != nil {
+		return encoded.Close()
+	}
+	return nil
+}
+
+// csvValue formats a typed value as CSV text; NULL becomes an empty field
+func csvValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case []byte:
+		return string(v)
+	case time.Time:
+		return v.Format("2006-01-02 15:04:05")
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+// writeSQL writes the tables as an SQL dump
+func (job *exportJob) writeSQL(w io.Writer) error {
+	content := job.c.FormValue("sql_content")
+	opts := db.DumpOptions{
+		Structure:          content != "data",
+		Data:               content != "structure",
+		DropTable:          job.c.FormValue("drop_table") == "true",
+		ExtendedInserts:    job.c.FormValue("extended_inserts") == "true",
+		DisableForeignKeys: job.c.FormValue("disable_foreign_keys") == "true",
+		Progress:           job.progress.update,
+	}
+
+	err := db.WriteSQLDump(job.c.Request().Context(), w, job.conn, job.dbName, job.tables, opts)
+	if err != nil {
+		// Leave the error where the dump stops for whoever opens the partial file
+		fmt.Fprintf(w, "\n-- Export error: %s\n", strings.ReplaceAll(err.Error(), "\n", " "))
+	}
+	return err
+}
+
+// writeJSON writes an object holding an array of row objects per table
+func (job *exportJob) writeJSON(out io.Writer) error {
+	w := bufio.NewWriter(out)
+
+	w.WriteString("{")
+	for i, tableName := range job.tables {
+		if i > 0 {
+			w.WriteString(",")
+		}
+		key, _ := json.Marshal(tableName)
+		w.WriteString("\n  ")
+		w.Write(key)
+		w.WriteString(": [")
+
+		count := 0
+		err := job.eachRow(tableName, func(columns []string, row []interface{}) error {
+			obj, err := rowObject(columns, row, "")
+			if err != nil {
+				return err
+			}
+			if count > 0 {
+				w.WriteString(",")
+			}
+			w.WriteString("\n    ")
+			_, err = w.Write(obj)
+			count++
+			return err
+		}, nil)
+		if err != nil {
+			return err
+		}
+
+		if count > 0 {
+			w.WriteString("\n  ")
+		}
+		w.WriteString("]")
+	}
+	w.WriteString("\n}\n")
+
+	return w.Flush()
+}
+
+// writeNDJSON writes one row object per line. When several tables are
+// exported each object starts with a "_table" field naming its table.
+func (job *exportJob) writeNDJSON(out io.Writer) error {
+	w := bufio.NewWriter(out)
+
+	for _, tableName := range job.tables {
+		tableField := ""
+		if len(job.tables) > 1 {
+			tableField = tableName
+		}
+
+		err := job.eachRow(tableName, func(columns []string, row []interface{}) error {
+			obj, err := rowObject(columns, row, tableField)
+			if err != nil {
+				return err
+			}
+			w.Write(obj)
+			_, err = w.WriteString("\n")
+			return err
+		}, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	return w.Flush()
+}
+
+// writeXLSX writes a workbook with one sheet per table. The sheets are
+// built first, so nothing is sent until the whole workbook is ready.
+func (job *exportJob) writeXLSX(w io.Writer) error {
+	f := excelize.NewFile()
+	defer f.Close()
+
+	headerStyle, err := f.NewStyle(&excelize.Style{Font: &excelize.Font{Bold: true}})
+	if err != nil {
+		return err
+	}
+	dateStyle, err := f.NewStyle(&excelize.Style{NumFmt: 22})
+	if err != nil {
+		return err
+	}
+
+	usedNames := make(map[string]bool)
+	for i, tableName := range job.tables {
+		sheet := sheetName(tableName, usedNames)
+		if i == 0 {
+			err = f.SetSheetName("Sheet1", sheet)
+		} else {
+			_, err = f.NewSheet(sheet)
+		}
+		if err != nil {
+			return err
+		}
+
+		sw, err := f.NewStreamWriter(sheet)
+		if err != nil {
+			return err
+		}
+
+		rowNum := 1
+		err = job.eachRow(tableName, func(columns []string, row []interface{}) error {
+			rowNum++
+			cells := make([]interface{}, len(row))
+			for i, val := range row {
+				cells[i] = xlsxCell(val, dateStyle)
+			}
+			cell, _ := excelize.CoordinatesToCellName(1, rowNum)
+			return sw.SetRow(cell, cells)
+		}, func(columns []string) error {
+			header := make([]interface{}, len(columns))
+			for i, col := range columns {
+				header[i] = excelize.Cell{StyleID: headerStyle, Value: col}
+			}
+			return sw.SetRow("A1", header)
+		})
+		if err != nil {
+			return err
+		}
+
+		if err := sw.Flush(); err != nil {
+			return err
+		}
+	}
+
+	return f.Write(w)
+}
+
+// eachRow streams the rows of a table to fn, calling header first with the
+// column names when it is set. Errors name the table.
+func (job *exportJob) eachRow(tableName string, fn func(columns []string, row []interface{}) error, header func(columns []string) error) error {
+	job.progress.update(tableName, 0)
+
+	rows, err := db.OpenTableRows(job.c.Request().Context(), job.conn, job.dbName, tableName)
+	if err != nil {
+		return fmt.Errorf("%s: %w", tableName, err)
+	}
+	defer rows.Close()
+
+	if header != nil {
+		if err := header(rows.Columns); err != nil {
+			return err
+		}
+	}
+
+	var count int64
+	for rows.Next() {
+		row, err := rows.Scan()
+		if err != nil {
+			return fmt.Errorf("%s: %w", tableName, err)
+		}
+		if err := fn(rows.Columns, row); err != nil {
+			return err
+		}
+		count++
+		job.progress.update(tableName, count)
+	}
+
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("%s: %w", tableName, err)
+	}
+	return nil
+}
+
+// rowObject encodes a row as a JSON object keeping the column order, which
+// encoding a map would lose. A non-empty table is written as a leading
+// "_table" field.
+func rowObject(columns []string, row []interface{}, table string) ([]byte, error) {
+	var b strings.Builder
+	b.WriteString("{")
+
+	if table != "" {
+		name, _ := json.Marshal(table)
+		b.WriteString(`"_table":`)
+		b.Write(name)
+	}
+
+	for i, col := range columns {
+		if i > 0 || table != "" {
+			b.WriteString(",")
+		}
+		key, err := json.Marshal(col)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(row[i])
+		if err != nil {
+			return nil, err
+		}
+		b.Write(key)
+		b.WriteString(":")
+		b.Write(value)
+	}
+
+	b.WriteString("}")
+	return []byte(b.String()), nil
+}
+
+// xlsxCell converts a typed value to a cell value. Excel stores numbers as
+// doubles, so numbers with more than 15 significant digits stay text.
+func xlsxCell(value interface{}, dateStyle int) interface{} {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case json.Number:
+		if significantDigits(string(v)) > 15 {
+			return string(v)
+		}
+		if f, err := v.Float64(); err == nil {
+			return f
+		}
+		return string(v)
+	case []byte:
+		return fmt.Sprintf("0x%X", v)
+	case string:
+		if len(v) > maxCellLength {
+			// Cut on a rune boundary
+			cut := maxCellLength
+			for cut > 0 && !utf8.RuneStart(v[cut]) {
+				cut--
+			}
+			return v[:cut]
+		}
+		return v
+	case time.Time:
+		// Dates are stored as numbers and need a format to show as dates
+		return excelize.Cell{StyleID: dateStyle, Value: v}
+	}
+	return value
+}
+
+// significantDigits counts the digits of a number's mantissa without leading zeros
+func significantDigits(number string) int {
+	if i := strings.IndexAny(number, "eE"); i != -1 {
+		number = number[:i]
+	}
+	number = strings.TrimLeft(strings.Replace(strings.TrimLeft(number, "+-"), ".", "", 1), "0")
+	return len(number)
+}
+
+// sheetName makes a table name a valid and unique worksheet name: at most 31
+// characters without []:*?/\
+func sheetName(tableName string, used map[string]bool) string {
+	name := strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`[]:*?/\`, r) {
+			return '_'
+		}
+		return r
+	}, tableName)
+	name = strings.Trim(name, "'")
+	if name == "" {
+		name = "Sheet"
+	}
+
+	base := name
+	for n := 2; ; n++ {
+		if runes := []rune(name); len(runes) > 31 {
+			name = string(runes[:31])
+		}
+		if !used[strings.ToLower(name)] {
+			break
+		}
+		suffix := fmt.Sprintf(" (%d)", n)
+		runes := []rune(base)
+		if len(runes)+len(suffix) > 31 {
+			runes = runes[:31-len(suffix)]
+		}
+		name = string(runes) + suffix
+	}
+
+	used[strings.ToLower(name)] = true
+	return name
+}
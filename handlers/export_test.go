@@ -0,0 +1,182 @@
+package handlers
+
+import (
+	"encoding/json"
+	"godbadmin/config"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+const exportRoute = "/servers/:id/db/:db/export"
+
+func TestExportData(t *testing.T) {
+	server := newSQLiteServer(t)
+
+	tests := []struct {
+		name         string
+		form         url.Values
+		user         *config.User
+		wantStatus   int
+		wantType     string
+		wantBody     string
+		wantFilename string
+	}{
+		{
+			name:         "csv with headers",
+			form:         url.Values{"tables": {"items"}, "format": {"csv"}, "delimiter": {","}, "include_headers": {"true"}},
+			user:         testAdmin,
+			wantStatus:   http.StatusOK,
+			wantType:     "text/csv",
+			wantBody:     "id,name,price\n1,apple,1.5\n2,\"pen, \"\"blue\"\"\",\n3,cup,3\n",
+			wantFilename: "main_export.csv",
+		},
+		{
+			name:       "tab separated without headers",
+			form:       url.Values{"tables": {"items"}, "format": {"csv"}, "delimiter": {`\t`}},
+			user:       testAdmin,
+			wantStatus: http.StatusOK,
+			wantBody:   "1\tapple\t1.5\n2\t\"pen, \"\"blue\"\"\"\t\n3\tcup\t3\n",
+		},
+		{
+			name:       "json",
+			form:       url.Values{"tables": {"items", "empty"}, "format": {"json"}},
+			user:       testAdmin,
+			wantStatus: http.StatusOK,
+			wantType:   "application/json; charset=utf-8",
+			wantBody:   "{\n  \"items\": [\n    {\"id\":1,\"name\":\"apple\",\"price\":1.5},\n    {\"id\":2,\"name\":\"pen, \\\"blue\\\"\",\"price\":null},\n    {\"id\":3,\"name\":\"cup\",\"price\":3}\n  ],\n  \"empty\": []\n}\n",
+		},
+		{
+			name:       "ndjson",
+			form:       url.Values{"tables": {"items"}, "format": {"ndjson"}},
+			user:       testAdmin,
+			wantStatus: http.StatusOK,
+			wantBody:   "{\"id\":1,\"name\":\"apple\",\"price\":1.5}\n{\"id\":2,\"name\":\"pen, \\\"blue\\\"\",\"price\":null}\n{\"id\":3,\"name\":\"cup\",\"price\":3}\n",
+		},
+		{
+			name:       "missing table",
+			form:       url.Values{"tables": {"items", "nope"}, "format": {"csv"}},
+			user:       testAdmin,
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "no table",
+			form:       url.Values{"format": {"csv"}},
+			user:       testAdmin,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "unknown format",
+			form:       url.Values{"tables": {"items"}, "format": {"pdf"}},
+			user:       testAdmin,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "unknown compression",
+			form:       url.Values{"tables": {"items"}, "format": {"csv"}, "compression": {"rar"}},
+			user:       testAdmin,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "no role on the server",
+			form:       url.Values{"tables": {"items"}, "format": {"csv"}},
+			user:       &config.User{Username: "bob"},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "viewer",
+			form:       url.Values{"tables": {"empty"}, "format": {"ndjson"}},
+			user:       &config.User{Username: "bob", Roles: map[string]config.Role{server.ID: config.RoleViewer}},
+			wantStatus: http.StatusOK,
+			wantBody:   "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec, _ := serve(ExportData, http.MethodPost, exportRoute, "/servers/"+server.ID+"/db/main/export", tt.form, tt.user)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (%s)", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if rec.Code != http.StatusOK {
+				return
+			}
+
+			if tt.wantType != "" && rec.Header().Get(echo.HeaderContentType) != tt.wantType {
+				t.Errorf("Content-Type = %q, want %q", rec.Header().Get(echo.HeaderContentType), tt.wantType)
+			}
+			if tt.wantFilename != "" && !strings.Contains(rec.Header().Get(echo.HeaderContentDisposition), tt.wantFilename) {
+				t.Errorf("Content-Disposition = %q, want %s", rec.Header().Get(echo.HeaderContentDisposition), tt.wantFilename)
+			}
+			if body := rec.Body.String(); body != tt.wantBody {
+				t.Errorf("body = %q, want %q", body, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestExportProgressOwner(t *testing.T) {
+	server := newSQLiteServer(t)
+	alice := &config.User{Username: "alice", Roles: map[string]config.Role{server.ID: config.RoleViewer, "other": config.RoleViewer}}
+	bob := &config.User{Username: "bob", Roles: map[string]config.Role{server.ID: config.RoleViewer}}
+	exportPath := "/servers/" + server.ID + "/db/main/export"
+
+	rec, _ := serve(StartExport, http.MethodPost, exportRoute+"/start", exportPath+"/start", nil, alice)
+	var started struct {
+		Success  bool   `json:"success"`
+		ExportID string `json:"export_id"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &started); err != nil || !started.Success || started.ExportID == "" {
+		t.Fatalf("StartExport() = %s", rec.Body)
+	}
+
+	form := url.Values{"tables": {"items"}, "format": {"csv"}, "export_id": {started.ExportID}}
+	if rec, _ := serve(ExportData, http.MethodPost, exportRoute, exportPath, form, alice); rec.Code != http.StatusOK {
+		t.Fatalf("ExportData() status = %d (%s)", rec.Code, rec.Body)
+	}
+
+	tests := []struct {
+		name     string
+		user     *config.User
+		serverID string
+		exportID string
+		want     bool
+	}{
+		{"owner", alice, server.ID, started.ExportID, true},
+		{"another user", bob, server.ID, started.ExportID, false},
+		{"another server", alice, "other", started.ExportID, false},
+		{"unknown ID", alice, server.ID, "0123456789abcdef", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := "/servers/" + tt.serverID + "/db/main/export/progress?export_id=" + url.QueryEscape(tt.exportID)
+			rec, _ := serve(ExportProgress, http.MethodGet, exportRoute+"/progress", target, nil, tt.user)
+			var got struct {
+				Success  bool         `json:"success"`
+				Progress exportStatus `json:"progress"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Success != tt.want {
+				t.Fatalf("ExportProgress() = %s, want success %v", rec.Body, tt.want)
+			}
+			if got.Success && (!got.Progress.Done || got.Progress.Rows != 3) {
+				t.Errorf("progress = %+v, want 3 rows done", got.Progress)
+			}
+		})
+	}
+
+	// An ID is used by one export only
+	form.Set("tables", "empty")
+	serve(ExportData, http.MethodPost, exportRoute, exportPath, form, alice)
+	exportsMu.Lock()
+	p := exports[started.ExportID]
+	exportsMu.Unlock()
+	if p.snapshot().Table != "items" {
+		t.Error("the export ID was used by a second export")
+	}
+}
@@ -0,0 +1,644 @@
+package handlers
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"godbadmin/audit"
+	"godbadmin/config"
+	"godbadmin/db"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/transform"
+)
+
+const (
+	// importPreviewRows is the number of CSV rows shown before importing
+	importPreviewRows = 10
+	// importSampleRows is the number of CSV rows used to suggest column types
+	importSampleRows = 100
+	// importUploadTTL is how long an uploaded CSV file waits for its import
+	importUploadTTL = 30 * time.Minute
+	// defaultImportBatchSize is the number of rows committed per transaction
+	defaultImportBatchSize = 1000
+)
+
+// importOptions are the settings of the import form, carried from the upload
+// step to the import step
+type importOptions struct {
+	Format    string
+	Delimiter string
+	Header    bool
+	Encoding  string
+	EmptyNull bool
+	BatchSize int
+	// Table is the existing table to load into; NewTable names a table created from the CSV header
+	Table    string
+	NewTable string
+	Create   bool
+}
+
+func parseImportOptions(c echo.Context) importOptions {
+	opts := importOptions{
+		Format:    c.FormValue("format"),
+		Delimiter: c.FormValue("delimiter"),
+		Header:    c.FormValue("header") == "true",
+		Encoding:  c.FormValue("encoding"),
+		EmptyNull: c.FormValue("empty_null") == "true",
+		Table:     c.FormValue("table"),
+		NewTable:  strings.TrimSpace(c.FormValue("new_table")),
+		Create:    c.FormValue("target") == "new",
+	}
+	if opts.Format == "" {
+		opts.Format = "csv"
+	}
+	if opts.Delimiter == "" {
+		opts.Delimiter = ","
+	}
+
+	opts.BatchSize, _ = strconv.Atoi(c.FormValue("batch_size"))
+	if opts.BatchSize < 1 {
+		opts.BatchSize = defaultImportBatchSize
+	}
+
+	return opts
+}
+
+// TargetTable returns the table the rows go to
+func (o importOptions) TargetTable() string {
+	if o.Create {
+		return o.NewTable
+	}
+	return o.Table
+}
+
+// comma returns the CSV delimiter; the form sends a tab as \t
+func (o importOptions) comma() rune {
+	if o.Delimiter == "\\t" {
+		return '\t'
+	}
+	r, _ := utf8.DecodeRuneInString(o.Delimiter)
+	return r
+}
+
+// decode wraps a file so it is read as UTF-8, mirroring the export encodings
+func (o importOptions) decode(r io.Reader) io.Reader {
+	switch o.Encoding {
+	case "sjis":
+		return transform.NewReader(r, japanese.ShiftJIS.NewDecoder())
+	case "eucjp":
+		return transform.NewReader(r, japanese.EUCJP.NewDecoder())
+	}
+
+	// Skip a UTF-8 byte order mark
+	br := bufio.NewReader(r)
+	if bom, err := br.Peek(3); err == nil && string(bom) == "\xef\xbb\xbf" {
+		br.Discard(3)
+	}
+	return br
+}
+
+// openCSV opens an uploaded CSV file with the delimiter and encoding of the options
+func (o importOptions) openCSV(path string) (*csv.Reader, *os.File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	r := csv.NewReader(o.decode(f))
+	r.Comma = o.comma()
+	r.FieldsPerRecord = -1
+	return r, f, nil
+}
+
+// importUpload is a CSV file kept between the preview and the import
+type importUpload struct {
+	Path     string
+	Filename string
+}
+
+var (
+	importsMu sync.Mutex
+	imports   = make(map[string]*importUpload)
+)
+
+// saveImportUpload stores an uploaded file until it is imported or expires
+// and returns the token that identifies it
+func saveImportUpload(src io.Reader, filename string) (string, error) {
+	f, err := os.CreateTemp("", "godbadmin-import-*")
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(f, src); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+
+	importsMu.Lock()
+	imports[token] = &importUpload{Path: f.Name(), Filename: filename}
+	importsMu.Unlock()
+
+	time.AfterFunc(importUploadTTL, func() { removeImportUpload(token) })
+	return token, nil
+}
+
+func getImportUpload(token string) (*importUpload, bool) {
+	importsMu.Lock()
+	defer importsMu.Unlock()
+	upload, found := imports[token]
+	return upload, found
+}
+
+func removeImportUpload(token string) {
+	importsMu.Lock()
+	upload, found := imports[token]
+	delete(imports, token)
+	importsMu.Unlock()
+
+	if found {
+		os.Remove(upload.Path)
+	}
+}
+
+// importMapping is one CSV column on the mapping step
+type importMapping struct {
+	Index  int
+	Header string
+	// Column is the target column, empty to skip the CSV column
+	Column string
+	// Type is the column type when a new table is created
+	Type string
+}
+
+// ImportPage shows the import form
+func ImportPage(c echo.Context) error {
+	serverID := c.Param("id")
+	dbName := c.Param("db")
+	settings := config.GetSettings()
+
+	if err := requireRole(c, serverID, config.RoleEditor); err != nil {
+		return err
+	}
+
+	server, found := settings.GetServer(serverID)
+	if !found {
+		return echo.NewHTTPError(http.StatusNotFound, "Server not found")
+	}
+
+	data := importPageData(server, dbName)
+	data["Options"] = importOptions{Format: "csv", Delimiter: ",", Header: true, EmptyNull: true, BatchSize: defaultImportBatchSize, Table: c.QueryParam("table")}
+
+	dbConn, err := db.Open(*server)
+	if err != nil {
+		data["Error"] = "データベース接続エラー: " + err.Error()
+		return c.Render(http.StatusOK, "import.html", addI18nContext(c, data))
+	}
+	defer dbConn.Close()
+
+	if err := loadImportTables(dbConn, dbName, data); err != nil {
+		data["Error"] = err.Error()
+	}
+
+	return c.Render(http.StatusOK, "import.html", addI18nContext(c, data))
+}
+
+// ImportData handles the import form. action=upload reads the posted file:
+// SQL files are executed right away and CSV files are kept for the column
+// mapping step. action=import loads a kept CSV file with the posted mapping.
+func ImportData(c echo.Context) error {
+	serverID := c.Param("id")
+	dbName := c.Param("db")
+	settings := config.GetSettings()
+
+	if err := requireRole(c, serverID, config.RoleEditor); err != nil {
+		return err
+	}
+
+	server, found := settings.GetServer(serverID)
+	if !found {
+		return echo.NewHTTPError(http.StatusNotFound, "Server not found")
+	}
+
+	opts := parseImportOptions(c)
+	// SQL files and new tables can change the schema
+	if opts.Format == "sql" || opts.Create {
+		if err := requireRole(c, serverID, config.RoleAdmin); err != nil {
+			return err
+		}
+	}
+	data := importPageData(server, dbName)
+	data["Options"] = opts
+
+	dbConn, err := db.Open(*server)
+	if err != nil {
+		data["Error"] = "データベース接続エラー: " + err.Error()
+		return c.Render(http.StatusOK, "import.html", addI18nContext(c, data))
+	}
+	defer dbConn.Close()
+
+	if err := loadImportTables(dbConn, dbName, data); err != nil {
+		data["Error"] = err.Error()
+		return c.Render(http.StatusOK, "import.html", addI18nContext(c, data))
+	}
+
+	if c.FormValue("action") == "import" {
+		err = importCSV(c, *server, dbConn, dbName, opts, data)
+		if err != nil && data["Step"] == "upload" {
+			// Nothing was imported; show the mapping again with the posted choices
+			if showImportMapping(dbConn, dbName, opts, c.FormValue("token"), data) == nil {
+				form := c.Request().Form
+				mappings := data["Mappings"].([]importMapping)
+				for i := range mappings {
+					if i < len(form["column"]) {
+						mappings[i].Column = form["column"][i]
+					}
+					if i < len(form["type"]) {
+						mappings[i].Type = form["type"][i]
+					}
+				}
+			}
+		}
+	} else {
+		err = uploadImport(c, *server, dbConn, dbName, opts, data)
+	}
+	if err != nil {
+		data["Error"] = err.Error()
+	}
+
+	return c.Render(http.StatusOK, "import.html", addI18nContext(c, data))
+}
+
+func importPageData(server *config.ServerConfig, dbName string) map[string]interface{} {
+	return map[string]interface{}{
+		"Server":               server,
+		"Error":                "",
+		"DatabasesWithTables":  nil,
+		"CurrentDatabase":      dbName,
+		"Tables":               nil,
+		"Step":                 "upload",
+		"ActiveMenu":           "database",
+		"ShowDatabaseDropdown": true,
+		"ShowCreateDatabase":   false,
+	}
+}
+
+// loadImportTables adds the sidebar and the tables of the database to data
+func loadImportTables(dbConn *db.Conn, dbName string, data map[string]interface{}) error {
+	dbWithTables, err := sidebarTree(dbConn, dbName)
+	if err != nil {
+		return errors.New("データベース一覧の取得エラー: " + err.Error())
+	}
+	data["DatabasesWithTables"] = dbWithTables
+
+	tables, err := db.CachedTables(dbConn, dbName)
+	if err != nil {
+		return errors.New("テーブル一覧の取得エラー: " + err.Error())
+	}
+	data["Tables"] = tables
+
+	return nil
+}
+
+// uploadImport runs an uploaded SQL file, or stores an uploaded CSV file and
+// prepares its preview and column mapping
+func uploadImport(c echo.Context, server config.ServerConfig, dbConn *db.Conn, dbName string, opts importOptions, data map[string]interface{}) error {
+	fh, err := c.FormFile("file")
+	if err != nil {
+		return errors.New("ファイルが選択されていません")
+	}
+	src, err := fh.Open()
+	if err != nil {
+		return errors.New("ファイルの読み込みエラー: " + err.Error())
+	}
+	defer src.Close()
+
+	if opts.Format == "sql" {
+		return importSQL(c, server, dbName, opts, src, data)
+	}
+
+	if opts.Create && opts.NewTable == "" {
+		return errors.New("新しいテーブル名を入力してください")
+	}
+	if !opts.Create && opts.Table == "" {
+		return errors.New("インポート先のテーブルを選択してください")
+	}
+	if opts.comma() == utf8.RuneError || opts.comma() == '"' {
+		return errors.New("区切り文字が不正です")
+	}
+
+	token, err := saveImportUpload(src, filepath.Base(fh.Filename))
+	if err != nil {
+		return errors.New("ファイルの保存エラー: " + err.Error())
+	}
+
+	if err := showImportMapping(dbConn, dbName, opts, token, data); err != nil {
+		removeImportUpload(token)
+		return err
+	}
+	return nil
+}
+
+// showImportMapping prepares the preview and column mapping of a stored CSV file
+func showImportMapping(dbConn *db.Conn, dbName string, opts importOptions, token string, data map[string]interface{}) error {
+	upload, found := getImportUpload(token)
+	if !found {
+		return errors.New("アップロードされたファイルが見つかりません。もう一度アップロードしてください")
+	}
+
+	var tableColumns []db.ColumnInfo
+	if !opts.Create {
+		var err error
+		tableColumns, err = db.GetTableColumns(dbConn, dbName, opts.Table)
+		if err != nil {
+			return errors.New("カラム情報の取得エラー: " + err.Error())
+		}
+	}
+
+	mappings, preview, err := previewCSV(upload.Path, opts, tableColumns)
+	if err != nil {
+		return err
+	}
+
+	data["Step"] = "map"
+	data["Token"] = token
+	data["Filename"] = upload.Filename
+	data["TableColumns"] = tableColumns
+	data["Mappings"] = mappings
+	data["PreviewRows"] = preview
+	return nil
+}
+
+// previewCSV reads the start of a CSV file and suggests a mapping for each of
+// its columns: matching names or positions for an existing table, header
+// names and inferred types for a new one
+func previewCSV(path string, opts importOptions, tableColumns []db.ColumnInfo) ([]importMapping, [][]string, error) {
+	r, f, err := opts.openCSV(path)
+	if err != nil {
+		return nil, nil, errors.New("ファイルの読み込みエラー: " + err.Error())
+	}
+	defer f.Close()
+
+	var header []string
+	var rows [][]string
+	width := 0
+	for len(rows) < importSampleRows {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			// Reported per row by the import
+			continue
+		}
+		if err != nil {
+			return nil, nil, errors.New("ファイルの読み込みエラー: " + err.Error())
+		}
+		if header == nil && opts.Header {
+			header = record
+			width = len(record)
+			continue
+		}
+		if len(record) > width {
+			width = len(record)
+		}
+		rows = append(rows, record)
+	}
+	if width == 0 {
+		return nil, nil, errors.New("CSVファイルが空です")
+	}
+
+	mappings := make([]importMapping, width)
+	for i := range mappings {
+		m := importMapping{Index: i, Header: fmt.Sprintf("column%d", i+1)}
+		if i < len(header) && strings.TrimSpace(header[i]) != "" {
+			m.Header = strings.TrimSpace(header[i])
+		}
+
+		if opts.Create {
+			m.Column = m.Header
+			samples := make([]string, 0, len(rows))
+			for _, row := range rows {
+				if i < len(row) {
+					samples = append(samples, row[i])
+				}
+			}
+			m.Type = db.InferColumnType(samples)
+		} else if opts.Header {
+			for _, col := range tableColumns {
+				if strings.EqualFold(col.Field, m.Header) {
+					m.Column = col.Field
+					break
+				}
+			}
+		} else if i < len(tableColumns) {
+			m.Column = tableColumns[i].Field
+		}
+
+		mappings[i] = m
+	}
+
+	if len(rows) > importPreviewRows {
+		rows = rows[:importPreviewRows]
+	}
+	return mappings, rows, nil
+}
+
+// importCSV loads a stored CSV file into the target table, creating the
+// table first when requested
+func importCSV(c echo.Context, server config.ServerConfig, dbConn *db.Conn, dbName string, opts importOptions, data map[string]interface{}) error {
+	token := c.FormValue("token")
+	upload, found := getImportUpload(token)
+	if !found {
+		return errors.New("アップロードされたファイルが見つかりません。もう一度アップロードしてください")
+	}
+
+	// One target column per CSV column, empty to skip it
+	form := c.Request().Form
+	targets := form["column"]
+	types := form["type"]
+
+	var columns []string
+	var indexes []int
+	var newColumns []db.ColumnEdit
+	seen := make(map[string]bool)
+	for i, target := range targets {
+		target = strings.TrimSpace(target)
+		if target == "" {
+			continue
+		}
+		if seen[strings.ToLower(target)] {
+			return fmt.Errorf("カラム %s が複数回指定されています", target)
+		}
+		seen[strings.ToLower(target)] = true
+
+		columns = append(columns, target)
+		indexes = append(indexes, i)
+		if opts.Create {
+			colType := ""
+			if i < len(types) {
+				colType = strings.TrimSpace(types[i])
+			}
+			newColumns = append(newColumns, db.ColumnEdit{Name: target, Type: colType, Nullable: true})
+		}
+	}
+	if len(columns) == 0 {
+		return errors.New("インポートするカラムが選択されていません")
+	}
+
+	if !opts.Create {
+		tableColumns, err := db.GetTableColumns(dbConn, dbName, opts.Table)
+		if err != nil {
+			return errors.New("カラム情報の取得エラー: " + err.Error())
+		}
+		exists := make(map[string]bool, len(tableColumns))
+		for _, col := range tableColumns {
+			exists[col.Field] = true
+		}
+		for _, col := range columns {
+			if !exists[col] {
+				return fmt.Errorf("カラム %s はテーブル %s にありません", col, opts.Table)
+			}
+		}
+	}
+
+	importConn, err := db.OpenDatabase(server, dbName)
+	if err != nil {
+		return errors.New("データベース接続エラー: " + err.Error())
+	}
+	defer importConn.Close()
+	auditImportConn(c, importConn, server.ID, dbName, upload.Filename)
+
+	if opts.Create {
+		stmt, err := db.CreateTableStatement(importConn, opts.NewTable, newColumns)
+		if err != nil {
+			return errors.New("テーブル作成エラー: " + err.Error())
+		}
+		data["CreateStatement"] = stmt
+		results, err := db.ExecuteStatements(c.Request().Context(), importConn, []string{stmt})
+		if err == nil && results[0].Error != "" {
+			err = errors.New(results[0].Error)
+		}
+		if err != nil {
+			return errors.New("テーブル作成エラー: " + err.Error())
+		}
+	}
+
+	r, f, err := opts.openCSV(upload.Path)
+	if err != nil {
+		return errors.New("ファイルの読み込みエラー: " + err.Error())
+	}
+	defer f.Close()
+
+	if opts.Header {
+		if _, err := r.Read(); err != nil && err != io.EOF {
+			return fmt.Errorf("CSVの解析エラー: %v", err)
+		}
+	}
+
+	next := func() (int, []*string, error) {
+		record, err := r.Read()
+		if err != nil {
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				return parseErr.StartLine, nil, &db.ImportRowError{Line: parseErr.StartLine, Message: parseErr.Err.Error()}
+			}
+			return 0, nil, err
+		}
+		line, _ := r.FieldPos(0)
+
+		values := make([]*string, len(indexes))
+		for i, index := range indexes {
+			if index >= len(record) {
+				return line, nil, &db.ImportRowError{Line: line, Message: fmt.Sprintf("%d fields, expected at least %d", len(record), index+1)}
+			}
+			if record[index] == "" && opts.EmptyNull {
+				continue
+			}
+			values[i] = &record[index]
+		}
+		return line, values, nil
+	}
+
+	start := time.Now()
+	result, err := db.ImportRows(c.Request().Context(), importConn, opts.TargetTable(), columns, next, opts.BatchSize)
+	if result != nil {
+		data["Step"] = "result"
+		data["Filename"] = upload.Filename
+		data["Result"] = result
+		data["Elapsed"] = time.Since(start).Round(time.Millisecond).String()
+		data["MaxImportErrors"] = db.MaxImportErrors
+	}
+	removeImportUpload(token)
+	if err != nil {
+		return errors.New("インポートエラー: " + err.Error())
+	}
+
+	return nil
+}
+
+// importSQL runs an uploaded SQL file on the database. Execution stops at
+// the first failing statement, like the SQL console.
+func importSQL(c echo.Context, server config.ServerConfig, dbName string, opts importOptions, src io.Reader, data map[string]interface{}) error {
+	script, err := io.ReadAll(opts.decode(src))
+	if err != nil {
+		return errors.New("ファイルの読み込みエラー: " + err.Error())
+	}
+
+	dbConn, err := db.OpenDatabase(server, dbName)
+	if err != nil {
+		return errors.New("データベース接続エラー: " + err.Error())
+	}
+	defer dbConn.Close()
+	auditConn(c, dbConn, server.ID, dbName, audit.ActionImport)
+
+	start := time.Now()
+	results, err := db.ExecuteSQL(c.Request().Context(), dbConn, string(script))
+	if err != nil {
+		return errors.New("データベース接続エラー: " + err.Error())
+	}
+
+	var executed int
+	var affected int64
+	var failed *db.StatementResult
+	for i := range results {
+		if results[i].Error != "" {
+			failed = &results[i]
+			break
+		}
+		executed++
+		affected += results[i].RowsAffected
+	}
+
+	data["Step"] = "result"
+	data["SQLExecuted"] = executed
+	data["SQLRowsAffected"] = affected
+	data["SQLFailed"] = failed
+	data["Elapsed"] = time.Since(start).Round(time.Millisecond).String()
+	return nil
+}
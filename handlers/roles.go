@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"godbadmin/auth"
+	"godbadmin/config"
+	"godbadmin/i18n"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// requireRole returns a 403 error unless the logged-in user has at least the
+// given role on the server
+func requireRole(c echo.Context, serverID string, role config.Role) error {
+	if auth.CurrentUser(c).Can(serverID, role) {
+		return nil
+	}
+	return echo.NewHTTPError(http.StatusForbidden, i18n.T(c, "error_forbidden"))
+}
+
+// requireServerAdmin returns a 403 error unless the logged-in user is an
+// administrator account, which may add servers
+func requireServerAdmin(c echo.Context) error {
+	if user := auth.CurrentUser(c); user != nil && user.Admin {
+		return nil
+	}
+	return echo.NewHTTPError(http.StatusForbidden, i18n.T(c, "error_forbidden"))
+}
+
+// forbiddenJSON is the API response when the role is missing
+func forbiddenJSON(c echo.Context) error {
+	return c.JSON(http.StatusForbidden, map[string]interface{}{
+		"success": false,
+		"error":   "Permission denied",
+	})
+}
+
+// visibleServers returns the servers the logged-in user has a role on
+func visibleServers(c echo.Context, servers []config.ServerConfig) []config.ServerConfig {
+	user := auth.CurrentUser(c)
+	visible := make([]config.ServerConfig, 0, len(servers))
+	for _, server := range servers {
+		if user.Can(server.ID, config.RoleViewer) {
+			visible = append(visible, server)
+		}
+	}
+	return visible
+}
@@ -1,26 +1,125 @@
 package handlers
 
 import (
+	"errors"
+	"godbadmin/auth"
 	"godbadmin/config"
 	"godbadmin/db"
 	"godbadmin/i18n"
+	"godbadmin/redact"
+	"maps"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/google/uuid"
 	"github.com/labstack/echo/v4"
 	i18nlib "github.com/nicksnyder/go-i18n/v2/i18n"
 )
 
-const settingsFile = "settings.json"
+// SettingsFile is where server changes are saved, set from the options at
+// startup
+var SettingsFile = "settings.json"
+
+// serverRequest is the JSON body of the connection APIs: the fields of the
+// server form, named as in settings.json. The form leaves the secrets of a
+// saved server blank, so they are taken from the server named by id.
+type serverRequest struct {
+	config.ServerConfig
+	ClearPassword bool `json:"clear_password"`
+}
+
+// server returns the settings to connect with, without an ID so the
+// connection is not mistaken for the saved server's.
+func (r serverRequest) server(c echo.Context) (config.ServerConfig, error) {
+	server := r.ServerConfig
+	if server.ID != "" {
+		saved, found := config.GetSettings().GetServer(server.ID)
+		if !found || !auth.CurrentUser(c).Can(server.ID, config.RoleAdmin) {
+			return server, errors.New("Server not found")
+		}
+		if err := keepSecrets(&server, *saved, r.ClearPassword); err != nil {
+			return server, err
+		}
+	}
+	server.ID = ""
+	return server, nil
+}
+
+// saveSettings writes settings.json. When another program changed the file,
+// its content is reloaded instead and the user has to repeat the change.
+func saveSettings(settings *config.Settings) error {
+	err := settings.Save(SettingsFile)
+	if errors.Is(err, config.ErrSettingsChanged) {
+		return echo.NewHTTPError(http.StatusConflict, "settings.jsonが他のプログラムで変更されたため保存しませんでした。最新の設定を確認してもう一度操作してください ("+err.Error()+")")
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	return nil
+}
+
+// errRetypeSecrets is returned when the server form changes where a saved
+// server connects to but leaves its secrets blank
+var errRetypeSecrets = errors.New("接続先が変更されたため、保存済みのパスワードは使えません。パスワードを入力し直してください")
+
+// keepSecrets takes the secrets left blank in the server form from the saved
+// server. The database password is only emptied when asked to. Secrets are
+// only reused for the same target, so changing the host, a DSN parameter
+// such as host or hostaddr, or how the target is verified cannot send them to
+// another machine.
+func keepSecrets(server *config.ServerConfig, saved config.ServerConfig, clearPassword bool) error {
+	if server.DBType == "sqlite" {
+		return nil
+	}
+	sameTarget := server.DBType == saved.DBType &&
+		server.Host == saved.Host &&
+		server.Port == saved.Port &&
+		server.Socket == saved.Socket &&
+		server.User == saved.User &&
+		maps.Equal(server.Params, saved.Params) &&
+		server.TLSMode == saved.TLSMode &&
+		server.TLSCACert == saved.TLSCACert &&
+		server.TLSClientCert == saved.TLSClientCert &&
+		server.TLSClientKey == saved.TLSClientKey &&
+		server.SSHHost == saved.SSHHost &&
+		server.SSHPort == saved.SSHPort &&
+		server.SSHUser == saved.SSHUser &&
+		server.SSHKeyFile == saved.SSHKeyFile &&
+		server.SSHKnownHosts == saved.SSHKnownHosts &&
+		server.SSHSkipHostKeyCheck == saved.SSHSkipHostKeyCheck
+
+	keep := func(secret *string, savedSecret string) error {
+		if *secret != "" || savedSecret == "" {
+			return nil
+		}
+		if !sameTarget {
+			return errRetypeSecrets
+		}
+		*secret = savedSecret
+		return nil
+	}
+
+	if !clearPassword {
+		if err := keep(&server.Password, saved.Password); err != nil {
+			return err
+		}
+	}
+	if server.SSHHost == "" {
+		return nil
+	}
+	if err := keep(&server.SSHPassword, saved.SSHPassword); err != nil {
+		return err
+	}
+	return keep(&server.SSHKeyPassphrase, saved.SSHKeyPassphrase)
+}
 
 func TestConnectionAPI(c echo.Context) error {
-	var req struct {
-		Host     string `json:"host"`
-		Port     int    `json:"port"`
-		User     string `json:"user"`
-		Password string `json:"password"`
-		DBType   string `json:"db_type"`
+	var req serverRequest
+
+	// Connections are tested from the server form
+	if !auth.CurrentUser(c).ManagesAnyServer() {
+		return forbiddenJSON(c)
 	}
 
 	if err := c.Bind(&req); err != nil {
@@ -30,8 +129,16 @@ func TestConnectionAPI(c echo.Context) error {
 		})
 	}
 
+	server, err := req.server(c)
+	if err != nil {
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		})
+	}
+
 	// Try to connect to the database
-	dbConn, err := db.ConnectWithoutDB(req.Host, req.Port, req.User, req.Password)
+	dbConn, err := db.ConnectWithoutDB(server)
 	if err != nil {
 		return c.JSON(http.StatusOK, map[string]interface{}{
 			"success": false,
@@ -44,7 +151,7 @@ func TestConnectionAPI(c echo.Context) error {
 	if err := dbConn.Ping(); err != nil {
 		return c.JSON(http.StatusOK, map[string]interface{}{
 			"success": false,
-			"error":   err.Error(),
+			"error":   redact.String(err.Error(), server.Secrets()...),
 		})
 	}
 
@@ -53,20 +160,44 @@ func TestConnectionAPI(c echo.Context) error {
 	})
 }
 
+// GetDatabasesAPI lists the databases of a saved server when the body only
+// has its id, or of the settings being edited in the server form.
 func GetDatabasesAPI(c echo.Context) error {
-	host := c.QueryParam("host")
-	portStr := c.QueryParam("port")
-	user := c.QueryParam("user")
-	password := c.QueryParam("password")
+	var req serverRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"success":   false,
+			"error":     "Invalid request: " + err.Error(),
+			"databases": []string{},
+		})
+	}
 
-	port := 3306
-	if portStr != "" {
-		if p, err := strconv.Atoi(portStr); err == nil {
-			port = p
+	var server config.ServerConfig
+	var dbConn *db.Conn
+	var err error
+	if req.ID != "" && req.Host == "" {
+		if !auth.CurrentUser(c).Can(req.ID, config.RoleViewer) {
+			return forbiddenJSON(c)
+		}
+		saved, found := config.GetSettings().GetServer(req.ID)
+		if !found {
+			return c.JSON(http.StatusOK, map[string]interface{}{
+				"success":   false,
+				"error":     "Server not found",
+				"databases": []string{},
+			})
+		}
+		server = *saved
+		dbConn, err = db.Open(server)
+	} else {
+		if !auth.CurrentUser(c).ManagesAnyServer() {
+			return forbiddenJSON(c)
+		}
+		server, err = req.server(c)
+		if err == nil {
+			dbConn, err = db.ConnectWithoutDB(server)
 		}
 	}
-
-	dbConn, err := db.ConnectWithoutDB(host, port, user, password)
 	if err != nil {
 		return c.JSON(http.StatusOK, map[string]interface{}{
 			"success":   false,
@@ -80,7 +211,7 @@ func GetDatabasesAPI(c echo.Context) error {
 	if err != nil {
 		return c.JSON(http.StatusOK, map[string]interface{}{
 			"success":   false,
-			"error":     err.Error(),
+			"error":     redact.String(err.Error(), server.Secrets()...),
 			"databases": []string{},
 		})
 	}
@@ -98,7 +229,7 @@ func GetDatabasesAPI(c echo.Context) error {
 
 func ServersPage(c echo.Context) error {
 	settings := config.GetSettings()
-	servers := settings.GetServers()
+	servers := visibleServers(c, settings.GetServers())
 	selectedID := c.QueryParam("selected")
 
 	var selectedServer *config.ServerConfig
@@ -106,17 +237,17 @@ func ServersPage(c echo.Context) error {
 	var errorMsg string
 
 	// If a server is selected, get its databases
-	if selectedID != "" {
+	if selectedID != "" && auth.CurrentUser(c).Can(selectedID, config.RoleViewer) {
 		server, found := settings.GetServer(selectedID)
 		if found {
 			selectedServer = server
 
 			// Try to connect and get databases
-			dbConn, err := db.ConnectWithoutDB(server.Host, server.Port, server.User, server.Password)
+			dbConn, err := db.Open(*server)
 			if err != nil {
 				errorMsg = "データベース接続エラー: " + err.Error()
 			} else {
-				databases, err = db.GetAllDatabases(dbConn)
+				databases, err = db.CachedDatabases(dbConn)
 				if err != nil {
 					errorMsg = "データベース一覧の取得エラー: " + err.Error()
 				}
@@ -137,8 +268,11 @@ func ServersPage(c echo.Context) error {
 }
 
 func AddServerPage(c echo.Context) error {
+	if err := requireServerAdmin(c); err != nil {
+		return err
+	}
 	settings := config.GetSettings()
-	servers := settings.GetServers()
+	servers := visibleServers(c, settings.GetServers())
 
 	localizer := c.Get("localizer").(*i18nlib.Localizer)
 	return c.Render(http.StatusOK, "server_form.html", map[string]interface{}{
@@ -147,6 +281,8 @@ func AddServerPage(c echo.Context) error {
 		"Server":     nil,
 		"Servers":    servers,
 		"Databases":  nil,
+		"Pool":       poolDefaults,
+		"TLSModes":   config.TLSModes,
 		"Context":    c,
 		"Lang":       i18n.GetCurrentLang(c),
 		"ActiveMenu": "servers",
@@ -155,6 +291,9 @@ func AddServerPage(c echo.Context) error {
 
 func EditServerPage(c echo.Context) error {
 	id := c.Param("id")
+	if err := requireRole(c, id, config.RoleAdmin); err != nil {
+		return err
+	}
 	settings := config.GetSettings()
 
 	server, found := settings.GetServer(id)
@@ -162,7 +301,7 @@ func EditServerPage(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusNotFound, "Server not found")
 	}
 
-	servers := settings.GetServers()
+	servers := visibleServers(c, settings.GetServers())
 
 	localizer := c.Get("localizer").(*i18nlib.Localizer)
 	return c.Render(http.StatusOK, "server_form.html", map[string]interface{}{
@@ -170,13 +309,107 @@ func EditServerPage(c echo.Context) error {
 		"Action":     "/servers/" + id,
 		"Server":     server,
 		"Servers":    servers,
+		"Pool":       poolDefaults,
+		"TLSModes":   config.TLSModes,
 		"Context":    c,
 		"Lang":       i18n.GetCurrentLang(c),
 		"ActiveMenu": "servers",
 	})
 }
 
+// poolDefaults fills the placeholders of the connection pool fields
+var poolDefaults = map[string]int{
+	"MaxOpenConns": config.DefaultMaxOpenConns,
+	"MaxIdleConns": config.DefaultMaxIdleConns,
+	"IdleTimeout":  config.DefaultIdleTimeout,
+}
+
+// setPoolLimits reads the optional connection pool limits of the server
+// form. Empty or invalid fields use the defaults.
+func setPoolLimits(c echo.Context, server *config.ServerConfig) {
+	limit := func(name string) int {
+		n, err := strconv.Atoi(c.FormValue(name))
+		if err != nil || n < 0 {
+			return 0
+		}
+		return n
+	}
+	server.MaxOpenConns = limit("max_open_conns")
+	server.MaxIdleConns = limit("max_idle_conns")
+	server.IdleTimeout = limit("idle_timeout")
+}
+
+// setConnectionOptions reads the optional connection options of the server
+// form. Extra parameters are given one key=value per line.
+func setConnectionOptions(c echo.Context, server *config.ServerConfig) {
+	seconds := func(name string) int {
+		n, err := strconv.Atoi(c.FormValue(name))
+		if err != nil || n < 0 {
+			return 0
+		}
+		return n
+	}
+
+	if server.DBType != "sqlite" {
+		server.Socket = strings.TrimSpace(c.FormValue("socket"))
+		server.ConnectTimeout = seconds("connect_timeout")
+		server.ReadTimeout = seconds("read_timeout")
+		server.WriteTimeout = seconds("write_timeout")
+		server.Charset = strings.TrimSpace(c.FormValue("charset"))
+		server.Collation = strings.TrimSpace(c.FormValue("collation"))
+		server.TimeZone = strings.TrimSpace(c.FormValue("time_zone"))
+	}
+
+	for _, line := range strings.Split(c.FormValue("params"), "\n") {
+		key, value, found := strings.Cut(strings.TrimSpace(line), "=")
+		key = strings.TrimSpace(key)
+		if !found || key == "" {
+			continue
+		}
+		if server.Params == nil {
+			server.Params = make(map[string]string)
+		}
+		server.Params[key] = strings.TrimSpace(value)
+	}
+}
+
+// setTLS reads the TLS settings of the server form. Unknown modes disable TLS.
+func setTLS(c echo.Context, server *config.ServerConfig) {
+	server.TLSMode = config.TLSDisabled
+	for _, mode := range config.TLSModes {
+		if c.FormValue("tls_mode") == mode {
+			server.TLSMode = mode
+		}
+	}
+	if server.DBType == "sqlite" || server.TLSMode == config.TLSDisabled {
+		server.TLSMode = ""
+		return
+	}
+	server.TLSCACert = c.FormValue("tls_ca_cert")
+	server.TLSClientCert = c.FormValue("tls_client_cert")
+	server.TLSClientKey = c.FormValue("tls_client_key")
+}
+
+// setSSHTunnel reads the optional SSH tunnel settings of the server form.
+// SQLite servers are local files and never use one.
+func setSSHTunnel(c echo.Context, server *config.ServerConfig) {
+	if server.DBType == "sqlite" || c.FormValue("ssh_host") == "" {
+		return
+	}
+	server.SSHHost = c.FormValue("ssh_host")
+	server.SSHPort, _ = strconv.Atoi(c.FormValue("ssh_port"))
+	server.SSHUser = c.FormValue("ssh_user")
+	server.SSHPassword = c.FormValue("ssh_password")
+	server.SSHKeyFile = c.FormValue("ssh_key_file")
+	server.SSHKeyPassphrase = c.FormValue("ssh_key_passphrase")
+	server.SSHKnownHosts = c.FormValue("ssh_known_hosts")
+	server.SSHSkipHostKeyCheck = c.FormValue("ssh_skip_host_key_check") == "on"
+}
+
 func CreateServer(c echo.Context) error {
+	if err := requireServerAdmin(c); err != nil {
+		return err
+	}
 	settings := config.GetSettings()
 
 	server := config.ServerConfig{
@@ -190,17 +423,25 @@ func CreateServer(c echo.Context) error {
 	}
 
 	// Parse port
-	port := 3306
+	port := db.DefaultPort(server.DBType)
 	if portStr := c.FormValue("port"); portStr != "" {
 		if p, err := strconv.Atoi(portStr); err == nil {
 			port = p
 		}
 	}
+	if server.DBType == "sqlite" {
+		// SQLite servers are a file path without a port
+		port = 0
+	}
 	server.Port = port
+	setPoolLimits(c, &server)
+	setConnectionOptions(c, &server)
+	setTLS(c, &server)
+	setSSHTunnel(c, &server)
 
 	settings.AddServer(server)
-	if err := settings.Save(settingsFile); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	if err := saveSettings(settings); err != nil {
+		return err
 	}
 
 	return c.Redirect(http.StatusSeeOther, "/servers")
@@ -208,8 +449,16 @@ func CreateServer(c echo.Context) error {
 
 func UpdateServer(c echo.Context) error {
 	id := c.Param("id")
+	if err := requireRole(c, id, config.RoleAdmin); err != nil {
+		return err
+	}
 	settings := config.GetSettings()
 
+	saved, found := settings.GetServer(id)
+	if !found {
+		return echo.NewHTTPError(http.StatusNotFound, "Server not found")
+	}
+
 	server := config.ServerConfig{
 		ID:       id,
 		Name:     c.FormValue("name"),
@@ -220,34 +469,58 @@ func UpdateServer(c echo.Context) error {
 		Database: "", // No longer use database field from form
 	}
 
-	port := 3306
+	port := db.DefaultPort(server.DBType)
 	if portStr := c.FormValue("port"); portStr != "" {
 		if p, err := strconv.Atoi(portStr); err == nil {
 			port = p
 		}
 	}
+	if server.DBType == "sqlite" {
+		// SQLite servers are a file path without a port
+		port = 0
+	}
 	server.Port = port
+	setPoolLimits(c, &server)
+	setConnectionOptions(c, &server)
+	setTLS(c, &server)
+	setSSHTunnel(c, &server)
+	// The form does not show the stored secrets
+	if err := keepSecrets(&server, *saved, c.FormValue("clear_password") == "on"); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
 
 	if !settings.UpdateServer(id, server) {
 		return echo.NewHTTPError(http.StatusNotFound, "Server not found")
 	}
 
-	if err := settings.Save(settingsFile); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	if err := saveSettings(settings); err != nil {
+		return err
 	}
+	db.Invalidate(id)
 
 	return c.Redirect(http.StatusSeeOther, "/servers")
 }
 
 func DeleteServer(c echo.Context) error {
 	id := c.Param("id")
+	if err := requireRole(c, id, config.RoleAdmin); err != nil {
+		return err
+	}
 	settings := config.GetSettings()
 
 	if !settings.DeleteServer(id) {
 		return echo.NewHTTPError(http.StatusNotFound, "Server not found")
 	}
 
-	if err := settings.Save(settingsFile); err != nil {
+	if err := saveSettings(settings); err != nil {
+		return err
+	}
+	db.Invalidate(id)
+
+	// Roles on the deleted server would otherwise apply to nothing
+	users := config.GetUsers()
+	users.RemoveServer(id)
+	if err := users.Save(UsersFile); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 	}
 
@@ -256,6 +529,9 @@ func DeleteServer(c echo.Context) error {
 
 func ServerInfoPage(c echo.Context) error {
 	id := c.Param("id")
+	if err := requireRole(c, id, config.RoleViewer); err != nil {
+		return err
+	}
 	settings := config.GetSettings()
 
 	server, found := settings.GetServer(id)
@@ -263,7 +539,7 @@ func ServerInfoPage(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusNotFound, "Server not found")
 	}
 
-	dbConn, err := db.ConnectWithoutDB(server.Host, server.Port, server.User, server.Password)
+	dbConn, err := db.Open(*server)
 	if err != nil {
 		return c.Render(http.StatusOK, "server_info.html", map[string]interface{}{
 			"Server":     server,
@@ -300,6 +576,9 @@ func ServerInfoPage(c echo.Context) error {
 
 func UserPrivilegesPage(c echo.Context) error {
 	id := c.Param("id")
+	if err := requireRole(c, id, config.RoleAdmin); err != nil {
+		return err
+	}
 	settings := config.GetSettings()
 
 	server, found := settings.GetServer(id)
@@ -307,7 +586,7 @@ func UserPrivilegesPage(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusNotFound, "Server not found")
 	}
 
-	dbConn, err := db.ConnectWithoutDB(server.Host, server.Port, server.User, server.Password)
+	dbConn, err := db.Open(*server)
 	if err != nil {
 		return c.Render(http.StatusOK, "user_privileges.html", map[string]interface{}{
 			"Server":         server,
@@ -347,13 +626,18 @@ func GetUserGrantsAPI(c echo.Context) error {
 	user := c.QueryParam("user")
 	host := c.QueryParam("host")
 
-	if serverID == "" || user == "" || host == "" {
+	// host is empty for servers without host-based accounts (PostgreSQL)
+	if serverID == "" || user == "" {
 		return c.JSON(http.StatusOK, map[string]interface{}{
 			"success": false,
 			"error":   "Missing parameters",
 		})
 	}
 
+	if !auth.CurrentUser(c).Can(serverID, config.RoleAdmin) {
+		return forbiddenJSON(c)
+	}
+
 	settings := config.GetSettings()
 	server, found := settings.GetServer(serverID)
 	if !found {
@@ -363,7 +647,7 @@ func GetUserGrantsAPI(c echo.Context) error {
 		})
 	}
 
-	dbConn, err := db.ConnectWithoutDB(server.Host, server.Port, server.User, server.Password)
+	dbConn, err := db.Open(*server)
 	if err != nil {
 		return c.JSON(http.StatusOK, map[string]interface{}{
 			"success": false,
@@ -0,0 +1,149 @@
+package handlers
+
+import (
+	"godbadmin/config"
+	"maps"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"testing"
+)
+
+func TestKeepSecrets(t *testing.T) {
+	saved := config.ServerConfig{
+		ID: "s1", DBType: "mysql", Host: "db.internal", Port: 3306, User: "app", Password: "db-secret",
+		SSHHost: "bastion", SSHPort: 22, SSHUser: "tunnel", SSHPassword: "ssh-secret",
+		SSHKeyFile: "~/.ssh/id_ed25519", SSHKeyPassphrase: "key-secret",
+		Params: map[string]string{"tls": "preferred"}, TLSMode: "require",
+	}
+
+	tests := []struct {
+		name          string
+		edit          func(*config.ServerConfig)
+		clearPassword bool
+		want          config.ServerConfig
+		wantErr       bool
+	}{
+		{
+			name: "same target keeps the secrets",
+			edit: func(s *config.ServerConfig) { s.Name = "renamed" },
+			want: config.ServerConfig{Password: "db-secret", SSHPassword: "ssh-secret", SSHKeyPassphrase: "key-secret"},
+		},
+		{
+			name: "typed secrets win",
+			edit: func(s *config.ServerConfig) { s.Password, s.SSHPassword = "new-db", "new-ssh" },
+			want: config.ServerConfig{Password: "new-db", SSHPassword: "new-ssh", SSHKeyPassphrase: "key-secret"},
+		},
+		{
+			name:          "clear password",
+			edit:          func(s *config.ServerConfig) {},
+			clearPassword: true,
+			want:          config.ServerConfig{SSHPassword: "ssh-secret", SSHKeyPassphrase: "key-secret"},
+		},
+		{name: "changed host", edit: func(s *config.ServerConfig) { s.Host = "evil.example.com" }, wantErr: true},
+		{name: "changed port", edit: func(s *config.ServerConfig) { s.Port = 3307 }, wantErr: true},
+		{name: "changed socket", edit: func(s *config.ServerConfig) { s.Socket = "/tmp/mysql.sock" }, wantErr: true},
+		{name: "changed user", edit: func(s *config.ServerConfig) { s.User = "root" }, wantErr: true},
+		{name: "changed type", edit: func(s *config.ServerConfig) { s.DBType = "postgresql" }, wantErr: true},
+		{name: "changed SSH host", edit: func(s *config.ServerConfig) { s.SSHHost = "other-bastion" }, wantErr: true},
+		{name: "changed SSH user", edit: func(s *config.ServerConfig) { s.SSHUser = "root" }, wantErr: true},
+		{name: "changed SSH key", edit: func(s *config.ServerConfig) { s.SSHKeyFile = "/tmp/key" }, wantErr: true},
+		{name: "changed SSH known hosts", edit: func(s *config.ServerConfig) { s.SSHKnownHosts = "/tmp/known_hosts" }, wantErr: true},
+		{name: "SSH host key check skipped", edit: func(s *config.ServerConfig) { s.SSHSkipHostKeyCheck = true }, wantErr: true},
+		{name: "host parameter", edit: func(s *config.ServerConfig) {
+			s.Params = map[string]string{"tls": "preferred", "host": "evil.example.com"}
+		}, wantErr: true},
+		{name: "changed parameter", edit: func(s *config.ServerConfig) { s.Params = map[string]string{"tls": "false"} }, wantErr: true},
+		{name: "changed TLS mode", edit: func(s *config.ServerConfig) { s.TLSMode = "disable" }, wantErr: true},
+		{name: "changed TLS CA", edit: func(s *config.ServerConfig) { s.TLSCACert = "/tmp/ca.pem" }, wantErr: true},
+		{name: "changed TLS client key", edit: func(s *config.ServerConfig) { s.TLSClientKey = "/tmp/key.pem" }, wantErr: true},
+		{
+			name: "changed host with new secrets",
+			edit: func(s *config.ServerConfig) {
+				s.Host, s.Password, s.SSHPassword, s.SSHKeyPassphrase = "db2.internal", "p1", "p2", "p3"
+			},
+			want: config.ServerConfig{Password: "p1", SSHPassword: "p2", SSHKeyPassphrase: "p3"},
+		},
+		{
+			name: "changed host with the password cleared",
+			edit: func(s *config.ServerConfig) {
+				s.Host, s.SSHHost = "db2.internal", ""
+			},
+			clearPassword: true,
+			want:          config.ServerConfig{},
+		},
+		{
+			name: "SSH tunnel removed",
+			edit: func(s *config.ServerConfig) { s.SSHHost, s.SSHUser, s.SSHKeyFile = "", "", "" },
+			// The database password would go to the same host without the tunnel
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := saved
+			server.Params = maps.Clone(saved.Params)
+			server.Password, server.SSHPassword, server.SSHKeyPassphrase = "", "", ""
+			tt.edit(&server)
+
+			err := keepSecrets(&server, saved, tt.clearPassword)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("keepSecrets() kept %q, %q, %q, want an error", server.Password, server.SSHPassword, server.SSHKeyPassphrase)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("keepSecrets() error = %v", err)
+			}
+			if server.Password != tt.want.Password || server.SSHPassword != tt.want.SSHPassword || server.SSHKeyPassphrase != tt.want.SSHKeyPassphrase {
+				t.Errorf("secrets = %q, %q, %q, want %q, %q, %q", server.Password, server.SSHPassword, server.SSHKeyPassphrase,
+					tt.want.Password, tt.want.SSHPassword, tt.want.SSHKeyPassphrase)
+			}
+		})
+	}
+
+	sqlite := config.ServerConfig{DBType: "sqlite", Host: "/tmp/other.db"}
+	if err := keepSecrets(&sqlite, saved, false); err != nil || sqlite.Password != "" {
+		t.Errorf("keepSecrets() on SQLite = %q, %v, want nothing kept", sqlite.Password, err)
+	}
+}
+
+func TestCreateServerDefaultPort(t *testing.T) {
+	defer func(filename string) { SettingsFile = filename }(SettingsFile)
+	SettingsFile = filepath.Join(t.TempDir(), "settings.json")
+
+	tests := []struct {
+		dbType string
+		port   string
+		want   int
+	}{
+		{"mysql", "", 3306},
+		{"postgresql", "", 5432},
+		{"postgresql", "6432", 6432},
+		{"sqlite", "5432", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.dbType+" "+tt.port, func(t *testing.T) {
+			name := "port test " + tt.dbType + tt.port
+			form := url.Values{"name": {name}, "db_type": {tt.dbType}, "host": {"localhost"}, "port": {tt.port}}
+			rec, _ := serve(CreateServer, http.MethodPost, "/servers", "/servers", form, testAdmin)
+			if rec.Code != http.StatusSeeOther {
+				t.Fatalf("status %d (%s)", rec.Code, rec.Body)
+			}
+
+			settings := config.GetSettings()
+			for _, server := range settings.GetServers() {
+				if server.Name == name {
+					settings.DeleteServer(server.ID)
+					if server.Port != tt.want {
+						t.Errorf("port = %d, want %d", server.Port, tt.want)
+					}
+					return
+				}
+			}
+			t.Fatal("the server was not saved")
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package handlers
+
+import (
+	"godbadmin/audit"
+	"godbadmin/auth"
+	"godbadmin/config"
+	"godbadmin/db"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// SQLPage shows the SQL console and, when SQL is posted, its results
+func SQLPage(c echo.Context) error {
+	serverID := c.Param("id")
+	dbName := c.Param("db")
+	sqlText := c.FormValue("sql")
+	settings := config.GetSettings()
+
+	if err := requireRole(c, serverID, config.RoleAdmin); err != nil {
+		return err
+	}
+
+	server, found := settings.GetServer(serverID)
+	if !found {
+		return echo.NewHTTPError(http.StatusNotFound, "Server not found")
+	}
+
+	data := map[string]interface{}{
+		"Server":               server,
+		"Error":                "",
+		"DatabasesWithTables":  nil,
+		"CurrentDatabase":      dbName,
+		"CurrentTable":         "",
+		"SQL":                  sqlText,
+		"Results":              nil,
+		"MaxRows":              db.MaxQueryRows,
+		"ActiveMenu":           "database",
+		"ShowDatabaseDropdown": true,
+		"ShowCreateDatabase":   false,
+	}
+
+	dbConn, err := db.Open(*server)
+	if err != nil {
+		data["Error"] = "データベース接続エラー: " + err.Error()
+		return c.Render(http.StatusOK, "sql.html", addI18nContext(c, data))
+	}
+	defer dbConn.Close()
+
+	dbWithTables, err := sidebarTree(dbConn, dbName)
+	if err != nil {
+		data["Error"] = "データベース一覧の取得エラー: " + err.Error()
+		return c.Render(http.StatusOK, "sql.html", addI18nContext(c, data))
+	}
+	data["DatabasesWithTables"] = dbWithTables
+
+	if c.Request().Method != http.MethodPost || sqlText == "" {
+		return c.Render(http.StatusOK, "sql.html", addI18nContext(c, data))
+	}
+
+	results, elapsed, err := executeSQL(c, *server, dbName, sqlText)
+	if err != nil {
+		data["Error"] = "データベース接続エラー: " + err.Error()
+		return c.Render(http.StatusOK, "sql.html", addI18nContext(c, data))
+	}
+	data["Results"] = results
+	data["TotalElapsed"] = float64(elapsed.Microseconds()) / 1000
+
+	return c.Render(http.StatusOK, "sql.html", addI18nContext(c, data))
+}
+
+type ExecuteSQLRequest struct {
+	ServerID string `json:"server_id"`
+	Database string `json:"database"`
+	SQL      string `json:"sql"`
+}
+
+// ExecuteSQLAPI runs SQL and returns every statement's result as JSON
+func ExecuteSQLAPI(c echo.Context) error {
+	var req ExecuteSQLRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"success": false,
+			"error":   "Invalid request",
+		})
+	}
+
+	if req.SQL == "" {
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"success": false,
+			"error":   "Missing parameters",
+		})
+	}
+
+	if !auth.CurrentUser(c).Can(req.ServerID, config.RoleAdmin) {
+		return forbiddenJSON(c)
+	}
+
+	settings := config.GetSettings()
+	server, found := settings.GetServer(req.ServerID)
+	if !found {
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"success": false,
+			"error":   "Server not found",
+		})
+	}
+
+	results, elapsed, err := executeSQL(c, *server, req.Database, req.SQL)
+	if err != nil {
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"success": false,
+			"error":   "Database connection error: " + err.Error(),
+		})
+	}
+
+	response := map[string]interface{}{
+		"success":    true,
+		"results":    results,
+		"elapsed_ns": elapsed,
+	}
+	if len(results) > 0 && results[len(results)-1].Error != "" {
+		response["success"] = false
+		response["error"] = results[len(results)-1].Error
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+// executeSQL runs a script on a connection opened to the given database, so
+// unqualified table names in the script refer to that database
+func executeSQL(c echo.Context, server config.ServerConfig, dbName, sqlText string) ([]db.StatementResult, time.Duration, error) {
+	dbConn, err := db.OpenDatabase(server, dbName)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer dbConn.Close()
+	auditConn(c, dbConn, server.ID, dbName, audit.ActionSQL)
+
+	start := time.Now()
+	results, err := db.ExecuteSQL(c.Request().Context(), dbConn, sqlText)
+	return results, time.Since(start), err
+}
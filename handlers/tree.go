@@ -0,0 +1,112 @@
+package handlers
+
+import (
+	"godbadmin/auth"
+	"godbadmin/config"
+	"godbadmin/db"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+type treeDatabase struct {
+	Name string `json:"name"`
+	// Tables is null when they were not loaded
+	Tables []string `json:"tables"`
+}
+
+func tableNames(tables []db.TableInfo) []string {
+	names := make([]string, len(tables))
+	for i, table := range tables {
+		names[i] = table.TableName
+	}
+	return names
+}
+
+// TreeAPI returns the sidebar tree of a server from the metadata cache:
+// the databases, the tables of one database (db), or every database with
+// its tables (all=1). With all=1, servers connecting to each database
+// separately leave the tables not cached yet null, to be loaded with db.
+// refresh=1 reloads the cache first.
+func TreeAPI(c echo.Context) error {
+	serverID := c.QueryParam("server_id")
+	if serverID == "" {
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"success": false,
+			"error":   "Missing parameters",
+		})
+	}
+
+	if !auth.CurrentUser(c).Can(serverID, config.RoleViewer) {
+		return forbiddenJSON(c)
+	}
+
+	server, found := config.GetSettings().GetServer(serverID)
+	if !found {
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"success": false,
+			"error":   "Server not found",
+		})
+	}
+
+	dbConn, err := db.Open(*server)
+	if err != nil {
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"success": false,
+			"error":   "Database connection error: " + err.Error(),
+		})
+	}
+	defer dbConn.Close()
+
+	if c.QueryParam("refresh") == "1" {
+		db.InvalidateMetadata(serverID)
+	}
+
+	if c.QueryParams().Has("db") {
+		tables, err := db.CachedTables(dbConn, c.QueryParam("db"))
+		if err != nil {
+			return c.JSON(http.StatusOK, map[string]interface{}{
+				"success": false,
+				"error":   err.Error(),
+			})
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"success": true,
+			"tables":  tableNames(tables),
+		})
+	}
+
+	var databases []treeDatabase
+	if c.QueryParam("all") == "1" {
+		tree, err := db.CachedTree(dbConn)
+		if err != nil {
+			return c.JSON(http.StatusOK, map[string]interface{}{
+				"success": false,
+				"error":   err.Error(),
+			})
+		}
+		for _, database := range tree {
+			entry := treeDatabase{Name: database.DatabaseName}
+			if database.Tables != nil {
+				entry.Tables = tableNames(database.Tables)
+			}
+			databases = append(databases, entry)
+		}
+	} else {
+		list, err := db.CachedDatabases(dbConn)
+		if err != nil {
+			return c.JSON(http.StatusOK, map[string]interface{}{
+				"success": false,
+				"error":   err.Error(),
+			})
+		}
+		for _, database := range list {
+			databases = append(databases, treeDatabase{Name: database.DatabaseName})
+		}
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"success":   true,
+		"databases": databases,
+	})
+}
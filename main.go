@@ -1,32 +1,72 @@
 package main
 
 import (
+	"bytes"
+	"embed"
+	"errors"
 	"flag"
 	"fmt"
+	"godbadmin/audit"
+	"godbadmin/auth"
 	"godbadmin/config"
+	"godbadmin/db"
 	"godbadmin/handlers"
 	"godbadmin/i18n"
+	"godbadmin/redact"
 	"html/template"
 	"io"
+	"io/fs"
 	"log"
 	"net"
 	"net/http"
+	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 )
 
+// templateFS holds the templates, so the binary runs from any directory
+//
+//go:embed templates/*.html
+var templateFS embed.FS
+
+// templateDir is where -dev reads the templates from
+const templateDir = "templates"
+
 type TemplateRenderer struct {
 	templates *template.Template
+	// dev parses the templates from templateDir again for every page, so
+	// edits show without a rebuild
+	dev     bool
+	funcMap template.FuncMap
 }
 
 func (t *TemplateRenderer) Render(w io.Writer, name string, data interface{}, c echo.Context) error {
-	return t.templates.ExecuteTemplate(w, name, data)
+	templates := t.templates
+	if t.dev {
+		var err error
+		if templates, err = parseTemplates(os.DirFS(templateDir), t.funcMap); err != nil {
+			return err
+		}
+	}
+	return templates.ExecuteTemplate(w, name, data)
+}
+
+func parseTemplates(fsys fs.FS, funcMap template.FuncMap) (*template.Template, error) {
+	return template.New("").Funcs(funcMap).ParseFS(fsys, "*.html")
 }
 
-func isPortAvailable(port int) bool {
-	addr := fmt.Sprintf(":%d", port)
+// csrfToken returns the token the CSRF middleware expects in posted forms
+func csrfToken(c echo.Context) string {
+	token, _ := c.Get(middleware.DefaultCSRFConfig.ContextKey).(string)
+	return token
+}
+
+func isPortAvailable(bind string, port int) bool {
+	addr := net.JoinHostPort(bind, strconv.Itoa(port))
 	listener, err := net.Listen("tcp", addr)
 	if err != nil {
 		return false
@@ -35,9 +75,9 @@ func isPortAvailable(port int) bool {
 	return true
 }
 
-func findAvailablePort(startPort int) int {
+func findAvailablePort(bind string, startPort int) int {
 	port := startPort
-	for !isPortAvailable(port) {
+	for !isPortAvailable(bind, port) {
 		log.Printf("Port %d is already in use, trying %d...", port, port+1)
 		port++
 		if port > startPort+10 {
@@ -47,17 +87,227 @@ func findAvailablePort(startPort int) int {
 	return port
 }
 
+// serverURL is the address to open in a browser for the address listened on
+func serverURL(scheme, bind string, port int) string {
+	host := bind
+	if ip := net.ParseIP(bind); bind == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "localhost"
+	}
+	return scheme + "://" + net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// certificateHosts are the names a self-signed certificate is issued for:
+// this machine and the address listened on
+func certificateHosts(bind string) []string {
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+	if hostname, err := os.Hostname(); err == nil && hostname != "localhost" {
+		hosts = append(hosts, hostname)
+	}
+	if ip := net.ParseIP(bind); bind != "" && (ip == nil || !ip.IsUnspecified() && !ip.IsLoopback()) {
+		hosts = append(hosts, bind)
+	}
+	return hosts
+}
+
+// redirectToHTTPS answers plain HTTP requests with a redirect to the same
+// page over HTTPS on port
+func redirectToHTTPS(port int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = strings.Trim(r.Host, "[]")
+		}
+		if host == "" {
+			host = "localhost"
+		}
+		hostPort := net.JoinHostPort(host, strconv.Itoa(port))
+		if port == 443 {
+			hostPort = strings.TrimSuffix(hostPort, ":443")
+		}
+		http.Redirect(w, r, "https://"+hostPort+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// ipExtractor tells the client address recorded in the logs and the audit
+// log. X-Forwarded-For is only believed from the trusted proxies, since
+// anyone else can send it.
+func ipExtractor(options config.Options) echo.IPExtractor {
+	ranges, _ := options.TrustedProxyRanges()
+	if len(ranges) == 0 {
+		return echo.ExtractIPDirect()
+	}
+	trust := []echo.TrustOption{echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false)}
+	for _, r := range ranges {
+		trust = append(trust, echo.TrustIPRange(r))
+	}
+	return echo.ExtractIPFromXFFHeader(trust...)
+}
+
+// loadOptions reads the options file, when there is one, and then the
+// environment. The flags set on the command line are applied after.
+func loadOptions(optionsFile string) (config.Options, error) {
+	options := config.DefaultOptions()
+	if optionsFile == "" {
+		optionsFile = os.Getenv(config.OptionsFileEnv)
+	}
+	if optionsFile != "" {
+		if err := options.LoadFile(optionsFile); err != nil {
+			return options, err
+		}
+	}
+	return options, options.LoadEnv()
+}
+
+// rotateKey asks for the new master password, unless it is in the
+// environment or a file, and encrypts the settings again with it.
+func rotateKey(settings *config.Settings, filename, newKeyFile string) error {
+	newPassword, err := config.MasterPassword(config.NewMasterPasswordEnv, newKeyFile)
+	if err != nil {
+		return err
+	}
+
+	if newPassword == "" {
+		if !config.CanPrompt() {
+			return fmt.Errorf("set %s or -new-master-key-file", config.NewMasterPasswordEnv)
+		}
+		newPassword, err = config.PromptPassword("New master password: ")
+		if err != nil {
+			return err
+		}
+		confirm, err := config.PromptPassword("Confirm new master password: ")
+		if err != nil {
+			return err
+		}
+		if confirm != newPassword {
+			return errors.New("the passwords do not match")
+		}
+	}
+
+	return settings.RotateKey(filename, newPassword)
+}
+
 func main() {
 	// Parse command line flags
-	portFlag := flag.Int("port", 8000, "Port to run the server on")
+	defaults := config.DefaultOptions()
+	optionsFlag := flag.String("config", "", "JSON file of the options below ($"+config.OptionsFileEnv+")")
+	dataDirFlag := flag.String("data-dir", defaults.DataDir, "Directory of settings.json, users.json and audit.jsonl ($"+config.DataDirEnv+")")
+	settingsFlag := flag.String("settings", "", "Settings file (default settings.json in the data directory, $"+config.SettingsFileEnv+")")
+	bindFlag := flag.String("bind", defaults.Bind, "Address to listen on, empty for every interface ($"+config.BindEnv+")")
+	portFlag := flag.Int("port", defaults.Port, "Port to run the server on ($"+config.PortEnv+")")
+	portProbeFlag := flag.Bool("port-probe", defaults.PortProbe, "Try the next ports when the port is in use ($"+config.PortProbeEnv+")")
+	devFlag := flag.Bool("dev", false, "Read the templates from ./"+templateDir+" for every page instead of the embedded ones")
+	tlsCertFlag := flag.String("tls-cert", "", "Certificate file to serve HTTPS with ($"+config.TLSCertEnv+")")
+	tlsKeyFlag := flag.String("tls-key", "", "Private key file of -tls-cert ($"+config.TLSKeyEnv+")")
+	tlsSelfSignedFlag := flag.Bool("tls-self-signed", false, "Serve HTTPS with a self-signed certificate generated in the data directory ($"+config.TLSSelfSignedEnv+")")
+	httpRedirectFlag := flag.Int("http-redirect-port", 0, "Port redirecting plain HTTP to HTTPS, 0 for none ($"+config.HTTPRedirectEnv+")")
+	hstsFlag := flag.Int("hsts-max-age", defaults.HSTSMaxAge, "Seconds browsers keep to HTTPS after a visit, 0 to send no HSTS header ($"+config.HSTSMaxAgeEnv+")")
+	trustedProxiesFlag := flag.String("trusted-proxies", "", "Comma-separated addresses or CIDR ranges of reverse proxies whose X-Forwarded-For is trusted ($"+config.TrustedProxyEnv+")")
+	keyFileFlag := flag.String("master-key-file", "", "File holding the master password of settings.json ($"+config.MasterKeyFileEnv+", default $"+config.MasterPasswordEnv+")")
+	newKeyFileFlag := flag.String("new-master-key-file", "", "File holding the new master password for rotate-key (default $"+config.NewMasterPasswordEnv+")")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [rotate-key]\n\nrotate-key encrypts the passwords in settings.json again with a key derived from a new master password.\n\n", os.Args[0])
+		flag.PrintDefaults()
+	}
 	flag.Parse()
+	if command := flag.Arg(0); flag.NArg() > 1 || (command != "" && command != "rotate-key") {
+		flag.Usage()
+		os.Exit(2)
+	}
 
-	// Load settings
+	// Options from the command line override the environment, which
+	// overrides the options file
+	options, err := loadOptions(*optionsFlag)
+	if err != nil {
+		log.Fatalf("Failed to read the options: %v", err)
+	}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "data-dir":
+			options.DataDir = *dataDirFlag
+		case "settings":
+			options.SettingsFile = *settingsFlag
+		case "bind":
+			options.Bind = *bindFlag
+		case "port":
+			options.Port = *portFlag
+		case "port-probe":
+			options.PortProbe = *portProbeFlag
+		case "master-key-file":
+			options.MasterKeyFile = *keyFileFlag
+		case "tls-cert":
+			options.TLSCert = *tlsCertFlag
+		case "tls-key":
+			options.TLSKey = *tlsKeyFlag
+		case "tls-self-signed":
+			options.TLSSelfSigned = *tlsSelfSignedFlag
+		case "http-redirect-port":
+			options.HTTPRedirectPort = *httpRedirectFlag
+		case "hsts-max-age":
+			options.HSTSMaxAge = *hstsFlag
+		case "trusted-proxies":
+			options.TrustedProxies = config.SplitList(*trustedProxiesFlag)
+		}
+	})
+	if err := options.Validate(); err != nil {
+		log.Fatalf("Invalid options: %v", err)
+	}
+	if err := os.MkdirAll(options.DataDir, 0700); err != nil {
+		log.Fatalf("Failed to create the data directory: %v", err)
+	}
+	settingsFile := options.SettingsPath()
+	handlers.SettingsFile = settingsFile
+	handlers.UsersFile = options.UsersPath()
+
+	// Load settings, asking for the master password when they need one
+	masterPassword, err := config.MasterPassword(config.MasterPasswordEnv, options.MasterKeyFile)
+	if err != nil {
+		log.Fatalf("Failed to read the master password: %v", err)
+	}
 	settings := config.GetSettings()
-	if err := settings.Load("settings.json"); err != nil {
-		log.Printf("Warning: Could not load settings.json: %v", err)
+	err = settings.Load(settingsFile, masterPassword)
+	if errors.Is(err, config.ErrMasterPasswordRequired) && config.CanPrompt() {
+		masterPassword, err = config.PromptPassword("Master password: ")
+		if err == nil {
+			err = settings.Load(settingsFile, masterPassword)
+		}
+	}
+	if err != nil {
+		log.Fatalf("Failed to load %s: %v", settingsFile, err)
+	}
+
+	if flag.Arg(0) == "rotate-key" {
+		if err := rotateKey(settings, settingsFile, *newKeyFileFlag); err != nil {
+			log.Fatalf("Failed to rotate the encryption key: %v", err)
+		}
+		log.Printf("%s is now encrypted with a key derived from the new master password", settingsFile)
+		return
 	}
 
+	// Pick up edits made to settings.json while running
+	settings.Watch(settingsFile, config.SettingsWatchInterval, func(serverIDs []string) {
+		for _, id := range serverIDs {
+			db.Invalidate(id)
+		}
+	})
+
+	if !settings.UsesMasterPassword() {
+		log.Printf("Warning: the encryption key of settings.json is stored in the file itself; set %s and run \"%s rotate-key\" to derive it from a master password", config.NewMasterPasswordEnv, os.Args[0])
+	}
+
+	// Load user accounts
+	users := config.GetUsers()
+	if err := users.Load(options.UsersPath()); err != nil {
+		log.Fatalf("Failed to load %s: %v", options.UsersPath(), err)
+	}
+
+	// Open the audit log of executed statements
+	if err := audit.Open(options.AuditPath()); err != nil {
+		log.Fatalf("Failed to open %s: %v", options.AuditPath(), err)
+	}
+
+	// Drop pooled connections to servers that stop answering
+	db.StartHealthChecks(db.HealthCheckInterval)
+
 	// Initialize i18n
 	if err := i18n.Init(); err != nil {
 		log.Fatalf("Failed to initialize i18n: %v", err)
@@ -66,18 +316,70 @@ func main() {
 	// Initialize Echo
 	e := echo.New()
 	e.HideBanner = true
-	e.Use(middleware.Logger())
+	e.IPExtractor = ipExtractor(options)
+	e.Use(middleware.LoggerWithConfig(middleware.LoggerConfig{
+		// Query strings may carry credentials, so the URI is logged redacted
+		Format: strings.Replace(middleware.DefaultLoggerConfig.Format, "${uri}", "${custom}", 1),
+		CustomTagFunc: func(c echo.Context, buf *bytes.Buffer) (int, error) {
+			return buf.WriteString(redact.URI(c.Request().RequestURI))
+		},
+	}))
 	e.Use(middleware.Recover())
+	if options.TLS() && options.HSTSMaxAge > 0 {
+		// Only the HSTS header; browsers ignore it on certificates they
+		// do not trust, so it does not lock out a self-signed certificate
+		e.Use(middleware.SecureWithConfig(middleware.SecureConfig{
+			HSTSMaxAge:            options.HSTSMaxAge,
+			HSTSExcludeSubdomains: true,
+		}))
+	}
 	e.Use(i18n.Middleware())
+	// Every POST, including the login and the JSON APIs, must carry the token
+	// of the _csrf cookie in the _csrf form field or the X-CSRF-Token header
+	e.Use(middleware.CSRFWithConfig(middleware.CSRFConfig{
+		TokenLookup:    "form:_csrf,header:" + echo.HeaderXCSRFToken,
+		CookieName:     "_csrf",
+		CookiePath:     "/",
+		CookieHTTPOnly: true,
+		CookieSameSite: http.SameSiteStrictMode,
+		CookieSecure:   options.TLS(),
+		ErrorHandler: func(err error, c echo.Context) error {
+			return echo.NewHTTPError(http.StatusForbidden, i18n.T(c, "error_csrf"))
+		},
+	}))
+	e.Use(auth.Middleware())
 
 	// Setup template renderer with translation function
 	funcMap := template.FuncMap{
 		"T": func(c echo.Context, key string) string {
 			return i18n.T(c, key)
 		},
+		"isNull": func(v interface{}) bool {
+			return v == nil
+		},
+		"currentUser": func(c echo.Context) *config.User {
+			return auth.CurrentUser(c)
+		},
+		"can": func(c echo.Context, serverID string, role string) bool {
+			return auth.CurrentUser(c).Can(serverID, config.Role(role))
+		},
+		"csrfToken": csrfToken,
+		"csrfField": func(c echo.Context) template.HTML {
+			return template.HTML(`<input type="hidden" name="_csrf" value="` + template.HTMLEscapeString(csrfToken(c)) + `">`)
+		},
+	}
+	templates, err := fs.Sub(templateFS, templateDir)
+	if err != nil {
+		log.Fatalf("Failed to load templates: %v", err)
+	}
+	if *devFlag {
+		templates = os.DirFS(templateDir)
+		log.Printf("Development mode: reading templates from %s for every page", templateDir)
 	}
 	renderer := &TemplateRenderer{
-		templates: template.Must(template.New("").Funcs(funcMap).ParseGlob("templates/*.html")),
+		templates: template.Must(parseTemplates(templates, funcMap)),
+		dev:       *devFlag,
+		funcMap:   funcMap,
 	}
 	e.Renderer = renderer
 
@@ -86,6 +388,19 @@ func main() {
 		return c.Redirect(302, "/servers")
 	})
 
+	// Authentication routes
+	e.GET("/login", handlers.LoginPage)
+	e.POST("/login", handlers.Login)
+	e.POST("/logout", handlers.Logout)
+	e.GET("/setup", handlers.SetupPage)
+	e.POST("/setup", handlers.Setup)
+	e.GET("/account", handlers.AccountPage)
+	e.POST("/account/password", handlers.ChangePassword)
+	e.POST("/users", handlers.CreateUser)
+	e.POST("/users/:username/password", handlers.ResetPassword)
+	e.POST("/users/:username/roles", handlers.UpdateRoles)
+	e.POST("/users/:username/delete", handlers.DeleteUser)
+
 	// Server management routes
 	e.GET("/servers", handlers.ServersPage)
 	e.GET("/servers/new", handlers.AddServerPage)
@@ -93,14 +408,18 @@ func main() {
 	e.GET("/servers/:id/edit", handlers.EditServerPage)
 	e.GET("/servers/:id/info", handlers.ServerInfoPage)
 	e.GET("/servers/:id/privileges", handlers.UserPrivilegesPage)
+	e.GET("/servers/:id/audit", handlers.AuditPage)
+	e.GET("/servers/:id/audit/download", handlers.AuditDownload)
 	e.POST("/servers/:id", handlers.UpdateServer)
 	e.POST("/servers/:id/delete", handlers.DeleteServer)
 
 	// API routes
 	e.POST("/api/test-connection", handlers.TestConnectionAPI)
-	e.GET("/api/databases", handlers.GetDatabasesAPI)
+	e.POST("/api/databases", handlers.GetDatabasesAPI)
+	e.GET("/api/tree", handlers.TreeAPI)
 	e.POST("/api/database/create", handlers.CreateDatabaseAPI)
 	e.GET("/api/user-grants", handlers.GetUserGrantsAPI)
+	e.POST("/api/sql/execute", handlers.ExecuteSQLAPI)
 	e.GET("/api/set-language", func(c echo.Context) error {
 		lang := c.QueryParam("lang")
 		if lang != "ja" && lang != "en" {
@@ -113,6 +432,7 @@ func main() {
 			Path:     "/",
 			MaxAge:   365 * 24 * 60 * 60, // 1 year
 			HttpOnly: true,
+			Secure:   c.IsTLS(),
 		}
 		c.SetCookie(cookie)
 
@@ -129,18 +449,74 @@ func main() {
 	e.GET("/servers/:id/db/:db/table/:table", handlers.TableDataPage)
 	e.GET("/servers/:id/db/:db/table/:table/details", handlers.TableDetailsPage)
 	e.GET("/servers/:id/db/:db/table/:table/edit", handlers.TableEditPage)
-	e.GET("/servers/:id/db/:db/table/:table/delete", handlers.DeleteTable)
+	e.POST("/servers/:id/db/:db/table/:table/edit", handlers.TableEditSave)
+	e.POST("/servers/:id/db/:db/table/:table/delete", handlers.DeleteTable)
 	e.GET("/servers/:id/db/:db/table/:table/row", handlers.RowDetailsPage)
+	e.GET("/servers/:id/db/:db/table/:table/row/new", handlers.InsertRowPage)
+	e.POST("/servers/:id/db/:db/table/:table/row/new", handlers.InsertRowPage)
+	e.GET("/servers/:id/db/:db/table/:table/row/edit", handlers.EditRowPage)
+	e.POST("/servers/:id/db/:db/table/:table/row/edit", handlers.EditRowPage)
+	e.POST("/servers/:id/db/:db/table/:table/row/delete", handlers.DeleteRow)
 	e.GET("/servers/:id/db/:db/export", handlers.ExportPage)
 	e.POST("/servers/:id/db/:db/export", handlers.ExportData)
+	e.POST("/servers/:id/db/:db/export/start", handlers.StartExport)
+	e.GET("/servers/:id/db/:db/export/progress", handlers.ExportProgress)
+	e.GET("/servers/:id/db/:db/import", handlers.ImportPage)
+	e.POST("/servers/:id/db/:db/import", handlers.ImportData)
+	e.GET("/servers/:id/db/:db/sql", handlers.SQLPage)
+	e.POST("/servers/:id/db/:db/sql", handlers.SQLPage)
 	e.GET("/servers/:id/table/:table", handlers.TableDataPage)   // Legacy route
 	e.GET("/servers/:id/tables", handlers.TablesPage)            // Legacy route
 
-	// Find available port
-	port := findAvailablePort(*portFlag)
-	addr := ":" + strconv.Itoa(port)
+	// Find available port, unless the port is fixed
+	port := options.Port
+	if options.PortProbe {
+		port = findAvailablePort(options.Bind, port)
+	}
+	addr := net.JoinHostPort(options.Bind, strconv.Itoa(port))
+
+	// Serve HTTPS when a certificate is given or generated
+	scheme := "http"
+	certFile, keyFile := options.TLSFiles()
+	if options.TLS() {
+		scheme = "https"
+	}
+	if options.TLSSelfSigned {
+		fingerprint, generated, err := config.EnsureSelfSignedCert(certFile, keyFile, certificateHosts(options.Bind))
+		if err != nil {
+			log.Fatalf("Failed to set up the self-signed certificate: %v", err)
+		}
+		if generated {
+			log.Printf("Generated a self-signed certificate in %s", certFile)
+		}
+		log.Printf("The browser will warn about the self-signed certificate; accept it only if its SHA-256 fingerprint is %s", fingerprint)
+	}
+	if options.HTTPRedirectPort != 0 {
+		redirect := &http.Server{
+			Addr:              net.JoinHostPort(options.Bind, strconv.Itoa(options.HTTPRedirectPort)),
+			Handler:           redirectToHTTPS(port),
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		go func() {
+			log.Fatalf("Failed to redirect HTTP to HTTPS: %v", redirect.ListenAndServe())
+		}()
+		log.Printf("Redirecting %s to HTTPS", serverURL("http", options.Bind, options.HTTPRedirectPort))
+	}
+
+	// Until the first account exists, the setup page asks for a token that
+	// only whoever can read this log knows
+	if users.Count() == 0 {
+		token, err := auth.NewSetupToken()
+		if err != nil {
+			log.Fatalf("Failed to create setup token: %v", err)
+		}
+		log.Printf("No user accounts yet. Create the administrator at %s/setup?token=%s", serverURL(scheme, options.Bind, port), token)
+	}
 
 	// Start server
-	log.Printf("Starting server on http://localhost%s", addr)
+	log.Printf("Starting server on %s", serverURL(scheme, options.Bind, port))
+	if options.TLS() {
+		e.Logger.Fatal(e.StartTLS(addr, certFile, keyFile))
+	}
 	e.Logger.Fatal(e.Start(addr))
 }
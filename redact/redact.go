@@ -0,0 +1,76 @@
+// Package redact removes passwords and other secrets from text that ends up
+// in logs, error messages and pages.
+package redact
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+)
+
+// Mask replaces a redacted value
+const Mask = "***"
+
+// minSecretLength is the shortest secret replaced in free text. Shorter ones
+// would mangle the rest of the message.
+const minSecretLength = 4
+
+// sensitiveParams are the query parameters whose values are never logged
+var sensitiveParams = map[string]bool{
+	"password":           true,
+	"passwd":             true,
+	"pwd":                true,
+	"secret":             true,
+	"token":              true,
+	"_csrf":              true,
+	"ssh_password":       true,
+	"ssh_key_passphrase": true,
+}
+
+// URI masks the values of sensitive query parameters in a request URI.
+func URI(uri string) string {
+	path, rawQuery, found := strings.Cut(uri, "?")
+	if !found {
+		return uri
+	}
+
+	params := strings.Split(rawQuery, "&")
+	for i, param := range params {
+		key, _, hasValue := strings.Cut(param, "=")
+		name, err := url.QueryUnescape(key)
+		if err != nil {
+			name = key
+		}
+		if hasValue && sensitiveParams[strings.ToLower(name)] {
+			params[i] = key + "=" + Mask
+		}
+	}
+	return path + "?" + strings.Join(params, "&")
+}
+
+// String replaces the secrets in s, as written and as escaped in URLs.
+func String(s string, secrets ...string) string {
+	for _, secret := range secrets {
+		if len(secret) < minSecretLength {
+			continue
+		}
+		for _, form := range []string{secret, url.QueryEscape(secret), url.PathEscape(secret), url.UserPassword("", secret).String()[1:]} {
+			s = strings.ReplaceAll(s, form, Mask)
+		}
+	}
+	return s
+}
+
+// Error returns err with the secrets replaced in its message, or err itself
+// when it does not contain them.
+func Error(err error, secrets ...string) error {
+	if err == nil {
+		return nil
+	}
+	message := err.Error()
+	redacted := String(message, secrets...)
+	if redacted == message {
+		return err
+	}
+	return errors.New(redacted)
+}